@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wangkuiyi/ci/db"
+)
+
+// TestApproveHandler approves a build while the main loop is busy
+func TestApproveHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "approve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := db.Open(path.Join(dir, "ci.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	b, err := d.CreateBuild(db.PullRequest, "url", "refs/pull/1/head", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetStatus(db.BuildAwaitingApproval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventQueue := make(chan interface{})
+	h := &HTTPServer{db: d, eventQueue: eventQueue}
+	approve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/approve/1", nil)
+		req.SetBasicAuth("admin", "password")
+		res := httptest.NewRecorder()
+		h.approveHandler(res, mux.SetURLVars(req, map[string]string{"buildID": "1"}))
+		return res
+	}
+
+	// nothing takes events from the queue yet
+	if res := approve(); res.Code != http.StatusSeeOther {
+		t.Fatal(res.Code, res.Body.String())
+	}
+	if s, err := b.Status(); err != nil || s != db.BuildQueued {
+		t.Fatal(s, err)
+	}
+	if a, ok, err := b.Approval(); err != nil || !ok || a.By != "admin" {
+		t.Fatal(a, ok, err)
+	}
+	select {
+	case ev := <-eventQueue:
+		if e, ok := ev.(approveEvent); !ok || e.BuildID != 1 {
+			t.Fatal(ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no approve event")
+	}
+
+	if res := approve(); res.Code != http.StatusConflict {
+		t.Fatal(res.Code, res.Body.String())
+	}
+}
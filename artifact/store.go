@@ -0,0 +1,116 @@
+// Package artifact implements a content-addressed store on local
+// disk for files produced by builds.
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Store keeps artifacts in dir, each artifact is saved as a file
+// named after the SHA256 checksum of its content, so identical
+// artifacts of different builds are stored once.
+type Store struct {
+	dir string
+}
+
+// NewStore creates a store given the directory to keep artifacts
+func NewStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put copies file into the store, returns the hex encoded SHA256
+// checksum and size of the file.
+func (s *Store) Put(file string) (sum string, size int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile(s.dir, ".upload")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, h), f)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	sum = hex.EncodeToString(h.Sum(nil))
+	p, err := s.Path(sum)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), p)
+	return
+}
+
+// Path returns the path of the artifact given its checksum
+func (s *Store) Path(sum string) (string, error) {
+	b, err := hex.DecodeString(sum)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid artifact checksum: %q", sum)
+	}
+	return path.Join(s.dir, sum[:2], sum), nil
+}
+
+// Open opens the artifact given its checksum for reading
+func (s *Store) Open(sum string) (*os.File, error) {
+	p, err := s.Path(sum)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Sweep removes artifacts not in keep and last modified before
+// before, returns the number of removed artifacts. Recently modified
+// artifacts are kept since they may be uploaded by running builds
+// which have not recorded them yet.
+func (s *Store) Sweep(keep map[string]bool, before time.Time) (int, error) {
+	files, err := filepath.Glob(path.Join(s.dir, "*", "*"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		sum := path.Base(f)
+		if _, err := s.Path(sum); err != nil || keep[sum] {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil || !fi.ModTime().Before(before) {
+			continue
+		}
+		err = os.Remove(f)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
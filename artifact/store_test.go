@@ -0,0 +1,73 @@
+package artifact_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/artifact"
+)
+
+func TestPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := artifact.NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := path.Join(dir, "a.txt")
+	err = ioutil.WriteFile(f, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, size, err := s.Put(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" || size != 5 {
+		t.Fatal(sum, size)
+	}
+
+	r, err := s.Open(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatal(string(b))
+	}
+
+	_, err = s.Open("../a.txt")
+	if err == nil {
+		t.FailNow()
+	}
+
+	n, err := s.Sweep(map[string]bool{sum: true}, time.Now().Add(time.Hour))
+	if err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	n, err = s.Sweep(nil, time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	n, err = s.Sweep(nil, time.Now().Add(time.Hour))
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	_, err = s.Open(sum)
+	if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
@@ -4,48 +4,75 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/wangkuiyi/ci/artifact"
+	"github.com/wangkuiyi/ci/cache"
 	"github.com/wangkuiyi/ci/db"
 	"github.com/wangkuiyi/ci/github"
+	"github.com/wangkuiyi/ci/report"
 )
 
+// Values of builds are read from CI_* environment variables, see scriptEnv.
 const (
 	bootstrapTpl = `#!/bin/bash
 echo "Setting Environments"
 set -x
 {{range $envKey, $envVal := .Env}}
-export {{$envKey}}="{{$envVal}}"
+export {{$envKey}}={{quote $envVal}}
 {{end}}
 set +x
 set -e
 `
 	pushEventCloneTpl = `
 set -x
-cd {{.BuildPath}}
-git clone --depth 1 {{.CloneURL}} repo
+cd "$CI_BUILD_PATH"
+if [ -n "$CI_MIRROR" ]; then
+	git clone --reference "$CI_MIRROR" --dissociate -- "$CI_CLONE_URL" repo || {
+		rm -rf repo
+		git clone -- "$CI_CLONE_URL" repo
+	}
+else
+	git clone --depth 1 -- "$CI_CLONE_URL" repo
+fi
 cd repo
-git fetch origin {{.Ref}}
-git checkout -qf {{.Head}}
+git fetch origin "$CI_REF"
+git checkout -qf "$CI_HEAD"
+if [ -n "$CI_SUBMODULE_MIRRORS" ]; then
+	while IFS=$'\t' read -r sub mirror; do
+		git submodule update --init --reference "$mirror" --dissociate -- "$sub" || true
+	done <<< "$CI_SUBMODULE_MIRRORS"
+fi
 git submodule update --init
 `
 	executeTpl = `
 set +x
-if [ -f {{.CIPath}} ]; then
-	source {{.CIPath}}
+cd "$CI_BUILD_PATH/repo"
+if [ -f "$CI_SCRIPT" ]; then
+	source "$CI_SCRIPT"
 else
-	echo "{{.CIPath}} not found, it seems the ci script is not configured."
+	echo "$CI_SCRIPT not found, it seems the ci script is not configured."
 fi
 `
 	cleanTpl = `#!/bin/bash
-rm -rf {{.BuildPath}}/*
+rm -rf "$CI_BUILD_PATH"/*
 `
 )
 
@@ -58,6 +85,25 @@ type Builder struct {
 	ciPath      string
 	env         map[string]string
 
+	artifacts     *artifact.Store // store of files produced by builds
+	artifactGlobs []string        // files to keep after build, relative to repository
+
+	reportGlobs   []string // test reports written by the ci script, relative to repository
+	coverageGlobs []string // coverage reports written by the ci script, relative to repository
+	annotateFlaky bool     // annotate failed statuses of pull requests whose failed tests are flaky
+
+	caches        *cache.Store // store of directories shared between builds
+	cacheSettings []cacheSetting
+
+	mirrors *Mirrors // mirrors of repositories shared between builds
+
+	secrets     map[string]string // secret environment variable name to the file of its value
+	forkSecrets bool              // pass secrets to approved pull requests from forks
+	cloneURL    string            // of the repository, builds cloning other repositories get no secrets unless approved
+
+	releasePath    string            // release script filename, ciPath if empty
+	releaseSecrets map[string]string // secrets passed to release builds only
+
 	bootstrapTpl      *template.Template // the build bootstrap template, including setting environment, etc.
 	pushEventCloneTpl *template.Template // git clone template for push event.
 	execTpl           *template.Template // execute ci scripts template.
@@ -66,9 +112,21 @@ type Builder struct {
 	github *github.API // github api
 }
 
+// cacheSetting declares directories to be cached between builds
+type cacheSetting struct {
+	// Key identifies the content of the cache. It is a template
+	// which can call checksum on files in the repository, such as
+	// deps-{{ checksum "requirements.txt" }}
+	Key string
+	// Paths are directories or files to cache, relative to repository
+	Paths []string
+}
+
 // New builder instance.
 // It will create the building directory for each go routine. The building dir can be configured in configuration file.
-func newBuilder(jobChan <-chan db.Build, github *github.API, concurrency int, dir, ciPath string, env map[string]string) (builder *Builder, err error) {
+// cloneURL is the clone URL of the repository.
+func newBuilder(jobChan <-chan db.Build, github *github.API, cloneURL string, artifacts *artifact.Store, caches *cache.Store, dir string, s *setting) (builder *Builder, err error) {
+	concurrency := s.Concurrency
 	for i := 0; i < concurrency; i++ {
 		path := path.Join(dir, strconv.Itoa(i))
 		err = os.MkdirAll(path, 0755)
@@ -76,17 +134,68 @@ func newBuilder(jobChan <-chan db.Build, github *github.API, concurrency int, di
 			return
 		}
 	}
+	mirrors, err := newMirrors(path.Join(dir, "mirrors"))
+	if err != nil {
+		return
+	}
 
 	builder = &Builder{
 		jobChan:     jobChan,
 		dir:         dir,
-		ciPath:      ciPath,
-		env:         env,
+		ciPath:      s.Github.Filename,
+		env:         s.Env,
 		concurrency: concurrency,
 		github:      github,
+
+		artifacts:     artifacts,
+		artifactGlobs: s.Artifacts,
+
+		reportGlobs:   s.TestReports,
+		coverageGlobs: s.Coverage,
+		annotateFlaky: s.Flaky.Annotate,
+
+		caches:        caches,
+		cacheSettings: s.Caches,
+
+		mirrors: mirrors,
+		secrets: s.Secrets,
+
+		forkSecrets: s.Forks.Secrets,
+		cloneURL:    cloneURL,
+
+		releasePath:    s.Release.Filename,
+		releaseSecrets: s.Release.Secrets,
 	}
 
-	builder.bootstrapTpl, err = template.New("bootstrap").Parse(bootstrapTpl)
+	for _, secrets := range []map[string]string{s.Secrets, s.Release.Secrets} {
+		for name := range secrets {
+			if !envName.MatchString(name) {
+				err = fmt.Errorf("invalid secret name: %q", name)
+				return
+			}
+		}
+	}
+
+	for i := range s.Caches {
+		_, err = builder.cacheKeyTpl(i, "")
+		if err != nil {
+			err = fmt.Errorf("invalid key of cache %d: %v", i, err)
+			return
+		}
+	}
+
+	for name, v := range s.Env {
+		if !envName.MatchString(name) {
+			err = fmt.Errorf("invalid environment variable name: %q", name)
+			return
+		}
+		if strings.ContainsRune(v, 0) {
+			err = fmt.Errorf("environment variable %s contains a NUL byte", name)
+			return
+		}
+	}
+
+	builder.bootstrapTpl, err = template.New("bootstrap").Funcs(template.FuncMap{"quote": shellQuote}).Parse(bootstrapTpl)
 	if err != nil {
 		return
 	}
@@ -111,19 +220,32 @@ func (b *Builder) builderMain(id int) {
 		if !ok {
 			break
 		}
-		log.Println("begin build", build.ID, build.Ref, build.CommitSHA)
-		err := b.build(build, path)
+		attempt, err := build.NewAttempt(strconv.Itoa(id))
 		if err != nil {
-			build.SetStatus(db.BuildError)
-			build.AppendOutput(db.OutputLine{T: db.Error, Str: err.Error(), Time: time.Now()})
-			b.github.CreateStatus(build.CommitSHA, github.Failure)
+			log.Println(err)
+			continue
+		}
+		log.Println("begin build", build.ID, "attempt", attempt.Num, build.Ref, build.CommitSHA)
+		secrets, err := b.loadSecrets(build)
+		if err == nil {
+			var values []string
+			for _, v := range secrets {
+				values = append(values, v)
+			}
+			attempt.Mask(values...)
+			err = b.build(build, attempt, path, secrets)
+		}
+		if err != nil {
+			attempt.SetStatus(db.BuildError)
+			attempt.AppendOutput(db.OutputLine{T: db.Error, Str: err.Error(), Time: time.Now()})
+			b.createStatus(build, github.Failure, "")
 			log.Println(err)
 			continue
 		}
 	}
 }
 
-func run(b db.Build, cmd *exec.Cmd) error {
+func run(a db.Attempt, cmd *exec.Cmd) error {
 	o, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -140,7 +262,7 @@ func run(b db.Build, cmd *exec.Cmd) error {
 	go func() {
 		s := bufio.NewScanner(o)
 		for s.Scan() {
-			b.AppendOutput(db.OutputLine{T: db.Stdout, Str: s.Text(), Time: time.Now()})
+			a.AppendOutput(db.OutputLine{T: db.Stdout, Str: s.Text(), Time: time.Now()})
 		}
 		close(waitOut)
 	}()
@@ -148,7 +270,7 @@ func run(b db.Build, cmd *exec.Cmd) error {
 	go func() {
 		s := bufio.NewScanner(e)
 		for s.Scan() {
-			b.AppendOutput(db.OutputLine{T: db.Stderr, Str: s.Text(), Time: time.Now()})
+			a.AppendOutput(db.OutputLine{T: db.Stderr, Str: s.Text(), Time: time.Now()})
 		}
 		close(waitErr)
 	}()
@@ -161,13 +283,94 @@ func run(b db.Build, cmd *exec.Cmd) error {
 	return nil
 }
 
-// Execute ci scripts for Build with id = bid, path as directory
-func (b *Builder) build(build db.Build, path string) error {
-	err := build.SetStatus(db.BuildRunning)
+// minSecretLen is the minimal length of secret values. Secrets are
+// masked in output, masking shorter values garbles the output.
+const minSecretLen = 4
+
+// loadSecrets reads secret values of build from their files, returns
+// secret name to value. Release builds get release secrets as well.
+// Secrets shorter than minSecretLen are refused rather than leaked.
+func (b *Builder) loadSecrets(build db.Build) (map[string]string, error) {
+	files := []map[string]string{b.secrets}
+	if build.T == db.Release {
+		files = append(files, b.releaseSecrets)
+	}
+	secrets := make(map[string]string)
+	for _, f := range files {
+		for name, file := range f {
+			v, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("read secret %s: %v", name, err)
+			}
+			secrets[name] = strings.TrimRight(string(v), "\r\n")
+			// a short value is masked wherever it appears in the output
+			if len(strings.TrimSpace(secrets[name])) < minSecretLen {
+				return nil, fmt.Errorf("secret %s is shorter than %d bytes", name, minSecretLen)
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// scriptPath returns the filename of the script build runs, release
+// builds run the release script if it is set.
+func (b *Builder) scriptPath(build db.Build) string {
+	if build.T == db.Release && b.releasePath != "" {
+		return b.releasePath
+	}
+	return b.ciPath
+}
+
+// createStatus posts the status of build to github in the context of
+// its type, so that statuses of release and scheduled builds do not
+// overwrite the status of the push build of the same commit. Push and
+// pull request builds post in the default context. The description
+// is the description of the ci if empty.
+func (b *Builder) createStatus(build db.Build, status, description string) error {
+	var statusContext string
+	switch build.T {
+	case db.Release:
+		statusContext = "ci/release"
+	case db.Scheduled:
+		statusContext = "ci/schedule/" + build.Schedule
+	}
+	return b.github.CreateStatusInContext(build.CommitSHA, statusContext, status, description)
+}
+
+// ownRepo returns whether build clones the repository of the ci
+// rather than a fork.
+func (b *Builder) ownRepo(build db.Build) bool {
+	return !build.PR.Fork && strings.EqualFold(build.CloneURL, b.cloneURL)
+}
+
+// withholdSecrets returns whether secrets are withheld from build.
+// Pull requests from forks get secrets only if they are approved and
+// the fork policy allows. Other builds get secrets only if they clone
+// the repository of the ci.
+func (b *Builder) withholdSecrets(build db.Build) (bool, error) {
+	if !build.PR.Fork {
+		return !b.ownRepo(build), nil
+	}
+	if !b.forkSecrets {
+		return true, nil
+	}
+	_, approved, err := build.Approval()
+	return !approved, err
+}
+
+// Execute ci scripts for an attempt of build, path as directory.
+// secrets are passed to ci scripts as environment variables, so that
+// they never appear in generated scripts.
+func (b *Builder) build(build db.Build, attempt db.Attempt, path string, secrets map[string]string) error {
+	err := attempt.SetStatus(db.BuildRunning)
 	if err != nil {
 		return err
 	}
-	err = b.github.CreateStatus(build.CommitSHA, github.Pending)
+	err = checkBuild(build)
+	if err != nil {
+		return err
+	}
+	err = b.createStatus(build, github.Pending, "")
 	if err != nil {
 		return err
 	}
@@ -178,102 +381,509 @@ func (b *Builder) build(build db.Build, path string) error {
 		return err
 	}
 
-	err = b.pushEventCloneTpl.Execute(&buffer, struct {
-		CloneURL  string
-		Ref       string
-		Head      string
-		BuildPath string
-	}{CloneURL: build.CloneURL, Ref: build.Ref, Head: build.CommitSHA, BuildPath: path})
+	mirror, subMirrors, err := b.mirrors.Update(build.CloneURL, build.CommitSHA)
 	if err != nil {
-		return err
+		msg := fmt.Sprintf("Update mirror: %v, fall back to a clean clone", err)
+		if mirror != "" {
+			msg = fmt.Sprintf("Update mirror: %v, clone with the mirror as it is", err)
+		}
+		err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: msg, Time: time.Now()})
+		if err != nil {
+			return err
+		}
 	}
 
-	err = b.execTpl.Execute(&buffer, struct{ CIPath string }{CIPath: b.ciPath})
+	env := scriptEnv(build, path, mirror, subMirrors, b.scriptPath(build))
+	err = b.pushEventCloneTpl.Execute(&buffer, nil)
 	if err != nil {
 		return err
 	}
 
-	cmd, err := genCmd(path, buffer.Bytes())
+	cmd, err := genCmd(path, buffer.Bytes(), env)
 	if err != nil {
 		return err
 	}
 
-	var stdout, stderr bytes.Buffer
-	err = build.AppendOutput(db.OutputLine{T: db.Info, Str: "Running build commands", Time: time.Now()})
+	err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Running clone commands", Time: time.Now()})
 	if err != nil {
 		return err
 	}
-	buildErr := run(build, cmd)
+	buildErr := run(attempt, cmd)
+
+	repo := filepath.Join(path, "repo")
+	var missed []int
+	var coverage string // status description reporting coverage
+	if buildErr == nil {
+		missed, err = b.restoreCaches(build, attempt, repo)
+		if err != nil {
+			return err
+		}
+
+		buffer.Reset()
+		err = b.bootstrapTpl.Execute(&buffer, struct{ Env map[string]string }{Env: b.env})
+		if err != nil {
+			return err
+		}
+		err = b.execTpl.Execute(&buffer, nil)
+		if err != nil {
+			return err
+		}
+
+		withhold, err := b.withholdSecrets(build)
+		if err != nil {
+			return err
+		}
+		execEnv := append([]string(nil), env...)
+		if len(secrets) > 0 {
+			if withhold {
+				err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Secrets are withheld from this build of a fork", Time: time.Now()})
+				if err != nil {
+					return err
+				}
+			} else {
+				for name, v := range secrets {
+					execEnv = append(execEnv, name+"="+v)
+				}
+			}
+		}
+		cmd, err = genCmd(path, buffer.Bytes(), execEnv)
+		if err != nil {
+			return err
+		}
+
+		err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Running build commands", Time: time.Now()})
+		if err != nil {
+			return err
+		}
+		buildErr = run(attempt, cmd)
+		err = b.collectTestReports(attempt, repo)
+		if err != nil {
+			return err
+		}
+		coverage, err = b.collectCoverage(build, attempt, repo)
+		if err != nil {
+			return err
+		}
+		err = b.uploadArtifacts(build, attempt, repo)
+		if err != nil {
+			return err
+		}
+	}
+
 	if buildErr != nil {
-		err = build.AppendOutput(db.OutputLine{T: db.Error, Str: buildErr.Error(), Time: time.Now()})
+		err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: buildErr.Error(), Time: time.Now()})
+		if err != nil {
+			return err
+		}
+		err = attempt.SetStatus(db.BuildFailed)
 		if err != nil {
 			return err
 		}
-		err = build.SetStatus(db.BuildFailed)
+		desc, err := b.flakyFailure(build, attempt)
 		if err != nil {
 			return err
 		}
-		err = b.github.CreateStatus(build.CommitSHA, github.Error)
+		err = b.createStatus(build, github.Error, desc)
 		if err != nil {
 			return err
 		}
 	} else {
-		err = build.AppendOutput(db.OutputLine{T: db.Info, Str: "Exit 0", Time: time.Now()})
+		err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Exit 0", Time: time.Now()})
 		if err != nil {
 			return err
 		}
-		err = build.SetStatus(db.BuildSuccess)
+		err = b.saveCaches(build, attempt, repo, missed)
 		if err != nil {
 			return err
 		}
-		err = b.github.CreateStatus(build.CommitSHA, github.Success)
+		err = attempt.SetStatus(db.BuildSuccess)
+		if err != nil {
+			return err
+		}
+		err = b.createStatus(build, github.Success, coverage)
 		if err != nil {
 			return err
 		}
 	}
 
-	stdout, stderr = bytes.Buffer{}, bytes.Buffer{}
 	var buf bytes.Buffer
-	err = b.cleanTpl.Execute(&buf, struct {
-		BuildPath string
-	}{BuildPath: path})
+	err = b.cleanTpl.Execute(&buf, nil)
 	if err != nil {
 		return err
 	}
 
-	cmd, err = genCmd(path, buf.Bytes())
+	cmd, err = genCmd(path, buf.Bytes(), env)
 	if err != nil {
 		return err
 	}
 
-	err = build.AppendOutput(db.OutputLine{T: db.Info, Str: "Running clean commands", Time: time.Now()})
+	err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Running clean commands", Time: time.Now()})
 	if err != nil {
 		return err
 	}
-	buildErr = run(build, cmd)
-	err = build.AppendOutput(db.OutputLine{T: db.Stdout, Str: string(stdout.Bytes()), Time: time.Now()})
+	buildErr = run(attempt, cmd)
+	if buildErr != nil {
+		err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: buildErr.Error(), Time: time.Now()})
+		if err != nil {
+			return err
+		}
+	} else {
+		err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Exit 0", Time: time.Now()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum returns the hex encoded SHA256 checksum of file, it is
+// called by cache key templates.
+func checksum(file string) (string, error) {
+	f, err := os.Open(file)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = build.AppendOutput(db.OutputLine{T: db.Stderr, Str: string(stderr.Bytes()), Time: time.Now()})
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	if buildErr != nil {
-		err = build.AppendOutput(db.OutputLine{T: db.Error, Str: buildErr.Error(), Time: time.Now()})
+// cacheKeyTpl parses the key template of the i-th cache, checksum in
+// the template refers to files relative to repo.
+func (b *Builder) cacheKeyTpl(i int, repo string) (*template.Template, error) {
+	return template.New("cacheKey").Funcs(template.FuncMap{"checksum": func(file string) (string, error) {
+		return checksum(filepath.Join(repo, file))
+	}}).Parse(b.cacheSettings[i].Key)
+}
+
+// cacheKey evaluates the key of the i-th cache of build in repo.
+// Builds of forks have keys of their own, so they can neither poison
+// nor read caches restored by builds of the ci's repository.
+func (b *Builder) cacheKey(build db.Build, i int, repo string) (string, error) {
+	tpl, err := b.cacheKeyTpl(i, repo)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if !b.ownRepo(build) {
+		buf.WriteString("fork/")
+	}
+	err = tpl.Execute(&buf, nil)
+	return buf.String(), err
+}
+
+// restoreCaches restores caches of build into repo, returns the indices of
+// caches which are not found.
+func (b *Builder) restoreCaches(build db.Build, attempt db.Attempt, repo string) ([]int, error) {
+	var missed []int
+	for i := range b.cacheSettings {
+		key, err := b.cacheKey(build, i, repo)
+		if err != nil {
+			err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: fmt.Sprintf("Cache key: %v", err), Time: time.Now()})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ok, err := b.caches.Restore(key, repo)
+		msg := "Restored cache " + key
+		if err != nil {
+			msg = fmt.Sprintf("Restore cache %s: %v", key, err)
+		} else if !ok {
+			msg = "No cache for " + key
+			missed = append(missed, i)
+		}
+		err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: msg, Time: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return missed, nil
+}
+
+// saveCaches saves the caches of build of given indices from repo
+func (b *Builder) saveCaches(build db.Build, attempt db.Attempt, repo string, indices []int) error {
+	for _, i := range indices {
+		key, err := b.cacheKey(build, i, repo)
+		if err != nil {
+			// already reported by restoreCaches
+			continue
+		}
+		msg := "Saved cache " + key
+		err = b.caches.Save(key, repo, b.cacheSettings[i].Paths)
+		if err != nil {
+			msg = fmt.Sprintf("Save cache %s: %v", key, err)
+		}
+		err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: msg, Time: time.Now()})
 		if err != nil {
 			return err
 		}
-	} else {
-		err = build.AppendOutput(db.OutputLine{T: db.Info, Str: "Exit 0", Time: time.Now()})
+	}
+	return nil
+}
+
+// uploadArtifacts copies files in repo matching artifact globs into
+// the artifact store and records them against the build.
+func (b *Builder) uploadArtifacts(build db.Build, attempt db.Attempt, repo string) error {
+	for _, glob := range b.artifactGlobs {
+		matches, err := filepath.Glob(filepath.Join(repo, glob))
 		if err != nil {
 			return err
 		}
+		if len(matches) == 0 {
+			err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "No artifact matches " + glob, Time: time.Now()})
+			if err != nil {
+				return err
+			}
+		}
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil || fi.IsDir() {
+				continue
+			}
+			name, err := filepath.Rel(repo, m)
+			if err != nil {
+				return err
+			}
+			sum, size, err := b.artifacts.Put(m)
+			if err != nil {
+				// a missing artifact does not fail the build, it is
+				// reported in output instead.
+				err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: fmt.Sprintf("Upload artifact %s: %v", name, err), Time: time.Now()})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = build.AddArtifact(db.Artifact{Name: name, SHA256: sum, Size: size, Attempt: attempt.Num, Created: time.Now()})
+			if err != nil {
+				return err
+			}
+			err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: fmt.Sprintf("Uploaded artifact %s sha256:%s", name, sum), Time: time.Now()})
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// collectTestReports parses test reports in repo matching report globs
+// and records the results against the attempt. A report which cannot
+// be parsed does not fail the build, it is reported in output instead.
+func (b *Builder) collectTestReports(attempt db.Attempt, repo string) error {
+	var results []db.TestResult
+	for _, glob := range b.reportGlobs {
+		matches, err := filepath.Glob(filepath.Join(repo, glob))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "No test report matches " + glob, Time: time.Now()})
+			if err != nil {
+				return err
+			}
+		}
+		for _, m := range matches {
+			name, err := filepath.Rel(repo, m)
+			if err != nil {
+				return err
+			}
+			cases, err := parseReport(m)
+			if err != nil {
+				err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: fmt.Sprintf("Parse test report %s: %v", name, err), Time: time.Now()})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			for _, c := range cases {
+				results = append(results, db.TestResult{
+					Suite:    c.Suite,
+					Name:     c.Name,
+					Status:   db.TestStatus(c.Status),
+					Duration: c.Duration,
+					Message:  c.Message,
+				})
+			}
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	output, err := attempt.Output(0, -1)
+	if err != nil {
+		return err
+	}
+	for i, r := range results {
+		if r.Status == db.TestFailed {
+			results[i].Line = failureLine(output, r.Name)
+		}
+	}
+	err = attempt.AddTestResults(results)
+	if err != nil {
+		return err
+	}
+	s := db.SummarizeTests(results)
+	return attempt.AppendOutput(db.OutputLine{T: db.Info, Str: fmt.Sprintf("Tests: %d passed, %d failed, %d skipped", s.Passed, s.Failed, s.Skipped), Time: time.Now()})
+}
+
+// collectCoverage parses coverage reports in repo matching coverage
+// globs and records the coverage against the build. It returns the
+// status description reporting the coverage, with the delta versus
+// the base branch for pull requests, "" if there is no coverage.
+func (b *Builder) collectCoverage(build db.Build, attempt db.Attempt, repo string) (string, error) {
+	cov := report.Coverage{Root: repo}
+	found := false
+	for _, glob := range b.coverageGlobs {
+		matches, err := filepath.Glob(filepath.Join(repo, glob))
+		if err != nil {
+			return "", err
+		}
+		if len(matches) == 0 {
+			err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "No coverage report matches " + glob, Time: time.Now()})
+			if err != nil {
+				return "", err
+			}
+		}
+		for _, m := range matches {
+			name, err := filepath.Rel(repo, m)
+			if err != nil {
+				return "", err
+			}
+			err = parseCoverage(&cov, m)
+			if err != nil {
+				err = attempt.AppendOutput(db.OutputLine{T: db.Error, Str: fmt.Sprintf("Parse coverage report %s: %v", name, err), Time: time.Now()})
+				if err != nil {
+					return "", err
+				}
+				continue
+			}
+			found = true
+		}
+	}
+	if !found {
+		return "", nil
+	}
+
+	var fs []db.FileCoverage
+	for _, f := range cov.Files() {
+		fs = append(fs, db.FileCoverage{File: f.File, Coverage: db.Coverage{Covered: f.Covered, Total: f.Total}})
+	}
+	err := build.SetCoverage(fs)
+	if err != nil {
+		return "", err
+	}
+	desc := fmt.Sprintf("coverage %.1f%%", db.TotalCoverage(fs).Percent())
+	_, base, ok, err := build.BaseCoverage()
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		delta := db.TotalCoverage(fs).Percent() - db.TotalCoverage(base).Percent()
+		desc += fmt.Sprintf(" (%+.1f%% vs %s)", delta, build.PR.Base)
+	}
+	return desc, attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Coverage: " + strings.TrimPrefix(desc, "coverage "), Time: time.Now()})
+}
+
+// parseCoverage parses the coverage report in file into cov
+func parseCoverage(cov *report.Coverage, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cov.Parse(f)
+}
+
+// flakyFailure returns the status description of a failed attempt of
+// a pull request build if all its failed tests are flaky, it returns
+// "" if the failure is not likely flaky or annotating is disabled.
+func (b *Builder) flakyFailure(build db.Build, attempt db.Attempt) (string, error) {
+	if !b.annotateFlaky || build.T != db.PullRequest {
+		return "", nil
+	}
+	fs, err := attempt.FlakyFailures()
+	if err != nil || len(fs) == 0 {
+		return "", err
+	}
+	var names []string
+	for _, f := range fs {
+		if !f.Flaky() {
+			return "", nil
+		}
+		names = append(names, f.Name)
+	}
+	desc := "failure likely flaky: " + strings.Join(names, ", ")
+	err = attempt.AppendOutput(db.OutputLine{T: db.Info, Str: "Failed tests are flaky, the failure is likely flaky", Time: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	// github limits descriptions to 140 characters
+	if r := []rune(desc); len(r) > 140 {
+		desc = string(r[:137]) + "..."
+	}
+	return desc, nil
+}
+
+// parseReport parses the test report in file
+func parseReport(file string) ([]report.Case, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return report.Parse(f)
+}
+
+// failureLine returns the number, starting from 1, of the line in
+// output reporting the failure of test name as go test does, like
+// "--- FAIL: name (0.01s)", or else the first line mentioning name as
+// a whole word. It returns 0 if no line mentions name.
+func failureLine(output []db.OutputLine, name string) uint64 {
+	var first uint64
+	if name == "" {
+		return 0
+	}
+	fail := "--- FAIL: " + name + " "
+	for i, o := range output {
+		if strings.HasPrefix(strings.TrimSpace(o.Str), fail) {
+			return uint64(i + 1)
+		}
+		if first == 0 && mentions(o.Str, name) {
+			first = uint64(i + 1)
+		}
+	}
+	return first
+}
+
+// mentions returns whether s contains name not adjacent to letters,
+// digits or underscores, so that TestA is not mentioned by TestAB.
+func mentions(s, name string) bool {
+	word := func(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+	for i := 0; ; {
+		j := strings.Index(s[i:], name)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(name)
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if (start == 0 || !word(before)) && (end == len(s) || !word(after)) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// envName matches valid names of environment variables
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 // Start all go routines
 func (b *Builder) Start() {
 	for i := 0; i < b.concurrency; i++ {
@@ -281,7 +891,9 @@ func (b *Builder) Start() {
 	}
 }
 
-func genCmd(basepath string, cmd []byte) (c *exec.Cmd, err error) {
+// genCmd writes script cmd into basepath and returns the command to
+// run it with environment variables env added.
+func genCmd(basepath string, cmd []byte, env []string) (c *exec.Cmd, err error) {
 	path := path.Join(basepath, strconv.Itoa(rand.Int()))
 	// the build folder will be cleaned later
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
@@ -294,5 +906,6 @@ func genCmd(basepath string, cmd []byte) (c *exec.Cmd, err error) {
 		return
 	}
 	c = exec.Command(path)
+	c.Env = append(os.Environ(), env...)
 	return
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestFailureLine(t *testing.T) {
+	var output []db.OutputLine
+	for _, s := range []string{
+		"=== RUN   TestAB",
+		"--- FAIL: TestAB (0.01s)",
+		"=== RUN   TestA",
+		"    --- FAIL: TestA/sub (0.00s)",
+		"--- FAIL: TestA (0.02s)",
+		"Test_C failed",
+	} {
+		output = append(output, db.OutputLine{Str: s})
+	}
+	for name, line := range map[string]uint64{
+		"TestAB":    2,
+		"TestA":     5,
+		"TestA/sub": 4,
+		"Test_C":    6,
+		"Test":      0,
+		"":          0,
+	} {
+		if l := failureLine(output, name); l != line {
+			t.Fatal(name, l)
+		}
+	}
+}
+
+func TestNewBuilderSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, s := range map[string]*setting{
+		"secret name": {Secrets: map[string]string{"A-B": "/secret"}},
+		"cache key":   {Caches: []cacheSetting{{Key: "deps-{{ checksum", Paths: []string{"deps"}}}},
+		"env name":    {Env: map[string]string{"1A": "x"}},
+		"env value":   {Env: map[string]string{"A": "x\x00y"}},
+	} {
+		if _, err := newBuilder(nil, nil, "", nil, nil, dir, s); err == nil {
+			t.Fatal(name)
+		}
+	}
+	s := &setting{
+		Secrets: map[string]string{"TOKEN": "/secret"},
+		Caches:  []cacheSetting{{Key: `deps-{{ checksum "go.sum" }}`, Paths: []string{"deps"}}},
+		Env:     map[string]string{"A": "x"},
+	}
+	if _, err := newBuilder(nil, nil, "", nil, nil, dir, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, v := range map[string]string{"long": "token\n", "short": "123\n"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(v), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &Builder{secrets: map[string]string{"TOKEN": filepath.Join(dir, "long")}}
+	secrets, err := b.loadSecrets(db.Build{T: db.Push})
+	if err != nil || secrets["TOKEN"] != "token" {
+		t.Fatal(secrets, err)
+	}
+	b.releaseSecrets = map[string]string{"PIN": filepath.Join(dir, "short")}
+	if _, err := b.loadSecrets(db.Build{T: db.Release}); err == nil {
+		t.Fatal("loaded a short secret")
+	}
+}
@@ -0,0 +1,299 @@
+// Package cache keeps directories of builds, such as downloaded
+// dependencies, on local disk so they can be restored by later builds.
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTooLarge is returned by Save if the cache is larger than the
+// size limit of the store.
+var ErrTooLarge = errors.New("cache is larger than the size limit")
+
+// Store saves caches as gzipped tarballs named after their keys.
+// The total size of the store is kept under maxSize by evicting the
+// least recently used caches. Restoring a cache counts as a use.
+type Store struct {
+	dir     string
+	maxSize int64 // in bytes, 0 means no limit
+
+	mu sync.Mutex
+}
+
+// NewStore creates a store given the directory to keep caches
+func NewStore(dir string, maxSize int64) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, maxSize: maxSize}, nil
+}
+
+func (s *Store) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(s.dir, hex.EncodeToString(sum[:])+".tar.gz")
+}
+
+// Has returns whether a cache of key exists
+func (s *Store) Has(key string) bool {
+	_, err := os.Stat(s.file(key))
+	return err == nil
+}
+
+// Restore extracts the cache of key into dir, returns false if there
+// is no such cache.
+func (s *Store) Restore(key, dir string) (bool, error) {
+	f, err := os.Open(s.file(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	err = os.Chtimes(f.Name(), now, now)
+	if err != nil {
+		return false, err
+	}
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+	return true, untar(tar.NewReader(z), dir)
+}
+
+// Save archives paths, relative to dir, as the cache of key. Then
+// least recently used caches are evicted if the store exceeds its
+// size limit.
+func (s *Store) Save(key, dir string, paths []string) error {
+	tmp, err := ioutil.TempFile(s.dir, ".save")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	z := gzip.NewWriter(tmp)
+	t := tar.NewWriter(z)
+	for _, p := range paths {
+		err = addTar(t, dir, filepath.Clean(p))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = t.Close()
+	if err == nil {
+		err = z.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	fi, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	if s.maxSize > 0 && fi.Size() > s.maxSize {
+		return ErrTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = os.Rename(tmp.Name(), s.file(key))
+	if err != nil {
+		return err
+	}
+	return s.evict()
+}
+
+// evict removes least recently used caches until the total size is
+// under the size limit.
+func (s *Store) evict() error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(path.Join(s.dir, "*.tar.gz"))
+	if err != nil {
+		return err
+	}
+	var fis []os.FileInfo
+	var total int64
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		fis = append(fis, fi)
+		total += fi.Size()
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+	for _, fi := range fis {
+		if total <= s.maxSize {
+			break
+		}
+		err = os.Remove(path.Join(s.dir, fi.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= fi.Size()
+	}
+	return nil
+}
+
+// addTar adds the file or directory p, relative to dir, into t.
+// Paths which do not exist are skipped.
+func addTar(t *tar.Writer, dir, p string) error {
+	if filepath.IsAbs(p) || outside(p) {
+		return errors.New("cache path must be inside the repository: " + p)
+	}
+	root := filepath.Join(dir, p)
+	if symlinked(dir, root) {
+		return errors.New("cache path must not be under a symlink: " + p)
+	}
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		err = t.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(t, f)
+		return err
+	})
+}
+
+// outside returns whether the relative path rel refers to a parent directory
+func outside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// symlinked returns whether any existing parent directory of name
+// below dir is a symlink.
+func symlinked(dir, name string) bool {
+	rel, err := filepath.Rel(dir, filepath.Dir(name))
+	if err != nil || outside(rel) {
+		return true
+	}
+	p := dir
+	for _, e := range strings.Split(rel, string(filepath.Separator)) {
+		if e == "." {
+			continue
+		}
+		p = filepath.Join(p, e)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return false
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// untar extracts r into dir. Symlinks must point inside dir, and
+// nothing is written through a symlink, so that a cache never writes
+// outside dir.
+func untar(r *tar.Reader, dir string) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if rel, err := filepath.Rel(dir, name); err != nil || outside(rel) {
+			return errors.New("invalid path in cache: " + hdr.Name)
+		}
+		if symlinked(dir, name) {
+			return errors.New("path under a symlink in cache: " + hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, os.FileMode(hdr.Mode)|0700)
+		case tar.TypeSymlink:
+			link := filepath.FromSlash(hdr.Linkname)
+			rel, e := filepath.Rel(dir, filepath.Join(filepath.Dir(name), link))
+			if filepath.IsAbs(link) || e != nil || outside(rel) {
+				return errors.New("symlink out of the repository in cache: " + hdr.Name + " -> " + hdr.Linkname)
+			}
+			os.Remove(name)
+			err = os.Symlink(link, name)
+		case tar.TypeReg:
+			// a symlink in place would be followed
+			if fi, e := os.Lstat(name); e == nil && fi.Mode()&os.ModeSymlink != 0 {
+				os.Remove(name)
+			}
+			err = writeFile(name, r, os.FileMode(hdr.Mode))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeFile(name string, r io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
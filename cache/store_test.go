@@ -0,0 +1,239 @@
+package cache_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/wangkuiyi/ci/cache"
+)
+
+func TestSaveRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := cache.NewStore(path.Join(dir, "store"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := path.Join(dir, "src")
+	err = os.MkdirAll(path.Join(src, "deps", "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(src, "deps", "lib", "a.so"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Has("key") {
+		t.FailNow()
+	}
+	ok, err := s.Restore("key", src)
+	if err != nil || ok {
+		t.Fatal(ok, err)
+	}
+
+	err = s.Save("key", src, []string{"deps", "not-exist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has("key") {
+		t.FailNow()
+	}
+
+	dst := path.Join(dir, "dst")
+	ok, err = s.Restore("key", dst)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	b, err := ioutil.ReadFile(path.Join(dst, "deps", "lib", "a.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a" {
+		t.Fatal(string(b))
+	}
+
+	err = s.Save("key", src, []string{"../src"})
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+// writeCache writes a cache of key into the store at dir, with given
+// tar headers, regular files have the content "x".
+func writeCache(t *testing.T, dir, key string, hdrs []tar.Header) {
+	sum := sha256.Sum256([]byte(key))
+	f, err := os.Create(path.Join(dir, hex.EncodeToString(sum[:])+".tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z := gzip.NewWriter(f)
+	w := tar.NewWriter(z)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = 1
+		}
+		err = w.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, err = w.Write([]byte("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := cache.NewStore(path.Join(dir, "store"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := path.Join(dir, "outside")
+	err = os.Mkdir(outside, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCache(t, path.Join(dir, "store"), "abs", []tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	writeCache(t, path.Join(dir, "store"), "rel", []tar.Header{
+		{Name: "deps/a", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+		{Name: "deps/a/x", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	writeCache(t, path.Join(dir, "store"), "inside", []tar.Header{
+		{Name: "deps/lib", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "deps/a", Typeflag: tar.TypeSymlink, Linkname: "lib"},
+		{Name: "deps/a/x", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	for _, key := range []string{"abs", "rel", "inside"} {
+		dst := path.Join(dir, "dst-"+key)
+		ok, err := s.Restore(key, dst)
+		if err == nil || !ok {
+			t.Fatal(key, ok, err)
+		}
+		if _, err := os.Stat(path.Join(outside, "x")); !os.IsNotExist(err) {
+			t.Fatal(key, err)
+		}
+	}
+
+	// symlinks inside the repository are restored
+	src := path.Join(dir, "src")
+	err = os.MkdirAll(path.Join(src, "deps", "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("lib", path.Join(src, "deps", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("key", src, []string{"deps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("key", src, []string{"deps/a/x"})
+	if err == nil {
+		t.FailNow()
+	}
+	dst := path.Join(dir, "dst")
+	ok, err := s.Restore("key", dst)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	link, err := os.Readlink(path.Join(dst, "deps", "a"))
+	if err != nil || link != "lib" {
+		t.Fatal(link, err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	err = os.MkdirAll(src, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// random content does not compress
+	b := make([]byte, 4096)
+	f, err := os.Open("/dev/urandom")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	_, err = f.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(src, "dep"), b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room for two caches
+	s, err := cache.NewStore(path.Join(dir, "store"), 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		err = s.Save(key, src, []string{"dep"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// use a, so b is the least recently used one
+	_, err = s.Restore("a", path.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("c", src, []string{"dep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has("a") || s.Has("b") || !s.Has("c") {
+		t.Fatal(s.Has("a"), s.Has("b"), s.Has("c"))
+	}
+
+	s, err = cache.NewStore(path.Join(dir, "small"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("a", src, []string{"dep"})
+	if err != cache.ErrTooLarge {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// Approval records that a maintainer approved a build which was
+// held in BuildAwaitingApproval
+type Approval struct {
+	By   string // the maintainer who approved the build
+	Time time.Time
+}
+
+// Approve approves a build in BuildAwaitingApproval, the build
+// becomes BuildQueued.
+func (b *Build) Approve(by string) error {
+	return b.db.update(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(statusBucket)
+		if bucket == nil || BuildStatus(bucket.Get(itob(b.ID))) != BuildAwaitingApproval {
+			return fmt.Errorf("build %d is not awaiting approval", b.ID)
+		}
+		candy.Must(setStatus(tx, b.ID, BuildQueued))
+		bucket, err := tx.CreateBucketIfNotExists(approvalBucket)
+		candy.Must(err)
+		return putGob(bucket, itob(b.ID), Approval{By: by, Time: time.Now().UTC().Round(0)})
+	}))
+}
+
+// Approval returns the approval of the build, ok is false if the
+// build has not been approved.
+func (b *Build) Approval() (a Approval, ok bool, err error) {
+	err = b.db.view(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(approvalBucket)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get(itob(b.ID))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&a)
+	}))
+	return
+}
+
+// AwaitingBuilds returns all builds in BuildAwaitingApproval
+func (d *DB) AwaitingBuilds() ([]Build, error) {
+	pending, err := d.PendingBuilds()
+	if err != nil {
+		return nil, err
+	}
+
+	var bs []Build
+	for _, b := range pending {
+		s, err := b.Status()
+		if err != nil {
+			// status not set yet
+			continue
+		}
+		if s == BuildAwaitingApproval {
+			bs = append(bs, b)
+		}
+	}
+	return bs, nil
+}
@@ -0,0 +1,86 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestApprove(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreatePullRequestBuild("url", "ref", "sha", db.PullRequestInfo{Number: 1, Author: "someone", Fork: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err := d.Build(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bb != b || bb.T != db.PullRequest || !bb.PR.Fork {
+		t.Fatal(bb)
+	}
+
+	// only builds awaiting approval can be approved
+	err = b.Approve("maintainer")
+	if err == nil {
+		t.FailNow()
+	}
+
+	err = b.SetStatus(db.BuildAwaitingApproval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := d.AwaitingBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 1 || bs[0] != b {
+		t.Fatal(bs)
+	}
+
+	_, ok, err := b.Approval()
+	if err != nil || ok {
+		t.Fatal(ok, err)
+	}
+
+	err = b.Approve("maintainer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := b.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != db.BuildQueued {
+		t.Fatal(s)
+	}
+	a, ok, err := b.Approval()
+	if err != nil || !ok || a.By != "maintainer" {
+		t.Fatal(a, ok, err)
+	}
+
+	bs, err = d.AwaitingBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 0 {
+		t.Fatal(bs)
+	}
+
+	err = b.Approve("maintainer")
+	if err == nil {
+		t.FailNow()
+	}
+}
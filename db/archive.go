@@ -0,0 +1,133 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// archivedRefBucket records refs archived after their branches or tags
+// were deleted, keyed by build type and ref, the value is the time
+// the ref was archived. Builds of archived refs are kept.
+var archivedRefBucket = []byte("archived_ref")
+
+// ArchivedRef is a ref archived after it was deleted
+type ArchivedRef struct {
+	Ref      string
+	Archived time.Time
+}
+
+// ArchiveRef archives ref of builds of type t, like a deleted branch,
+// and cancels its builds not started yet. Returns ids of canceled
+// builds. Archived refs are not listed by Refs until they are built
+// again.
+func (d *DB) ArchiveRef(t BuildType, ref string) ([]uint64, error) {
+	var canceled []uint64
+	err := d.update(makeSafeHandler(func(tx Tx) error {
+		canceled = nil // the transaction may be retried
+		ids := refIDs(tx, t, ref)
+		if len(ids) == 0 {
+			return nil
+		}
+		putArchived(tx, t, ref, time.Now().UTC().Round(0))
+
+		status := tx.Bucket(statusBucket)
+		if status == nil {
+			return nil
+		}
+		for _, id := range ids {
+			s := BuildStatus(status.Get(itob(id)))
+			if s == BuildQueued || s == BuildAwaitingApproval {
+				candy.Must(setStatus(tx, id, BuildCanceled))
+				canceled = append(canceled, id)
+			}
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return canceled, nil
+}
+
+// ArchivedRefs returns archived refs of given build type, the latest
+// archived first.
+func (d *DB) ArchivedRefs(t BuildType) ([]ArchivedRef, error) {
+	var refs []ArchivedRef
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		b := archivedRefs(tx, t)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			r := ArchivedRef{Ref: string(k)}
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&r.Archived))
+			refs = append(refs, r)
+			return nil
+		})
+	}))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].Archived.After(refs[j].Archived) })
+	return refs, nil
+}
+
+func archivedRefs(tx Tx, t BuildType) Bucket {
+	b := tx.Bucket(archivedRefBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Bucket(itob(uint64(t)))
+}
+
+// archived returns the time ref of build type t was archived, zero if
+// it is not archived.
+func archived(tx Tx, t BuildType, ref string) time.Time {
+	var at time.Time
+	if b := archivedRefs(tx, t); b != nil {
+		if v := b.Get([]byte(ref)); v != nil {
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&at))
+		}
+	}
+	return at
+}
+
+func putArchived(tx Tx, t BuildType, ref string, at time.Time) {
+	b, err := tx.CreateBucketIfNotExists(archivedRefBucket)
+	candy.Must(err)
+	b, err = b.CreateBucketIfNotExists(itob(uint64(t)))
+	candy.Must(err)
+	candy.Must(putGob(b, []byte(ref), at))
+}
+
+// unarchive restores ref of build type t, e.g., when a deleted branch
+// is pushed again.
+func unarchive(tx Tx, t BuildType, ref string) {
+	if b := archivedRefs(tx, t); b != nil {
+		candy.Must(b.Delete([]byte(ref)))
+	}
+}
+
+// refIDs returns ids of builds of type t on ref, the earliest first
+func refIDs(tx Tx, t BuildType, ref string) []uint64 {
+	var ids []uint64
+	b := tx.Bucket(refBucket)
+	if b == nil {
+		return nil
+	}
+	if b = b.Bucket(itob(uint64(t))); b == nil {
+		return nil
+	}
+	if b = b.Bucket([]byte(ref)); b == nil {
+		return nil
+	}
+	candy.Must(b.ForEach(func(_, v []byte) error {
+		ids = append(ids, btoi(v))
+		return nil
+	}))
+	return ids
+}
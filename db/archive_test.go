@@ -0,0 +1,107 @@
+package db_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestArchiveRef(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	var builds []db.Build
+	for _, s := range []db.BuildStatus{db.BuildSuccess, db.BuildRunning, db.BuildQueued, db.BuildAwaitingApproval} {
+		b, err := d.CreateBuild(db.Push, "url", "refs/heads/feature", "sha")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.SetStatus(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		builds = append(builds, b)
+	}
+	_, err = d.CreateBuild(db.Push, "url", "refs/heads/master", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, err := d.ArchiveRef(db.Push, "refs/heads/gone")
+	if err != nil || len(canceled) != 0 {
+		t.Fatal(canceled, err)
+	}
+	canceled, err = d.ArchiveRef(db.Push, "refs/heads/feature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(canceled, []uint64{builds[2].ID, builds[3].ID}) {
+		t.Fatal(canceled)
+	}
+	for i, want := range []db.BuildStatus{db.BuildSuccess, db.BuildRunning, db.BuildCanceled, db.BuildCanceled} {
+		s, err := builds[i].Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != want {
+			t.Fatal(i, s, want)
+		}
+	}
+	_, err = builds[2].NewAttempt("worker")
+	if err == nil {
+		t.Fatal("attempt a canceled build")
+	}
+
+	refs, err := d.Refs(db.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refs, []string{"refs/heads/master"}) {
+		t.Fatal(refs)
+	}
+	archived, err := d.ArchivedRefs(db.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 1 || archived[0].Ref != "refs/heads/feature" || archived[0].Archived.IsZero() {
+		t.Fatal(archived)
+	}
+	bs, err := d.RefBuilds(db.Push, "refs/heads/feature", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 4 {
+		t.Fatal(bs)
+	}
+
+	// pushing the branch again restores it
+	_, err = d.CreateBuild(db.Push, "url", "refs/heads/feature", "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err = d.Refs(db.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Fatal(refs)
+	}
+	archived, err = d.ArchivedRefs(db.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 0 {
+		t.Fatal(archived)
+	}
+}
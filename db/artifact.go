@@ -0,0 +1,57 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// Artifact is a file produced by a build and kept in the artifact store
+type Artifact struct {
+	Name    string // path of the file relative to the repository
+	SHA256  string // hex encoded checksum, the key in the artifact store
+	Size    int64
+	Attempt uint64 // the attempt that produced the artifact
+	Created time.Time
+}
+
+// AddArtifact records an artifact against the build
+func (b *Build) AddArtifact(a Artifact) error {
+	return b.db.update(makeSafeHandler(func(tx Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(artifactBucket)
+		candy.Must(err)
+		bucket, err = bucket.CreateBucketIfNotExists(itob(b.ID))
+		candy.Must(err)
+		id, err := bucket.NextSequence()
+		candy.Must(err)
+		return putGob(bucket, itob(id), a)
+	}))
+}
+
+// Artifacts returns all artifacts of the build in the order they are added
+func (b *Build) Artifacts() ([]Artifact, error) {
+	var as []Artifact
+	err := b.db.view(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(artifactBucket)
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(itob(b.ID))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var a Artifact
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&a))
+			as = append(as, a)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return as, nil
+}
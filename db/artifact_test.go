@@ -0,0 +1,55 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestArtifacts(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := b.Artifacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 0 {
+		t.Fatal(as)
+	}
+
+	a0 := db.Artifact{Name: "dist/a.whl", SHA256: "00", Size: 1, Attempt: 1, Created: time.Now().UTC().Round(0)}
+	a1 := db.Artifact{Name: "image.tar", SHA256: "01", Size: 2, Attempt: 1, Created: time.Now().UTC().Round(0)}
+	err = b.AddArtifact(a0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AddArtifact(a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as, err = b.Artifacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 2 || as[0] != a0 || as[1] != a1 {
+		t.Fatal(as)
+	}
+}
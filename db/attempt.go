@@ -0,0 +1,247 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// Attempt is one execution of a build. A build is executed more
+// than once when it is retried, rerun or recovered after a crash,
+// each execution is recorded as a new attempt.
+// the coresponding value of public field in database will never change
+type Attempt struct {
+	db   *DB
+	mask *strings.Replacer
+
+	BuildID uint64
+	Num     uint64 // attempt number, starts from 1
+	Worker  string // the worker executing this attempt
+	Created time.Time
+}
+
+// AttemptState is the mutable state of an attempt
+type AttemptState struct {
+	Status   BuildStatus
+	Started  time.Time // zero if the attempt has not started running
+	Finished time.Time // zero if the attempt has not finished
+}
+
+func isFinished(s BuildStatus) bool {
+	return s == BuildFailed || s == BuildSuccess || s == BuildError || s == BuildCanceled
+}
+
+// NewAttempt creates a new attempt of the build executed by worker.
+// The status of the new attempt is BuildQueued. Canceled builds are
+// not attempted.
+func (b *Build) NewAttempt(worker string) (Attempt, error) {
+	a := Attempt{BuildID: b.ID, Worker: worker, Created: time.Now().UTC().Round(0)}
+	err := b.db.update(makeSafeHandler(func(tx Tx) error {
+		if bucket := tx.Bucket(statusBucket); bucket != nil && BuildStatus(bucket.Get(itob(b.ID))) == BuildCanceled {
+			return fmt.Errorf("build %d is canceled", b.ID)
+		}
+		bucket, err := tx.CreateBucketIfNotExists(attemptBucket)
+		candy.Must(err)
+		bucket, err = bucket.CreateBucketIfNotExists(itob(b.ID))
+		candy.Must(err)
+		a.Num, err = bucket.NextSequence()
+		candy.Must(err)
+		candy.Must(putGob(bucket, itob(a.Num), a))
+
+		bucket, err = tx.CreateBucketIfNotExists(attemptStateBucket)
+		candy.Must(err)
+		bucket, err = bucket.CreateBucketIfNotExists(itob(b.ID))
+		candy.Must(err)
+		return putGob(bucket, itob(a.Num), AttemptState{Status: BuildQueued})
+	}))
+	if err != nil {
+		return Attempt{}, err
+	}
+	a.db = b.db
+	return a, nil
+}
+
+// Attempts returns all attempts of the build, the first attempt comes first
+func (b *Build) Attempts() ([]Attempt, error) {
+	var as []Attempt
+	err := b.db.view(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(attemptBucket)
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(itob(b.ID))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var a Attempt
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&a))
+			a.db = b.db
+			as = append(as, a)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+// Attempt returns the attempt of the build given attempt number
+func (b *Build) Attempt(num uint64) (Attempt, error) {
+	var a Attempt
+	err := b.db.view(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(attemptBucket)
+		if bucket == nil {
+			return fmt.Errorf("attempt %d of build %d not exist", num, b.ID)
+		}
+		bucket = bucket.Bucket(itob(b.ID))
+		if bucket == nil {
+			return fmt.Errorf("attempt %d of build %d not exist", num, b.ID)
+		}
+		v := bucket.Get(itob(num))
+		if v == nil {
+			return fmt.Errorf("attempt %d of build %d not exist", num, b.ID)
+		}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&a)
+	}))
+	if err != nil {
+		return Attempt{}, err
+	}
+	a.db = b.db
+	return a, nil
+}
+
+// latestAttempt returns the number of the latest attempt of build id,
+// 0 means the build has never been attempted.
+func latestAttempt(tx Tx, id uint64) uint64 {
+	bucket := tx.Bucket(attemptBucket)
+	if bucket == nil {
+		return 0
+	}
+	bucket = bucket.Bucket(itob(id))
+	if bucket == nil {
+		return 0
+	}
+	k, _ := bucket.Cursor().Last()
+	if k == nil {
+		return 0
+	}
+	return btoi(k)
+}
+
+// SetStatus sets attempt status, the status of the build is set as
+// well since it always follows its latest attempt.
+func (a *Attempt) SetStatus(s BuildStatus) error {
+	return a.db.update(makeSafeHandler(func(tx Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(attemptStateBucket)
+		candy.Must(err)
+		bucket, err = bucket.CreateBucketIfNotExists(itob(a.BuildID))
+		candy.Must(err)
+		var state AttemptState
+		if v := bucket.Get(itob(a.Num)); v != nil {
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&state))
+		}
+		state.Status = s
+		now := time.Now().UTC().Round(0)
+		if s == BuildRunning && state.Started.IsZero() {
+			state.Started = now
+		}
+		if isFinished(s) {
+			state.Finished = now
+			sealOutputAt(tx, attemptOutputBucket, itob(a.BuildID), itob(a.Num))
+		}
+		candy.Must(putGob(bucket, itob(a.Num), state))
+
+		if latestAttempt(tx, a.BuildID) != a.Num {
+			// an older attempt does not change build status
+			return nil
+		}
+		return setStatus(tx, a.BuildID, s)
+	}))
+}
+
+// State returns attempt state
+func (a *Attempt) State() (AttemptState, error) {
+	var state AttemptState
+	err := a.db.view(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(attemptStateBucket)
+		if bucket == nil {
+			return fmt.Errorf("state of attempt %d of build %d not exist", a.Num, a.BuildID)
+		}
+		bucket = bucket.Bucket(itob(a.BuildID))
+		if bucket == nil {
+			return fmt.Errorf("state of attempt %d of build %d not exist", a.Num, a.BuildID)
+		}
+		v := bucket.Get(itob(a.Num))
+		if v == nil {
+			return fmt.Errorf("state of attempt %d of build %d not exist", a.Num, a.BuildID)
+		}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&state)
+	}))
+	if err != nil {
+		return AttemptState{}, err
+	}
+	return state, nil
+}
+
+// Status returns attempt status
+func (a *Attempt) Status() (BuildStatus, error) {
+	state, err := a.State()
+	if err != nil {
+		return "", err
+	}
+	return state.Status, nil
+}
+
+// Mask replaces values in every output line appended and every test
+// result message added afterwards with "***", so that secrets never
+// reach the database. Every non-empty value is masked, however short.
+// Each line of a multi-line value is masked on its own since output is
+// stored line by line.
+func (a *Attempt) Mask(values ...string) {
+	var olds []string
+	for _, v := range values {
+		lines := strings.Split(v, "\n")
+		if len(lines) > 1 {
+			lines = append(lines, v)
+		}
+		for _, l := range lines {
+			if l = strings.TrimSpace(l); l != "" {
+				olds = append(olds, l)
+			}
+		}
+	}
+	if len(olds) == 0 {
+		a.mask = nil
+		return
+	}
+	// the replacer tries olds in order, longer ones go first so that
+	// a value containing another one is masked as a whole.
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+	var oldnew []string
+	for _, o := range olds {
+		oldnew = append(oldnew, o, "***")
+	}
+	a.mask = strings.NewReplacer(oldnew...)
+}
+
+// AppendOutput append output for an attempt
+func (a *Attempt) AppendOutput(o OutputLine) error {
+	if a.mask != nil {
+		o.Str = a.mask.Replace(o.Str)
+	}
+	return appendOutput(a.db, o, attemptOutputBucket, itob(a.BuildID), itob(a.Num))
+}
+
+// Output returns output of an attempt in a range
+// if end == -1, will return all data starting from start
+func (a *Attempt) Output(start, end int) ([]OutputLine, error) {
+	return output(a.db, start, end, attemptOutputBucket, itob(a.BuildID), itob(a.Num))
+}
@@ -0,0 +1,212 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestAttempts(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := b.Attempts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 0 {
+		t.Fatal(as)
+	}
+
+	a1, err := b.NewAttempt("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1.Num != 1 || a1.BuildID != b.ID || a1.Worker != "0" {
+		t.Fatal(a1)
+	}
+
+	s, err := a1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != db.BuildQueued {
+		t.Fatal(s)
+	}
+
+	err = a1.SetStatus(db.BuildRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line0 := db.OutputLine{T: db.Stdout, Str: "attempt 1", Time: time.Now().UTC().Round(0)}
+	err = a1.AppendOutput(line0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a1.SetStatus(db.BuildError)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := a1.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != db.BuildError || state.Started.IsZero() || state.Finished.IsZero() {
+		t.Fatal(state)
+	}
+
+	s, err = b.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != db.BuildError {
+		t.Fatal(s)
+	}
+
+	a2, err := b.NewAttempt("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a2.Num != 2 {
+		t.Fatal(a2)
+	}
+	line1 := db.OutputLine{T: db.Stdout, Str: "attempt 2", Time: time.Now().UTC().Round(0)}
+	err = b.AppendOutput(line1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a2.SetStatus(db.BuildSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// build output and status follow the latest attempt
+	l, err := b.Output(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0] != line1 {
+		t.Fatal(l)
+	}
+	s, err = b.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != db.BuildSuccess {
+		t.Fatal(s)
+	}
+
+	l, err = a1.Output(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0] != line0 {
+		t.Fatal(l)
+	}
+
+	// an older attempt does not change build status
+	err = a1.SetStatus(db.BuildFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = b.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != db.BuildSuccess {
+		t.Fatal(s)
+	}
+
+	as, err = b.Attempts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 2 || as[0] != a1 || as[1] != a2 {
+		t.Fatal(as)
+	}
+
+	a, err := b.Attempt(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != a2 {
+		t.Fatal(a)
+	}
+	_, err = b.Attempt(3)
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+func TestAttemptMask(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := b.NewAttempt("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Mask("token", "tokenlong", "-----BEGIN KEY-----\nabcdefgh\n-----END KEY-----\n", "ab")
+	for _, s := range []string{"use token", "use tokenlong", "abcdefgh", "-----END KEY-----", "ab"} {
+		err = a.AppendOutput(db.OutputLine{T: db.Stdout, Str: s})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := a.Output(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"use ***", "use ***", "***", "***", "***"}
+	if len(l) != len(expected) {
+		t.Fatal(l)
+	}
+	for i := range l {
+		if l[i].Str != expected[i] {
+			t.Fatal(i, l[i].Str)
+		}
+	}
+
+	err = a.AddTestResults([]db.TestResult{{Name: "TestA", Status: db.TestFailed, Message: "got tokenlong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := a.TestResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].Message != "got ***" {
+		t.Fatal(rs)
+	}
+}
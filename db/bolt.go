@@ -0,0 +1,227 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltStorage stores the database in a BoltDB file
+type boltStorage struct {
+	path string
+
+	// mu guards db, which is replaced by Compact. db is nil if the
+	// file can not be opened again after compacting, err tells why.
+	mu  sync.RWMutex
+	db  *bolt.DB
+	err error
+}
+
+// boltTimeout is how long opening a BoltDB file waits for the file
+// lock, which is held by the process having the file open.
+const boltTimeout = 5 * time.Second
+
+func openBolt(path string) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("open %s: %v, it is open by another process, like a running ci", path, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return &boltStorage{path: path, db: db}, nil
+}
+
+func (s *boltStorage) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return s.err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStorage) Update(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return s.err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return s.err
+	}
+	return s.db.Close()
+}
+
+// Compact rewrites the database file. Reads go on while the file is
+// copied, the caller makes sure nothing is written meanwhile, and they
+// only wait for the copy to replace the file.
+func (s *boltStorage) Compact() error {
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	dst, err := openBolt(tmp)
+	if err != nil {
+		return err
+	}
+	err = s.View(func(tx Tx) error {
+		return dst.Update(func(dtx Tx) error {
+			return tx.ForEach(func(name []byte, b Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+	})
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.db.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	renameErr := os.Rename(tmp, s.path)
+	if renameErr != nil {
+		os.Remove(tmp)
+	}
+	s.db, err = bolt.Open(s.path, 0600, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		// nothing can be done without the file, every transaction
+		// fails with the error until the ci is restarted.
+		s.db = nil
+		s.err = fmt.Errorf("reopen %s after compacting: %v", s.path, err)
+		log.Println("db:", s.err)
+		return s.err
+	}
+	return renameErr
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return wrapBucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucket(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucket(name)
+	return wrapBucket(b), err
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	return wrapBucket(b), err
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+func (t boltTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	return t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, boltBucket{b})
+	})
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBucket returns nil instead of a Bucket holding a nil *bolt.Bucket
+func wrapBucket(b *bolt.Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	return wrapBucket(b.b.Bucket(name))
+}
+
+func (b boltBucket) CreateBucket(name []byte) (Bucket, error) {
+	nb, err := b.b.CreateBucket(name)
+	return wrapBucket(nb), err
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nb, err := b.b.CreateBucketIfNotExists(name)
+	return wrapBucket(nb), err
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+func (b boltBucket) Get(k []byte) []byte {
+	return b.b.Get(k)
+}
+
+func (b boltBucket) Put(k, v []byte) error {
+	return b.b.Put(k, v)
+}
+
+func (b boltBucket) Delete(k []byte) error {
+	return b.b.Delete(k)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.b.Cursor()
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+func (b boltBucket) Sequence() uint64 {
+	return b.b.Sequence()
+}
+
+func (b boltBucket) SetSequence(v uint64) error {
+	return b.b.SetSequence(v)
+}
+
+// WriteTo writes a consistent snapshot of the database file to w in a
+// read-only transaction.
+func (s *boltStorage) WriteTo(w io.Writer) (n int64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return 0, s.err
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
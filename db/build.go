@@ -5,9 +5,9 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/topicai/candy"
 )
 
@@ -37,6 +37,11 @@ const (
 	PullRequest BuildType = iota
 	// Push means build is triggered from push event
 	Push
+	// Scheduled means build is triggered by a schedule on a branch
+	Scheduled
+	// Release means build is triggered by pushing a tag or publishing
+	// a github release
+	Release
 )
 
 // BuildStatus in database
@@ -51,45 +56,92 @@ const (
 	BuildError = "error"
 	// BuildFailed means there is error during build caused by build script
 	BuildFailed = "failed"
+	// BuildAwaitingApproval means the build is held until a maintainer
+	// approves it, e.g., a pull request from a fork
+	BuildAwaitingApproval = "awaiting-approval"
+	// BuildCanceled means the build is canceled before it started,
+	// e.g., its branch is deleted
+	BuildCanceled = "canceled"
 )
 
+// PullRequestInfo describes the pull request of a PullRequest build
+type PullRequestInfo struct {
+	Number int
+	Author string // login of the pull request author
+	Fork   bool   // whether the head repository is a fork of the base repository
+	Base   string // the branch the pull request merges into, empty if not recorded
+}
+
+// ReleaseInfo describes the github release of a Release build
+type ReleaseInfo struct {
+	Name       string // name of the release, empty if the build is triggered by pushing a tag
+	Prerelease bool
+}
+
+// Tag returns the tag of a Release build, empty for other builds
+func (b Build) Tag() string {
+	if b.T != Release {
+		return ""
+	}
+	return strings.TrimPrefix(b.Ref, "refs/tags/")
+}
+
 // Build represents a build event in database
 // the coresponding value of public field in database will never change
 type Build struct {
-	db *bolt.DB
+	db *DB
 
 	T         BuildType
 	Ref       string
 	CloneURL  string
 	CommitSHA string
 	ID        uint64
+	PR        PullRequestInfo // zero if the build is not a PullRequest build
+	Created   time.Time       // zero if the build was created before it was recorded
+	Schedule  string          // name of the schedule of a Scheduled build
+	Release   ReleaseInfo     // zero if the build is not a Release build
 }
 
 // SetStatus sets build status
 func (b *Build) SetStatus(s BuildStatus) error {
-	err := b.db.Update(makeSafeHandler(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(statusBucket)
-		candy.Must(err)
-		candy.Must(bucket.Put(itob(b.ID), []byte(s)))
-		if s == BuildFailed || s == BuildSuccess || s == BuildError {
-			// remove from pending
-			bucket = tx.Bucket(pendingBucket)
-			if bucket == nil {
-				return nil
-			}
-
-			err = bucket.Delete(itob(b.ID))
-			candy.Must(err)
-		}
-		return nil
+	err := b.db.update(makeSafeHandler(func(tx Tx) error {
+		return setStatus(tx, b.ID, s)
 	}))
 	return err
 }
 
+func setStatus(tx Tx, id uint64, s BuildStatus) error {
+	bucket, err := tx.CreateBucketIfNotExists(statusBucket)
+	candy.Must(err)
+	old := BuildStatus(bucket.Get(itob(id)))
+	candy.Must(bucket.Put(itob(id), []byte(s)))
+	indexStatus(tx, buildIndexKey(tx, id), old, s)
+	if isFinished(s) {
+		if s != BuildCanceled {
+			recordStats(tx, id, s, time.Now().UTC().Round(0))
+		}
+		if num := latestAttempt(tx, id); num != 0 {
+			sealOutputAt(tx, attemptOutputBucket, itob(id), itob(num))
+		} else {
+			sealOutputAt(tx, outputBucket, itob(id))
+		}
+
+		// remove from pending
+		bucket = tx.Bucket(pendingBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		err = bucket.Delete(itob(id))
+		candy.Must(err)
+	}
+	return nil
+}
+
 // Status returns build status
 func (b *Build) Status() (BuildStatus, error) {
 	var stat BuildStatus
-	err := b.db.View(makeSafeHandler(func(tx *bolt.Tx) error {
+	err := b.db.view(makeSafeHandler(func(tx Tx) error {
 		bucket := tx.Bucket(statusBucket)
 		if bucket == nil {
 			return errors.New("statusBucket not exist")
@@ -107,8 +159,45 @@ func (b *Build) Status() (BuildStatus, error) {
 	return stat, nil
 }
 
-// AppendOutput append output for a build
+// AppendOutput append output for the latest attempt of a build
 func (b *Build) AppendOutput(o OutputLine) error {
+	path, err := b.outputPath()
+	if err != nil {
+		return err
+	}
+	return appendOutput(b.db, o, path...)
+}
+
+// Output returns output of the latest attempt of a build in a range
+// if end == -1, will return all data starting from start
+func (b *Build) Output(start, end int) ([]OutputLine, error) {
+	path, err := b.outputPath()
+	if err != nil {
+		return nil, err
+	}
+	return output(b.db, start, end, path...)
+}
+
+// outputPath returns the bucket path of the output of the latest
+// attempt. Builds which are never attempted keep their output in
+// outputBucket.
+func (b *Build) outputPath() ([][]byte, error) {
+	var num uint64
+	err := b.db.view(func(tx Tx) error {
+		num = latestAttempt(tx, b.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if num == 0 {
+		return [][]byte{outputBucket, itob(b.ID)}, nil
+	}
+	return [][]byte{attemptOutputBucket, itob(b.ID), itob(num)}, nil
+}
+
+// appendOutput appends an output line into the bucket given by path
+func appendOutput(db *DB, o OutputLine, path ...[]byte) error {
 	if o.Str == "" {
 		return nil
 	}
@@ -120,21 +209,33 @@ func (b *Build) AppendOutput(o OutputLine) error {
 		return err
 	}
 
-	err = b.db.Update(makeSafeHandler(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(outputBucket)
-		candy.Must(err)
-		bucket, err = bucket.CreateBucketIfNotExists(itob(b.ID))
+	return db.update(makeSafeHandler(func(tx Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(path[0])
 		candy.Must(err)
-		id, err := bucket.NextSequence()
-		candy.Must(err)
-		return bucket.Put(itob(id), buf.Bytes())
+		for _, name := range path[1:] {
+			bucket, err = bucket.CreateBucketIfNotExists(name)
+			candy.Must(err)
+		}
+		putLine(tx, bucket, path, buf.Bytes())
+		return nil
 	}))
-	return err
 }
 
-// Output returns output of a build in a range
+// putLine puts gob-encoded output line v into the output bucket b given
+// by path, returns its line number.
+func putLine(tx Tx, b Bucket, path [][]byte, v []byte) uint64 {
+	n, err := b.NextSequence()
+	candy.Must(err)
+	candy.Must(b.Put(itob(n), v))
+	if looseLines(b) >= chunkLines || sealed(b) {
+		sealIndexed(tx, path, b)
+	}
+	return n
+}
+
+// output returns output lines in a range from the bucket given by path
 // if end == -1, will return all data starting from start
-func (b *Build) Output(start, end int) ([]OutputLine, error) {
+func output(db *DB, start, end int, path ...[]byte) ([]OutputLine, error) {
 	err := validate(start, end)
 	if err != nil {
 		return nil, err
@@ -153,34 +254,21 @@ func (b *Build) Output(start, end int) ([]OutputLine, error) {
 	start++
 
 	var out []OutputLine
-	err = b.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(outputBucket)
-		if bucket == nil {
-			// treat as no output
-			return nil
+	err = db.view(makeSafeHandler(func(tx Tx) error {
+		bucket := tx.Bucket(path[0])
+		for _, name := range path[1:] {
+			if bucket == nil {
+				break
+			}
+			bucket = bucket.Bucket(name)
 		}
-		bucket = bucket.Bucket(itob(b.ID))
 		if bucket == nil {
 			// treat as no output
 			return nil
 		}
-		c := bucket.Cursor()
-		key := itob(uint64(start))
-		k, v := c.Seek(key)
-		if !bytes.Equal(key, k) {
-			// key not exist, start is too big
-			return nil
-		}
-
-		count := 0
-		for ; (diff == -1 || count < diff) && k != nil; k, v = c.Next() {
-			count++
-			var o OutputLine
-			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&o))
-			out = append(out, o)
-		}
+		out = readOutput(bucket, uint64(start), diff)
 		return nil
-	})
+	}))
 	if err != nil {
 		return nil, err
 	}
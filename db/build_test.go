@@ -10,7 +10,7 @@ import (
 )
 
 func TestBuild(t *testing.T) {
-	d, err := db.Open(testPath)
+	d, err := open(testPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,10 +39,10 @@ func TestBuild(t *testing.T) {
 		t.FailNow()
 	}
 
-	line0 := db.OutputLine{T: db.Stdout, Str: "stdout", Time: time.Now()}
-	line1 := db.OutputLine{T: db.Stderr, Str: "stderr", Time: time.Now()}
-	line2 := db.OutputLine{T: db.Info, Str: "info", Time: time.Now()}
-	line3 := db.OutputLine{T: db.Error, Str: "error", Time: time.Now()}
+	line0 := db.OutputLine{T: db.Stdout, Str: "stdout", Time: time.Now().UTC().Round(0)}
+	line1 := db.OutputLine{T: db.Stderr, Str: "stderr", Time: time.Now().UTC().Round(0)}
+	line2 := db.OutputLine{T: db.Info, Str: "info", Time: time.Now().UTC().Round(0)}
+	line3 := db.OutputLine{T: db.Error, Str: "error", Time: time.Now().UTC().Round(0)}
 
 	b.AppendOutput(line0)
 	b.AppendOutput(line1)
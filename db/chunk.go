@@ -0,0 +1,188 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+
+	"github.com/topicai/candy"
+)
+
+// Output lines are stored in a bucket keyed by line numbers. Lines are
+// appended to the bucket one by one, and sealed into compressed chunks
+// of at most chunkLines lines once there are chunkLines of them or the
+// output is finished. Lines are indexed for searching when sealed. Chunks are stored in the nested bucket
+// chunksBucket keyed by the line number of their first line, which is
+// the index for seeking a line. A finished output is marked by
+// sealedKey, lines appended to it afterwards, like output of the clean
+// script, are sealed into its last chunk at once.
+var (
+	chunksBucket = []byte("chunks")
+	sealedKey    = []byte("sealed")
+)
+
+const chunkLines = 256
+
+// encodeChunk gob-encodes lines in one stream, so that type metadata
+// is encoded once per chunk, and compresses it.
+func encodeChunk(lines []OutputLine) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	candy.Must(gob.NewEncoder(w).Encode(lines))
+	candy.Must(w.Close())
+	return buf.Bytes()
+}
+
+func decodeChunk(v []byte) []OutputLine {
+	r, err := gzip.NewReader(bytes.NewReader(v))
+	candy.Must(err)
+	var lines []OutputLine
+	candy.Must(gob.NewDecoder(r).Decode(&lines))
+	return lines
+}
+
+// isLineKey returns whether k is the key of a line rather than of
+// chunksBucket. Keys of lines are 8-byte big endian line numbers, which
+// sort before chunksBucket.
+func isLineKey(k, v []byte) bool {
+	return v != nil && len(k) == 8
+}
+
+// looseLines returns the number of lines not sealed yet in b
+func looseLines(b Bucket) uint64 {
+	k, v := b.Cursor().First()
+	if k == nil || !isLineKey(k, v) {
+		return 0
+	}
+	return b.Sequence() - btoi(k) + 1
+}
+
+// sealed returns whether the output in b is finished
+func sealed(b Bucket) bool {
+	return b.Get(sealedKey) != nil
+}
+
+// sealOutput seals lines in b into chunks, returns the number of
+// sealed lines.
+func sealOutput(b Bucket) int {
+	_, lines := sealLines(b)
+	return len(lines)
+}
+
+// sealLines seals lines in b into chunks, returns the line number of
+// the first sealed line and the sealed lines. Lines follow the last
+// chunk if it is not full, so sealing a few lines at a time does not
+// make small chunks.
+func sealLines(b Bucket) (uint64, []OutputLine) {
+	var keys [][]byte
+	var lines []OutputLine
+	c := b.Cursor()
+	for k, v := c.First(); k != nil && isLineKey(k, v); k, v = c.Next() {
+		var o OutputLine
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&o))
+		keys = append(keys, k)
+		lines = append(lines, o)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// line numbers are consecutive, the chunk of lines starting from
+	// line number start is keyed by it.
+	first := btoi(keys[0])
+	start, all := first, lines
+	chunks, err := b.CreateBucketIfNotExists(chunksBucket)
+	candy.Must(err)
+	if k, v := chunks.Cursor().Last(); k != nil {
+		last := decodeChunk(v)
+		if len(last) < chunkLines && btoi(k)+uint64(len(last)) == first {
+			start = btoi(k)
+			all = append(last, lines...)
+		}
+	}
+	for i := 0; i < len(all); i += chunkLines {
+		j := i + chunkLines
+		if j > len(all) {
+			j = len(all)
+		}
+		candy.Must(chunks.Put(itob(start+uint64(i)), encodeChunk(all[i:j])))
+	}
+	for _, k := range keys {
+		candy.Must(b.Delete(k))
+	}
+	return first, lines
+}
+
+// sealIndexed seals lines in the output bucket b given by path, and
+// adds the sealed lines to the search index.
+func sealIndexed(tx Tx, path [][]byte, b Bucket) {
+	first, lines := sealLines(b)
+	indexLines(tx, path, first, lines)
+}
+
+// sealOutputAt seals the finished output bucket given by path, if it
+// exists.
+func sealOutputAt(tx Tx, path ...[]byte) {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return
+		}
+		b = b.Bucket(name)
+	}
+	if b != nil {
+		sealIndexed(tx, path, b)
+		candy.Must(b.Put(sealedKey, []byte{1}))
+	}
+}
+
+// readOutput returns at most n lines in b starting from line number
+// start, all lines starting from start if n is -1.
+func readOutput(b Bucket, start uint64, n int) []OutputLine {
+	var out []OutputLine
+	full := func() bool {
+		return n >= 0 && len(out) >= n
+	}
+
+	next := start
+	if chunks := b.Bucket(chunksBucket); chunks != nil {
+		c := chunks.Cursor()
+		for k, v := seekChunk(c, start); k != nil && !full(); k, v = c.Next() {
+			first := btoi(k)
+			lines := decodeChunk(v)
+			for i, l := range lines {
+				if first+uint64(i) >= start && !full() {
+					out = append(out, l)
+				}
+			}
+			if end := first + uint64(len(lines)); end > next {
+				next = end
+			}
+		}
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(itob(next)); k != nil && isLineKey(k, v) && !full(); k, v = c.Next() {
+		var o OutputLine
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&o))
+		out = append(out, o)
+	}
+	return out
+}
+
+// seekChunk moves c to the chunk holding line number n, or to the last
+// chunk if n is after all chunks, and returns the chunk.
+func seekChunk(c Cursor, n uint64) (k, v []byte) {
+	k, v = c.Seek(itob(n))
+	if k == nil {
+		return c.Last()
+	}
+	if btoi(k) > n {
+		// n is in the previous chunk
+		if pk, pv := c.Prev(); pk != nil {
+			return pk, pv
+		}
+		return c.First()
+	}
+	return k, v
+}
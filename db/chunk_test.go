@@ -0,0 +1,122 @@
+package db_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestChunkedOutput(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := b.NewAttempt("worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lines span sealed chunks and loose lines
+	const n = 600
+	for i := 0; i < n; i++ {
+		err = a.AppendOutput(db.OutputLine{T: db.Stdout, Str: fmt.Sprintf("line %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		ranges := [][2]int{{0, -1}, {0, 1}, {255, 257}, {256, 512}, {300, -1}, {599, -1}, {510, 520}, {0, n}}
+		for _, r := range ranges {
+			o, err := a.Output(r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := r[1]
+			if end == -1 {
+				end = n
+			}
+			if len(o) != end-r[0] {
+				t.Fatal(r, len(o))
+			}
+			for i, l := range o {
+				if l.Str != fmt.Sprintf("line %d", r[0]+i) {
+					t.Fatal(r, i, l)
+				}
+			}
+		}
+		o, err := a.Output(n, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(o) != 0 {
+			t.Fatal(o)
+		}
+
+		rs, err := d.SearchOutput("line 255", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 || rs[0].Line != 256 || rs[0].Str != "line 255" {
+			t.Fatal(rs)
+		}
+	}
+	search599 := func() []db.SearchResult {
+		rs, err := d.SearchOutput("line 599", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	check()
+	// lines are searchable once sealed
+	if rs := search599(); len(rs) != 0 {
+		t.Fatal(rs)
+	}
+	// remaining lines are sealed once the attempt is finished
+	err = a.SetStatus(db.BuildSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if rs := search599(); len(rs) != 1 || rs[0].Line != 600 || rs[0].Str != "line 599" {
+		t.Fatal(rs)
+	}
+
+	// lines appended afterwards are sealed into the last chunk
+	for i := n; i < n+3; i++ {
+		err = a.AppendOutput(db.OutputLine{T: db.Stdout, Str: fmt.Sprintf("line %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := a.Output(n-2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o) != 5 || o[0].Str != "line 598" || o[4].Str != "line 602" {
+		t.Fatal(o)
+	}
+	rs, err := d.SearchOutput("line 601", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].Line != 602 || rs[0].Str != "line 601" {
+		t.Fatal(rs)
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/topicai/candy"
+)
+
+// coverageBucket holds coverage of builds, keyed by build id and then
+// by file
+var coverageBucket = []byte("coverage")
+
+// Coverage counts covered statements or lines
+type Coverage struct {
+	Covered, Total int
+}
+
+// Percent returns the covered percentage, 0 if there is nothing to
+// cover
+func (c Coverage) Percent() float64 {
+	if c.Total == 0 {
+		return 0
+	}
+	return float64(c.Covered) * 100 / float64(c.Total)
+}
+
+// FileCoverage is the coverage of a source file
+type FileCoverage struct {
+	File string
+	Coverage
+}
+
+// TotalCoverage sums coverage of files fs
+func TotalCoverage(fs []FileCoverage) Coverage {
+	var c Coverage
+	for _, f := range fs {
+		c.Covered += f.Covered
+		c.Total += f.Total
+	}
+	return c
+}
+
+func putCoverage(tx Tx, id uint64, fs []FileCoverage) {
+	b, err := tx.CreateBucketIfNotExists(coverageBucket)
+	candy.Must(err)
+	if b.Bucket(itob(id)) != nil {
+		candy.Must(b.DeleteBucket(itob(id)))
+	}
+	b, err = b.CreateBucket(itob(id))
+	candy.Must(err)
+	for _, f := range fs {
+		candy.Must(putGob(b, []byte(f.File), f.Coverage))
+	}
+}
+
+// coverage returns coverage of build id sorted by file, ok is false if
+// the build has no coverage
+func coverage(tx Tx, id []byte) (fs []FileCoverage, ok bool) {
+	b := tx.Bucket(coverageBucket)
+	if b == nil {
+		return nil, false
+	}
+	if b = b.Bucket(id); b == nil {
+		return nil, false
+	}
+	candy.Must(b.ForEach(func(k, v []byte) error {
+		f := FileCoverage{File: string(k)}
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&f.Coverage))
+		fs = append(fs, f)
+		return nil
+	}))
+	return fs, true
+}
+
+// SetCoverage records coverage of files of the build, replacing the
+// coverage of earlier attempts
+func (b *Build) SetCoverage(fs []FileCoverage) error {
+	return b.db.update(makeSafeHandler(func(tx Tx) error {
+		putCoverage(tx, b.ID, fs)
+		return nil
+	}))
+}
+
+// Coverage returns coverage of files of the build sorted by file, ok
+// is false if no coverage is recorded.
+func (b *Build) Coverage() (fs []FileCoverage, ok bool, err error) {
+	err = b.db.view(makeSafeHandler(func(tx Tx) error {
+		fs, ok = coverage(tx, itob(b.ID))
+		return nil
+	}))
+	return
+}
+
+// BaseCoverage returns the coverage of the latest build with coverage
+// on the base branch of a pull request build, created before the
+// build. ok is false if there is no such build.
+func (b *Build) BaseCoverage() (base Build, fs []FileCoverage, ok bool, err error) {
+	if b.T != PullRequest || b.PR.Base == "" {
+		return Build{}, nil, false, nil
+	}
+	err = b.db.view(makeSafeHandler(func(tx Tx) error {
+		refs := tx.Bucket(refBucket)
+		if refs == nil {
+			return nil
+		}
+		if refs = refs.Bucket(itob(uint64(Push))); refs == nil {
+			return nil
+		}
+		if refs = refs.Bucket([]byte("refs/heads/" + b.PR.Base)); refs == nil {
+			return nil
+		}
+		c := refs.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if btoi(v) > b.ID {
+				continue
+			}
+			if fs, ok = coverage(tx, v); ok {
+				v := tx.Bucket(buildBucket).Get(v)
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&base))
+				return nil
+			}
+		}
+		return nil
+	}))
+	base.db = b.db
+	return
+}
@@ -0,0 +1,105 @@
+package db_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestCoverage(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	base, err := d.CreateBuild(db.Push, "url", "refs/heads/develop", "sha0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err := base.Coverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("coverage of a build without coverage")
+	}
+
+	// the coverage of a retry replaces the earlier one
+	err = base.SetCoverage([]db.FileCoverage{{File: "old.go", Coverage: db.Coverage{Covered: 1, Total: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []db.FileCoverage{
+		{File: "a.go", Coverage: db.Coverage{Covered: 3, Total: 4}},
+		{File: "b.go", Coverage: db.Coverage{Covered: 0, Total: 4}},
+	}
+	err = base.SetCoverage([]db.FileCoverage{want[1], want[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, ok, err := base.Coverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !reflect.DeepEqual(fs, want) {
+		t.Fatal(fs)
+	}
+	if c := db.TotalCoverage(fs); c.Covered != 3 || c.Total != 8 || c.Percent() != 37.5 {
+		t.Fatal(c)
+	}
+
+	// a later build of the base branch without coverage
+	_, err = d.CreateBuild(db.Push, "url", "refs/heads/develop", "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := d.CreatePullRequestBuild("url", "feature", "sha2", db.PullRequestInfo{Number: 1, Base: "develop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a build of the base branch created after the pull request build
+	later, err := d.CreateBuild(db.Push, "url", "refs/heads/develop", "sha3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = later.SetCoverage(want[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, fs, ok, err := pr.BaseCoverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || b.ID != base.ID || !reflect.DeepEqual(fs, want) {
+		t.Fatal(b, fs, ok)
+	}
+	_, _, ok, err = base.BaseCoverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("base coverage of a push build")
+	}
+
+	err = d.DeleteBuild(base.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ok, err = pr.BaseCoverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("base coverage of a deleted build")
+	}
+}
@@ -7,8 +7,9 @@ import (
 	"errors"
 
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/topicai/candy"
 )
 
@@ -19,6 +20,15 @@ var (
 	outputBucket  = []byte("output")
 	shaBucket     = []byte("sha")
 	refBucket     = []byte("ref")
+
+	attemptBucket       = []byte("attempt")
+	attemptStateBucket  = []byte("attempt_state")
+	attemptOutputBucket = []byte("attempt_output")
+
+	metaBucket = []byte("meta")
+
+	artifactBucket = []byte("artifact")
+	approvalBucket = []byte("approval")
 )
 
 func validate(start, end int) error {
@@ -37,21 +47,50 @@ func validate(start, end int) error {
 
 // DB is the database api for ci system.
 type DB struct {
-	db *bolt.DB
+	// mu blocks writes while compacting, read-write transactions
+	// hold the read lock and Compact holds the write lock.
+	mu sync.RWMutex
+	s  Storage
 }
 
-// Open opens a database given path
+// Open opens a database stored in a BoltDB file given path, the
+// database is migrated to the latest schema version.
 func Open(path string) (*DB, error) {
-	db, err := bolt.Open(path, 0600, nil)
+	s, err := openBolt(path)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	return OpenStorage(s)
+}
+
+// OpenStorage opens a database stored in s, the database is migrated
+// to the latest schema version.
+func OpenStorage(s Storage) (*DB, error) {
+	_, err := migrate(s, false)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &DB{s: s}, nil
 }
 
 // Close the database.
 func (d *DB) Close() error {
-	return d.db.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s.Close()
+}
+
+// view executes a read-only transaction
+func (d *DB) view(fn func(Tx) error) error {
+	return d.s.View(fn)
+}
+
+// update executes a read-write transaction
+func (d *DB) update(fn func(Tx) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.s.Update(fn)
 }
 
 // itob returns an 8-byte big endian representation of v
@@ -66,8 +105,18 @@ func btoi(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
-func makeSafeHandler(f func(*bolt.Tx) error) func(*bolt.Tx) error {
-	return func(t *bolt.Tx) (err error) {
+// putGob gob-encodes v and puts it into bucket b with key k
+func putGob(b Bucket, k []byte, v interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, buf.Bytes())
+}
+
+func makeSafeHandler(f func(Tx) error) func(Tx) error {
+	return func(t Tx) (err error) {
 		defer func() {
 			if r := recover(); r != nil {
 				switch e := r.(type) {
@@ -84,49 +133,75 @@ func makeSafeHandler(f func(*bolt.Tx) error) func(*bolt.Tx) error {
 
 // CreateBuild creats a build event
 func (d *DB) CreateBuild(t BuildType, cloneURL, ref, commitSHA string) (Build, error) {
-	build := Build{T: t, CloneURL: cloneURL, Ref: ref, CommitSHA: commitSHA}
-	var buildID uint64
-	err := d.db.Update(makeSafeHandler(func(tx *bolt.Tx) error {
+	return d.createBuild(Build{T: t, CloneURL: cloneURL, Ref: ref, CommitSHA: commitSHA})
+}
+
+// CreatePullRequestBuild creates a build event of a pull request
+func (d *DB) CreatePullRequestBuild(cloneURL, ref, commitSHA string, pr PullRequestInfo) (Build, error) {
+	return d.createBuild(Build{T: PullRequest, CloneURL: cloneURL, Ref: ref, CommitSHA: commitSHA, PR: pr})
+}
+
+// CreateScheduledBuild creates a build triggered by schedule
+func (d *DB) CreateScheduledBuild(cloneURL, ref, commitSHA, schedule string) (Build, error) {
+	return d.createBuild(Build{T: Scheduled, CloneURL: cloneURL, Ref: ref, CommitSHA: commitSHA, Schedule: schedule})
+}
+
+// CreateReleaseBuild creates a build of tag ref, such as
+// refs/tags/v1.0
+func (d *DB) CreateReleaseBuild(cloneURL, ref, commitSHA string, r ReleaseInfo) (Build, error) {
+	return d.createBuild(Build{T: Release, CloneURL: cloneURL, Ref: ref, CommitSHA: commitSHA, Release: r})
+}
+
+func (d *DB) createBuild(build Build) (Build, error) {
+	build.Created = time.Now().UTC().Round(0)
+	err := d.update(makeSafeHandler(func(tx Tx) error {
 		b, err := tx.CreateBucketIfNotExists(buildBucket)
 		candy.Must(err)
-		buildID, err = b.NextSequence()
-		candy.Must(err)
-		build.ID = buildID
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		candy.Must(enc.Encode(build))
-		candy.Must(b.Put(itob(buildID), buf.Bytes()))
-		b, err = tx.CreateBucketIfNotExists(shaBucket)
-		candy.Must(err)
-		b, err = b.CreateBucketIfNotExists([]byte(build.CommitSHA))
-		candy.Must(err)
-		commitID, err := b.NextSequence()
+		build.ID, err = b.NextSequence()
 		candy.Must(err)
-		candy.Must(b.Put(itob(commitID), itob(build.ID)))
-		b, err = tx.CreateBucketIfNotExists(refBucket)
-		candy.Must(err)
-		b, err = b.CreateBucketIfNotExists(itob(uint64(build.T)))
-		candy.Must(err)
-		b, err = b.CreateBucketIfNotExists([]byte(build.Ref))
-		candy.Must(err)
-		refID, err := b.NextSequence()
-		candy.Must(err)
-		candy.Must(b.Put(itob(refID), itob(build.ID)))
-		b, err = tx.CreateBucketIfNotExists(pendingBucket)
-		candy.Must(err)
-		return b.Put(itob(buildID), make([]byte, 0))
+		putBuild(tx, build)
+		unarchive(tx, build.T, build.Ref)
+		return nil
 	}))
 	if err != nil {
 		return Build{}, err
 	}
-	build.db = d.db
+	build.db = d
 	return build, err
 }
 
+// putBuild puts build into the database with its index entries, the
+// build is pending until its status is finished.
+func putBuild(tx Tx, build Build) {
+	b, err := tx.CreateBucketIfNotExists(buildBucket)
+	candy.Must(err)
+	candy.Must(putGob(b, itob(build.ID), build))
+	b, err = tx.CreateBucketIfNotExists(shaBucket)
+	candy.Must(err)
+	b, err = b.CreateBucketIfNotExists([]byte(build.CommitSHA))
+	candy.Must(err)
+	commitID, err := b.NextSequence()
+	candy.Must(err)
+	candy.Must(b.Put(itob(commitID), itob(build.ID)))
+	b, err = tx.CreateBucketIfNotExists(refBucket)
+	candy.Must(err)
+	b, err = b.CreateBucketIfNotExists(itob(uint64(build.T)))
+	candy.Must(err)
+	b, err = b.CreateBucketIfNotExists([]byte(build.Ref))
+	candy.Must(err)
+	refID, err := b.NextSequence()
+	candy.Must(err)
+	candy.Must(b.Put(itob(refID), itob(build.ID)))
+	indexTime(tx, indexKey(build.Created, build.ID))
+	b, err = tx.CreateBucketIfNotExists(pendingBucket)
+	candy.Must(err)
+	candy.Must(b.Put(itob(build.ID), make([]byte, 0)))
+}
+
 // Build returns build given build id
 func (d *DB) Build(id uint64) (Build, error) {
 	var build Build
-	err := d.db.View(makeSafeHandler(func(tx *bolt.Tx) error {
+	err := d.view(makeSafeHandler(func(tx Tx) error {
 		b := tx.Bucket(buildBucket)
 		if b == nil {
 			return errors.New("buildBucket does not exist")
@@ -140,7 +215,7 @@ func (d *DB) Build(id uint64) (Build, error) {
 	if err != nil {
 		return Build{}, err
 	}
-	build.db = d.db
+	build.db = d
 	return build, nil
 }
 
@@ -171,7 +246,7 @@ func (d *DB) PendingBuilds() ([]Build, error) {
 
 func (d *DB) pendingBuilds() ([]uint64, error) {
 	var ids []uint64
-	err := d.db.View(func(tx *bolt.Tx) error {
+	err := d.view(func(tx Tx) error {
 		b := tx.Bucket(pendingBucket)
 		if b == nil {
 			// no pending bucket
@@ -190,10 +265,11 @@ func (d *DB) pendingBuilds() ([]uint64, error) {
 	return ids, nil
 }
 
-// Refs returns all refs of given build type
+// Refs returns refs of given build type which are not archived, see
+// ArchivedRefs for archived refs
 func (d *DB) Refs(t BuildType) ([]string, error) {
 	var refs []string
-	err := d.db.View(func(tx *bolt.Tx) error {
+	err := d.view(func(tx Tx) error {
 		b := tx.Bucket(refBucket)
 		if b == nil {
 			return nil
@@ -202,9 +278,10 @@ func (d *DB) Refs(t BuildType) ([]string, error) {
 		if b == nil {
 			return nil
 		}
+		archived := archivedRefs(tx, t)
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			if v == nil {
+			if v == nil && (archived == nil || archived.Get(k) == nil) {
 				refs = append(refs, string(k))
 			}
 		}
@@ -240,7 +317,7 @@ func (d *DB) RefBuilds(t BuildType, ref string, start, end int) ([]Build, error)
 func (d *DB) refBuilds(t BuildType, ref string, start, end int) ([]uint64, error) {
 	var ids []uint64
 	diff := end - start
-	err := d.db.View(func(tx *bolt.Tx) error {
+	err := d.view(func(tx Tx) error {
 		b := tx.Bucket(refBucket)
 		if b == nil {
 			return nil
@@ -277,7 +354,7 @@ func (d *DB) SHABuilds(sha string) ([]Build, error) {
 
 func (d *DB) shaBuilds(sha string) ([]uint64, error) {
 	var ids []uint64
-	err := d.db.View(func(tx *bolt.Tx) error {
+	err := d.view(func(tx Tx) error {
 		b := tx.Bucket(shaBucket)
 		if b == nil {
 			// no pending bucket
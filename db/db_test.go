@@ -1,17 +1,68 @@
 package db_test
 
 import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"os"
 
+	_ "github.com/lib/pq"
 	"github.com/wangkuiyi/ci/db"
+	_ "modernc.org/sqlite"
 )
 
 const testPath = "tmp.test.db"
 
+var (
+	drivers    = flag.String("drivers", "bolt,sqlite", "comma separated storage drivers the tests run against: bolt, sqlite and postgres")
+	dataSource = flag.String("postgres", "", "data source of the PostgreSQL database the tests run against, its tables are dropped")
+
+	// driver is the storage driver of the current run
+	driver string
+)
+
+// TestMain runs all tests against each storage driver
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := 0
+	for _, driver = range strings.Split(*drivers, ",") {
+		fmt.Println("storage driver:", driver)
+		if c := m.Run(); c != 0 {
+			code = c
+		}
+	}
+	os.Exit(code)
+}
+
+// open opens the database of the current storage driver, sqlite stores
+// the database in file path as bolt does.
+func open(path string) (*db.DB, error) {
+	switch driver {
+	case "bolt":
+		return db.Open(path)
+	case "sqlite":
+		return db.OpenSQL("sqlite", path)
+	case "postgres":
+		s, err := sql.Open("postgres", *dataSource)
+		if err != nil {
+			return nil, err
+		}
+		defer s.Close()
+		_, err = s.Exec("DROP TABLE IF EXISTS ci_bucket, ci_kv")
+		if err != nil {
+			return nil, err
+		}
+		return db.OpenSQL("postgres", *dataSource)
+	}
+	return nil, fmt.Errorf("unknown storage driver: %s", driver)
+}
+
 func TestBuildCreateQuery(t *testing.T) {
-	d, err := db.Open(testPath)
+	d, err := open(testPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,10 +91,48 @@ func TestBuildCreateQuery(t *testing.T) {
 	if bb != b {
 		t.Fatal(b, bb)
 	}
+
+	b, err = d.CreateScheduledBuild("url", "refs/heads/master", "sha", "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err = d.Build(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bb != b || bb.T != db.Scheduled || bb.Schedule != "nightly" {
+		t.Fatal(b, bb)
+	}
+	refs, err := d.Refs(db.Scheduled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != "refs/heads/master" {
+		t.Fatal(refs)
+	}
+
+	b, err = d.CreateReleaseBuild("url", "refs/tags/v1.0", "sha", db.ReleaseInfo{Name: "1.0", Prerelease: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb, err = d.Build(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bb != b || bb.T != db.Release || bb.Tag() != "v1.0" || bb.Release.Name != "1.0" || !bb.Release.Prerelease {
+		t.Fatal(b, bb)
+	}
+	refs, err = d.Refs(db.Push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != "ref" {
+		t.Fatal(refs)
+	}
 }
 
 func TestPendingBuilds(t *testing.T) {
-	d, err := db.Open(testPath)
+	d, err := open(testPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,7 +172,7 @@ func TestPendingBuilds(t *testing.T) {
 }
 
 func TestRefBuilds(t *testing.T) {
-	d, err := db.Open(testPath)
+	d, err := open(testPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -165,7 +254,7 @@ func TestRefBuilds(t *testing.T) {
 }
 
 func TestRefs(t *testing.T) {
-	d, err := db.Open(testPath)
+	d, err := open(testPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -219,3 +308,101 @@ func TestRefs(t *testing.T) {
 		t.Fatal(refs)
 	}
 }
+
+// TestConcurrentWriters writes to the database from several goroutines,
+// on PostgreSQL through two connections to the same database as two ci
+// processes do, conflicting transactions are retried rather than fail.
+func TestConcurrentWriters(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	other := d
+	if driver == "postgres" {
+		other, err = db.OpenSQL("postgres", *dataSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+	}
+
+	const writers, lines = 4, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		dd := d
+		if i%2 == 1 {
+			dd = other
+		}
+		b, err := dd.CreateBuild(db.Push, "url", "ref", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := b.NewAttempt("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				err := a.AppendOutput(db.OutputLine{T: db.Stdout, Str: fmt.Sprint(j)})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- a.SetStatus(db.BuildSuccess)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				_, _, err := dd.AddDelivery(db.Delivery{ID: fmt.Sprintf("%d-%d", i, j), Event: "push", Outcome: db.DeliveryPending})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bs, err := d.RefBuilds(db.Push, "ref", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != writers {
+		t.Fatal(bs)
+	}
+	for _, b := range bs {
+		as, err := b.Attempts()
+		if err != nil || len(as) != 1 {
+			t.Fatal(as, err)
+		}
+		l, err := as[0].Output(0, -1)
+		if err != nil || len(l) != lines {
+			t.Fatal(len(l), err)
+		}
+		if s, err := b.Status(); err != nil || s != db.BuildSuccess {
+			t.Fatal(s, err)
+		}
+	}
+	if _, total, err := d.PendingDeliveries(0); err != nil || total != writers*lines {
+		t.Fatal(total, err)
+	}
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// Webhook deliveries are stored in deliveryBucket/<seq> without their
+// bodies, which are in deliveryBodyBucket/<seq>. deliveryIDBucket maps
+// delivery ids sent by github to sequence numbers, and
+// deliveryPendingBucket/<seq> indexes pending deliveries. Deliveries
+// outlive builds, only the last deliveryLimit deliveries and pending
+// deliveries are kept.
+var (
+	deliveryBucket        = []byte("delivery")
+	deliveryBodyBucket    = []byte("delivery_body")
+	deliveryIDBucket      = []byte("delivery_id")
+	deliveryPendingBucket = []byte("delivery_pending")
+)
+
+const deliveryLimit = 1000
+
+// Outcomes of deliveries whose events are handled, a redelivery of
+// them is dropped. Other outcomes, like a malformed body, are errors,
+// and a redelivery is recorded again.
+const (
+	DeliveryPending = "pending" // the event is waiting to be processed
+	DeliveryQueued  = "queued"  // the event is sent to the event channel
+	DeliveryIgnored = "ignored" // the event type is not handled
+)
+
+// handled returns if the event of a delivery with outcome is handled
+func handled(outcome string) bool {
+	return outcome == DeliveryPending || outcome == DeliveryQueued || outcome == DeliveryIgnored
+}
+
+// Delivery is a webhook delivery received from github
+type Delivery struct {
+	Seq      uint64 // sequence number of the delivery in the database, starts from 1
+	ID       string // the X-GitHub-Delivery header, empty if it is not sent
+	Event    string // the X-GitHub-Event header
+	Header   map[string][]string
+	Body     []byte // the raw body, nil in deliveries returned by Deliveries
+	Received time.Time
+	Outcome  string    // how the delivery was handled
+	Replayed time.Time // when the delivery was last replayed, zero if never
+}
+
+// AddDelivery records a delivery received now, returns the recorded
+// delivery. If a delivery with the same id has been recorded and its
+// event is handled, dup is true and the recorded one is returned.
+func (d *DB) AddDelivery(dv Delivery) (r Delivery, dup bool, err error) {
+	err = d.update(makeSafeHandler(func(tx Tx) error {
+		ids, err := tx.CreateBucketIfNotExists(deliveryIDBucket)
+		candy.Must(err)
+		if dv.ID != "" {
+			if v := ids.Get([]byte(dv.ID)); v != nil {
+				if rec := getDelivery(tx, btoi(v), true); handled(rec.Outcome) {
+					r, dup = rec, true
+					return nil
+				}
+			}
+		}
+
+		b, err := tx.CreateBucketIfNotExists(deliveryBucket)
+		candy.Must(err)
+		dv.Seq, err = b.NextSequence()
+		candy.Must(err)
+		dv.Received = time.Now().UTC().Round(0)
+		rec := dv
+		rec.Body = nil
+		candy.Must(putGob(b, itob(dv.Seq), rec))
+		bodies, err := tx.CreateBucketIfNotExists(deliveryBodyBucket)
+		candy.Must(err)
+		candy.Must(bodies.Put(itob(dv.Seq), dv.Body))
+		if dv.ID != "" {
+			candy.Must(ids.Put([]byte(dv.ID), itob(dv.Seq)))
+		}
+		indexPending(tx, dv.Seq, dv.Outcome)
+		pruneDeliveries(tx, dv.Seq)
+		r = dv
+		return nil
+	}))
+	return
+}
+
+// indexPending adds delivery seq to the index of pending deliveries
+// if outcome is DeliveryPending, or removes it otherwise.
+func indexPending(tx Tx, seq uint64, outcome string) {
+	b, err := tx.CreateBucketIfNotExists(deliveryPendingBucket)
+	candy.Must(err)
+	if outcome == DeliveryPending {
+		candy.Must(b.Put(itob(seq), []byte{}))
+	} else {
+		candy.Must(b.Delete(itob(seq)))
+	}
+}
+
+// pruneDeliveries deletes deliveries older than the last deliveryLimit
+// deliveries up to seq, pending deliveries are kept.
+func pruneDeliveries(tx Tx, seq uint64) {
+	if seq <= deliveryLimit {
+		return
+	}
+	b := tx.Bucket(deliveryBucket)
+	pending := tx.Bucket(deliveryPendingBucket)
+	var old []uint64
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && btoi(k) <= seq-deliveryLimit; k, _ = c.Next() {
+		if pending.Get(k) == nil {
+			old = append(old, btoi(k))
+		}
+	}
+	ids := tx.Bucket(deliveryIDBucket)
+	for _, s := range old {
+		dv := getDelivery(tx, s, false)
+		// the id may map to a later delivery of it
+		if v := ids.Get([]byte(dv.ID)); dv.ID != "" && v != nil && btoi(v) == s {
+			candy.Must(ids.Delete([]byte(dv.ID)))
+		}
+		candy.Must(b.Delete(itob(s)))
+		candy.Must(tx.Bucket(deliveryBodyBucket).Delete(itob(s)))
+	}
+}
+
+// getDelivery returns delivery seq, with its body if body is true
+func getDelivery(tx Tx, seq uint64, body bool) Delivery {
+	var dv Delivery
+	b := tx.Bucket(deliveryBucket)
+	if b == nil {
+		panic(fmt.Errorf("delivery %d not exist", seq))
+	}
+	v := b.Get(itob(seq))
+	if v == nil {
+		panic(fmt.Errorf("delivery %d not exist", seq))
+	}
+	candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&dv))
+	if body {
+		if b = tx.Bucket(deliveryBodyBucket); b != nil {
+			dv.Body = append([]byte(nil), b.Get(itob(seq))...)
+		}
+	}
+	return dv
+}
+
+// SetDeliveryOutcome records how delivery seq was handled
+func (d *DB) SetDeliveryOutcome(seq uint64, outcome string) error {
+	return d.update(makeSafeHandler(func(tx Tx) error {
+		dv := getDelivery(tx, seq, false)
+		dv.Outcome = outcome
+		indexPending(tx, seq, outcome)
+		return putGob(tx.Bucket(deliveryBucket), itob(seq), dv)
+	}))
+}
+
+// Delivery returns delivery seq with its body
+func (d *DB) Delivery(seq uint64) (Delivery, error) {
+	var dv Delivery
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		dv = getDelivery(tx, seq, true)
+		return nil
+	}))
+	return dv, err
+}
+
+// SetDeliveryReplayed records that delivery seq is replayed now
+func (d *DB) SetDeliveryReplayed(seq uint64) error {
+	return d.update(makeSafeHandler(func(tx Tx) error {
+		dv := getDelivery(tx, seq, false)
+		dv.Replayed = time.Now().UTC().Round(0)
+		return putGob(tx.Bucket(deliveryBucket), itob(seq), dv)
+	}))
+}
+
+// Deliveries returns at most n deliveries received before delivery
+// before without their bodies, the latest first. before == 0 means
+// the latest deliveries.
+func (d *DB) Deliveries(before uint64, n int) ([]Delivery, error) {
+	var ds []Delivery
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		b := tx.Bucket(deliveryBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		k, v := c.Last()
+		if before != 0 {
+			k, v = c.Seek(itob(before))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && len(ds) < n; k, v = c.Prev() {
+			var dv Delivery
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&dv))
+			ds = append(ds, dv)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// PendingDeliveries returns at most n pending deliveries with their
+// bodies, the earliest first, and the number of pending deliveries.
+func (d *DB) PendingDeliveries(n int) ([]Delivery, int, error) {
+	var ds []Delivery
+	total := 0
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		b := tx.Bucket(deliveryPendingBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			if len(ds) < n {
+				ds = append(ds, getDelivery(tx, btoi(k), true))
+			}
+			total++
+			return nil
+		})
+	}))
+	if err != nil {
+		return nil, 0, err
+	}
+	return ds, total, nil
+}
@@ -0,0 +1,197 @@
+package db_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestDelivery(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	for i := 1; i <= 3; i++ {
+		dv, dup, err := d.AddDelivery(db.Delivery{
+			ID:      fmt.Sprintf("guid-%d", i),
+			Event:   "push",
+			Header:  map[string][]string{"X-Github-Event": {"push"}},
+			Body:    []byte(fmt.Sprintf(`{"ref":"refs/heads/%d"}`, i)),
+			Outcome: db.DeliveryQueued,
+		})
+		if err != nil || dup {
+			t.Fatal(dup, err)
+		}
+		if dv.Seq != uint64(i) || dv.Received.IsZero() {
+			t.Fatal(dv)
+		}
+	}
+
+	dv, dup, err := d.AddDelivery(db.Delivery{ID: "guid-2", Event: "push", Body: []byte("redelivered")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dup || dv.Seq != 2 || string(dv.Body) != `{"ref":"refs/heads/2"}` {
+		t.Fatal(dup, dv)
+	}
+	dv, dup, err = d.AddDelivery(db.Delivery{Event: "ping", Body: []byte("{}")})
+	if err != nil || dup || dv.Seq != 4 {
+		t.Fatal(dup, dv, err)
+	}
+
+	err = d.SetDeliveryOutcome(2, "queued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dv, err = d.Delivery(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dv.Outcome != "queued" || dv.Header["X-Github-Event"][0] != "push" || string(dv.Body) != `{"ref":"refs/heads/2"}` || !dv.Replayed.IsZero() {
+		t.Fatal(dv)
+	}
+	err = d.SetDeliveryReplayed(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dv, err = d.Delivery(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dv.Replayed.IsZero() || dv.Outcome != "queued" || string(dv.Body) != `{"ref":"refs/heads/2"}` {
+		t.Fatal(dv)
+	}
+	_, err = d.Delivery(9)
+	if err == nil {
+		t.Fatal("delivery 9 does not exist")
+	}
+
+	ds, err := d.Deliveries(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 3 || ds[0].Seq != 4 || ds[2].Seq != 2 || ds[0].Body != nil || ds[2].Replayed.IsZero() {
+		t.Fatal(ds)
+	}
+	ds, err = d.Deliveries(ds[2].Seq, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Seq != 1 {
+		t.Fatal(ds)
+	}
+
+	// a redelivery of a malformed delivery is recorded again
+	dv, dup, err = d.AddDelivery(db.Delivery{ID: "guid-5", Event: "push", Outcome: "malformed: EOF"})
+	if err != nil || dup || dv.Seq != 5 {
+		t.Fatal(dup, dv, err)
+	}
+	dv, dup, err = d.AddDelivery(db.Delivery{ID: "guid-5", Event: "push", Body: []byte("{}"), Outcome: db.DeliveryPending})
+	if err != nil || dup || dv.Seq != 6 {
+		t.Fatal(dup, dv, err)
+	}
+	dv, dup, err = d.AddDelivery(db.Delivery{ID: "guid-5", Event: "push", Body: []byte("{}")})
+	if err != nil || !dup || dv.Seq != 6 || dv.Outcome != db.DeliveryPending {
+		t.Fatal(dup, dv, err)
+	}
+}
+
+func TestPendingDeliveries(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	for i := 1; i <= 3; i++ {
+		_, _, err := d.AddDelivery(db.Delivery{Event: "push", Body: []byte(fmt.Sprint(i)), Outcome: db.DeliveryPending})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = d.AddDelivery(db.Delivery{Event: "watch", Outcome: "ignored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, total, err := d.PendingDeliveries(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(ds) != 2 || ds[0].Seq != 1 || string(ds[1].Body) != "2" {
+		t.Fatal(total, ds)
+	}
+
+	err = d.SetDeliveryOutcome(1, "queued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetDeliveryOutcome(4, db.DeliveryPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, total, err = d.PendingDeliveries(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(ds) != 3 || ds[0].Seq != 2 || ds[2].Seq != 4 {
+		t.Fatal(total, ds)
+	}
+}
+
+func TestDeliveriesPaging(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	// more deliveries than a read ahead batch of SQL cursors
+	const n = 600
+	for i := 0; i < n; i++ {
+		_, _, err := d.AddDelivery(db.Delivery{Event: "push"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, before := range []uint64{0, 300} {
+		ds, err := d.Deliveries(before, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := uint64(n + 1)
+		if before != 0 {
+			last = before
+		}
+		if uint64(len(ds)) != last-1 {
+			t.Fatal(before, len(ds))
+		}
+		for i, dv := range ds {
+			if dv.Seq != last-1-uint64(i) {
+				t.Fatal(before, i, dv.Seq)
+			}
+		}
+	}
+}
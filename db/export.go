@@ -0,0 +1,303 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// exportRecord is a line of an export. A "build" record is followed by
+// "attempt" and "output" records of the build.
+type exportRecord struct {
+	Type string `json:"type"`
+
+	// build records
+	Build     *Build         `json:"build,omitempty"`
+	Status    BuildStatus    `json:"status,omitempty"`
+	Approval  *Approval      `json:"approval,omitempty"`
+	Artifacts []Artifact     `json:"artifacts,omitempty"`
+	Coverage  []FileCoverage `json:"coverage,omitempty"`
+	Archived  *time.Time     `json:"archived,omitempty"` // when the ref of the build was archived
+
+	// attempt records
+	Attempt *Attempt      `json:"attempt,omitempty"`
+	State   *AttemptState `json:"state,omitempty"`
+	Tests   []TestResult  `json:"tests,omitempty"`
+
+	// output records hold lines of an attempt starting from line number
+	// Start, attempt 0 is the output of a build never attempted.
+	BuildID    uint64       `json:"build_id,omitempty"`
+	AttemptNum uint64       `json:"attempt_num,omitempty"`
+	Start      uint64       `json:"start,omitempty"`
+	Lines      []OutputLine `json:"lines,omitempty"`
+}
+
+// Backup writes a consistent snapshot of the database to w while the
+// database is in use. Only BoltDB storage supports backup, other
+// storages are backed up by Export or the tools of the SQL database.
+func (d *DB) Backup(w io.Writer) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s, ok := d.s.(io.WriterTo)
+	if !ok {
+		return 0, errors.New("the storage does not support backup, export the database instead")
+	}
+	return s.WriteTo(w)
+}
+
+// Export writes builds with their statuses, attempts, test results,
+// outputs, coverage, artifact records, approvals and archived refs to
+// w as JSON lines, in one transaction, so the export is a consistent
+// snapshot, see sqlStorage.run for PostgreSQL. The export can be
+// imported into any storage by Import.
+func (d *DB) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return d.view(makeSafeHandler(func(tx Tx) error {
+		builds := tx.Bucket(buildBucket)
+		if builds == nil {
+			return nil
+		}
+		return builds.ForEach(func(k, v []byte) error {
+			var build Build
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+			rec := exportRecord{Type: "build", Build: &build}
+			if b := tx.Bucket(statusBucket); b != nil {
+				rec.Status = BuildStatus(b.Get(k))
+			}
+			if b := tx.Bucket(approvalBucket); b != nil {
+				if v := b.Get(k); v != nil {
+					rec.Approval = &Approval{}
+					candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(rec.Approval))
+				}
+			}
+			if b := tx.Bucket(artifactBucket); b != nil {
+				if b = b.Bucket(k); b != nil {
+					candy.Must(b.ForEach(func(_, v []byte) error {
+						var a Artifact
+						candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&a))
+						rec.Artifacts = append(rec.Artifacts, a)
+						return nil
+					}))
+				}
+			}
+			rec.Coverage, _ = coverage(tx, k)
+			if at := archived(tx, build.T, build.Ref); !at.IsZero() {
+				rec.Archived = &at
+			}
+			candy.Must(enc.Encode(rec))
+
+			if b := tx.Bucket(outputBucket); b != nil {
+				if b = b.Bucket(k); b != nil {
+					exportOutput(enc, build.ID, 0, b)
+				}
+			}
+			attempts := tx.Bucket(attemptBucket)
+			if attempts == nil {
+				return nil
+			}
+			if attempts = attempts.Bucket(k); attempts == nil {
+				return nil
+			}
+			return attempts.ForEach(func(num, v []byte) error {
+				rec := exportRecord{Type: "attempt", Attempt: &Attempt{}}
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(rec.Attempt))
+				if b := tx.Bucket(attemptStateBucket); b != nil {
+					if b = b.Bucket(k); b != nil {
+						if v := b.Get(num); v != nil {
+							rec.State = &AttemptState{}
+							candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(rec.State))
+						}
+					}
+				}
+				rec.Tests = testResults(tx, k, num)
+				candy.Must(enc.Encode(rec))
+
+				if b := tx.Bucket(attemptOutputBucket); b != nil {
+					if b = b.Bucket(k); b != nil {
+						if b = b.Bucket(num); b != nil {
+							exportOutput(enc, build.ID, rec.Attempt.Num, b)
+						}
+					}
+				}
+				return nil
+			})
+		})
+	}))
+}
+
+// exportOutput writes lines in output bucket b as output records of at
+// most chunkLines lines.
+func exportOutput(enc *json.Encoder, build, attempt uint64, b Bucket) {
+	for start := uint64(1); ; start += chunkLines {
+		lines := readOutput(b, start, chunkLines)
+		if len(lines) == 0 {
+			return
+		}
+		candy.Must(enc.Encode(exportRecord{
+			Type:       "output",
+			BuildID:    build,
+			AttemptNum: attempt,
+			Start:      start,
+			Lines:      lines,
+		}))
+	}
+}
+
+// Import reads an export written by Export from r into the database,
+// which must have no build. Builds keep their ids, a build and its
+// records are imported in one transaction.
+func (d *DB) Import(r io.Reader) error {
+	err := d.view(func(tx Tx) error {
+		if b := tx.Bucket(buildBucket); b != nil {
+			if k, _ := b.Cursor().First(); k != nil {
+				return errors.New("import into a database with builds")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	var recs []exportRecord
+	for {
+		var rec exportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Type == "build" && len(recs) > 0 {
+			err = d.importBuild(recs)
+			if err != nil {
+				return err
+			}
+			recs = recs[:0]
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	return d.importBuild(recs)
+}
+
+// importBuild imports records of a build, which starts with the build
+// record.
+func (d *DB) importBuild(recs []exportRecord) error {
+	if recs[0].Type != "build" || recs[0].Build == nil {
+		return fmt.Errorf("expect a build record, got %s", recs[0].Type)
+	}
+	build := *recs[0].Build
+	id := itob(build.ID)
+
+	return d.update(makeSafeHandler(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(buildBucket)
+		candy.Must(err)
+		if b.Get(id) != nil {
+			return fmt.Errorf("build %d is imported twice", build.ID)
+		}
+		if b.Sequence() < build.ID {
+			candy.Must(b.SetSequence(build.ID))
+		}
+		putBuild(tx, build)
+
+		if a := recs[0].Approval; a != nil {
+			b, err = tx.CreateBucketIfNotExists(approvalBucket)
+			candy.Must(err)
+			candy.Must(putGob(b, id, *a))
+		}
+		for _, a := range recs[0].Artifacts {
+			b, err = tx.CreateBucketIfNotExists(artifactBucket)
+			candy.Must(err)
+			b, err = b.CreateBucketIfNotExists(id)
+			candy.Must(err)
+			n, err := b.NextSequence()
+			candy.Must(err)
+			candy.Must(putGob(b, itob(n), a))
+		}
+
+		if fs := recs[0].Coverage; fs != nil {
+			putCoverage(tx, build.ID, fs)
+		}
+		if at := recs[0].Archived; at != nil {
+			putArchived(tx, build.T, build.Ref, *at)
+		}
+
+		var outputs [][][]byte
+		for _, rec := range recs[1:] {
+			switch rec.Type {
+			case "attempt":
+				if rec.Attempt == nil || rec.Attempt.BuildID != build.ID {
+					return fmt.Errorf("attempt record of build %d is not of the build", build.ID)
+				}
+				num := itob(rec.Attempt.Num)
+				b, err = tx.CreateBucketIfNotExists(attemptBucket)
+				candy.Must(err)
+				b, err = b.CreateBucketIfNotExists(id)
+				candy.Must(err)
+				if b.Sequence() < rec.Attempt.Num {
+					candy.Must(b.SetSequence(rec.Attempt.Num))
+				}
+				candy.Must(putGob(b, num, *rec.Attempt))
+				if rec.State != nil {
+					b, err = tx.CreateBucketIfNotExists(attemptStateBucket)
+					candy.Must(err)
+					b, err = b.CreateBucketIfNotExists(id)
+					candy.Must(err)
+					candy.Must(putGob(b, num, *rec.State))
+				}
+				if len(rec.Tests) > 0 {
+					var finished time.Time
+					if rec.State != nil {
+						finished = rec.State.Finished
+					}
+					putTestResults(tx, build.ID, rec.Attempt.Num, rec.Tests, finished)
+				}
+			case "output":
+				if rec.BuildID != build.ID {
+					return fmt.Errorf("output record of build %d is not of build %d", rec.BuildID, build.ID)
+				}
+				path := [][]byte{outputBucket, id}
+				if rec.AttemptNum != 0 {
+					path = [][]byte{attemptOutputBucket, id, itob(rec.AttemptNum)}
+				}
+				outputs = append(outputs, path)
+				b, err = tx.CreateBucketIfNotExists(path[0])
+				candy.Must(err)
+				for _, name := range path[1:] {
+					b, err = b.CreateBucketIfNotExists(name)
+					candy.Must(err)
+				}
+				for i, o := range rec.Lines {
+					var buf bytes.Buffer
+					candy.Must(gob.NewEncoder(&buf).Encode(o))
+					if n := putLine(tx, b, path, buf.Bytes()); n != rec.Start+uint64(i) {
+						return fmt.Errorf("output of build %d attempt %d is not continuous at line %d", build.ID, rec.AttemptNum, rec.Start+uint64(i))
+					}
+				}
+			default:
+				return fmt.Errorf("unknown record type %s of build %d", rec.Type, build.ID)
+			}
+		}
+
+		if s := recs[0].Status; s != "" {
+			candy.Must(setStatus(tx, build.ID, s))
+		}
+		if isFinished(recs[0].Status) {
+			for _, path := range outputs {
+				sealOutputAt(tx, path...)
+			}
+		}
+		return nil
+	}))
+}
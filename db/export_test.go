@@ -0,0 +1,345 @@
+package db_test
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+const importPath = "tmp.import.db"
+
+func TestExportImport(t *testing.T) {
+	if driver == "postgres" {
+		t.Skip("the test needs two databases")
+	}
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	// a build never attempted
+	b, err := d.CreateBuild(db.Push, "url", "master", "sha0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AppendOutput(db.OutputLine{T: db.Info, Str: "legacy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetStatus(db.BuildError)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a pull request build attempted twice and approved
+	b, err = d.CreatePullRequestBuild("url", "feature", "sha1", db.PullRequestInfo{Number: 7, Author: "alice", Fork: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetStatus(db.BuildAwaitingApproval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Approve("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		a, err := b.NewAttempt("worker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 300; j++ {
+			err = a.AppendOutput(db.OutputLine{T: db.Stdout, Time: time.Now().UTC().Round(0), Str: "building"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = a.AddTestResults([]db.TestResult{{Suite: "pkg", Name: "TestA", Status: db.TestFailed, Message: "want 1", Line: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.SetStatus(db.BuildFailed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = b.SetCoverage([]db.FileCoverage{{File: "a.go", Coverage: db.Coverage{Covered: 1, Total: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AddArtifact(db.Artifact{Name: "dist/a.whl", SHA256: "00", Size: 1, Attempt: 2, Created: time.Now().UTC().Round(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.ArchiveRef(db.PullRequest, "feature")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a build still running
+	b, err = d.CreateBuild(db.Push, "url", "master", "sha2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := b.NewAttempt("worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.SetStatus(db.BuildRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AppendOutput(db.OutputLine{T: db.Stdout, Str: "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = d.Export(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := open(importPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := e.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(importPath)
+
+	err = e.Import(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Import(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Fatal("import into a database with builds")
+	}
+
+	for id := uint64(1); id <= 3; id++ {
+		want, err := d.Build(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := e.Build(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.T != want.T || got.Ref != want.Ref || got.CommitSHA != want.CommitSHA || got.PR != want.PR || !got.Created.Equal(want.Created) {
+			t.Fatal(got, want)
+		}
+
+		ws, err := want.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gs, err := got.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gs != ws {
+			t.Fatal(id, gs, ws)
+		}
+
+		wo, err := want.Output(0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		goo, err := got.Output(0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(goo, wo) {
+			t.Fatal(id, len(goo), len(wo))
+		}
+
+		was, err := want.Attempts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gas, err := got.Attempts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gas) != len(was) {
+			t.Fatal(id, gas, was)
+		}
+		for i := range gas {
+			wst, err := was[i].State()
+			if err != nil {
+				t.Fatal(err)
+			}
+			gst, err := gas[i].State()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gst, wst) {
+				t.Fatal(id, gst, wst)
+			}
+			wo, err := was[i].Output(0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goo, err := gas[i].Output(0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(goo, wo) {
+				t.Fatal(id, i, len(goo), len(wo))
+			}
+			wt, err := was[i].TestResults()
+			if err != nil {
+				t.Fatal(err)
+			}
+			gt, err := gas[i].TestResults()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gt, wt) {
+				t.Fatal(id, i, gt, wt)
+			}
+		}
+
+		wa, err := want.Artifacts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ga, err := got.Artifacts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ga, wa) {
+			t.Fatal(id, ga, wa)
+		}
+
+		wc, wok, err := want.Coverage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gc, gok, err := got.Coverage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gok != wok || !reflect.DeepEqual(gc, wc) {
+			t.Fatal(id, gc, wc)
+		}
+
+		wp, wok, err := want.Approval()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gp, gok, err := got.Approval()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gok != wok || gp != wp {
+			t.Fatal(id, gp, wp)
+		}
+	}
+
+	pending, err := e.PendingBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != 3 {
+		t.Fatal(pending)
+	}
+	p, err := e.QueryBuilds(db.BuildQuery{Status: db.BuildFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Builds) != 1 || p.Builds[0].ID != 2 {
+		t.Fatal(p)
+	}
+	wr, err := d.ArchivedRefs(db.PullRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := e.ArchivedRefs(db.PullRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wr) != 1 || !reflect.DeepEqual(gr, wr) {
+		t.Fatal(gr, wr)
+	}
+	rs, err := e.SearchOutput("legacy", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].BuildID != 1 {
+		t.Fatal(rs)
+	}
+	b, err = e.CreateBuild(db.Push, "url", "master", "sha3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != 4 {
+		t.Fatal(b.ID)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	_, err = d.CreateBuild(db.Push, "url", "master", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(importPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(importPath)
+	_, err = d.Backup(f)
+	f.Close()
+	if driver != "bolt" {
+		if err == nil {
+			t.Fatal("backup of SQL storage")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := db.Open(importPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	b, err := e.Build(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.CommitSHA != "sha" {
+		t.Fatal(b)
+	}
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// testHistoryBucket holds the latest runs of each test, keyed by the
+// test and then by build id and attempt number. The sequence of the
+// bucket of a test counts its runs. The history outlives builds
+// deleted by the retention policy.
+var testHistoryBucket = []byte("test_history")
+
+const (
+	// runs of a test kept in its history
+	testHistoryLimit = 100
+	// a test is flaky if its status flips this many times on a branch
+	flakyFlips = 3
+)
+
+// testRun is a run of a test in the history of the test
+type testRun struct {
+	Build, Attempt uint64
+	T              BuildType
+	Ref            string
+	SHA            string
+	Status         TestStatus
+	Time           time.Time
+}
+
+// FlakyTest is the flakiness of a test computed from its history
+type FlakyTest struct {
+	Suite, Name string
+	Runs        int // passed and failed runs in the history
+	Failures    int
+	// Flips counts status changes between consecutive runs of push
+	// builds of different commits of the same branch
+	Flips int
+	// Conflicts counts commits on which the test both passed and failed
+	Conflicts int
+	// Score is (Flips + Conflicts) / Runs, capped at 1, higher is
+	// flakier
+	Score float64
+	// the latest failed run
+	LastFailure        time.Time
+	LastFailureBuild   uint64
+	LastFailureAttempt uint64
+}
+
+// Flaky returns whether the test passed and failed on a commit, or
+// flipped repeatedly on a branch
+func (f FlakyTest) Flaky() bool {
+	return f.Conflicts > 0 || f.Flips >= flakyFlips
+}
+
+// testKey is the key of a test in testHistoryBucket
+func testKey(suite, name string) []byte {
+	return []byte(suite + "\x00" + name)
+}
+
+// recordTestRuns records passed and failed results rs of attempt num of
+// build id in the history of the tests, the runs happened at t.
+func recordTestRuns(tx Tx, id, num uint64, rs []TestResult, t time.Time) {
+	var build Build
+	if b := tx.Bucket(buildBucket); b != nil {
+		if v := b.Get(itob(id)); v != nil {
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+		}
+	}
+	history, err := tx.CreateBucketIfNotExists(testHistoryBucket)
+	candy.Must(err)
+	key := append(itob(id), itob(num)...)
+	for _, r := range rs {
+		if r.Status != TestPassed && r.Status != TestFailed {
+			continue
+		}
+		b, err := history.CreateBucketIfNotExists(testKey(r.Suite, r.Name))
+		candy.Must(err)
+		runs := countRuns(b)
+		if b.Get(key) == nil {
+			runs++
+		}
+		candy.Must(putGob(b, key, testRun{
+			Build:   id,
+			Attempt: num,
+			T:       build.T,
+			Ref:     build.Ref,
+			SHA:     build.CommitSHA,
+			Status:  r.Status,
+			Time:    t,
+		}))
+		pruneHistory(b, runs)
+	}
+}
+
+// countRuns returns the number of runs in history b. Histories recorded
+// before runs were counted are counted once.
+func countRuns(b Bucket) uint64 {
+	if n := b.Sequence(); n > 0 {
+		return n
+	}
+	var n uint64
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// pruneHistory deletes the oldest runs in history b of the given
+// number of runs beyond testHistoryLimit, and records the number of
+// runs left.
+func pruneHistory(b Bucket, runs uint64) {
+	for ; runs > testHistoryLimit; runs-- {
+		k, _ := b.Cursor().First()
+		candy.Must(b.Delete(append([]byte{}, k...)))
+	}
+	candy.Must(b.SetSequence(runs))
+}
+
+// flakiness computes the flakiness of the test of key from its
+// history b
+func flakiness(key []byte, b Bucket) FlakyTest {
+	var f FlakyTest
+	if i := bytes.IndexByte(key, 0); i >= 0 {
+		f.Suite, f.Name = string(key[:i]), string(key[i+1:])
+	}
+	last := make(map[string]testRun) // the last run on each branch
+	statuses := make(map[string]TestStatus)
+	conflicts := make(map[string]bool)
+	candy.Must(b.ForEach(func(_, v []byte) error {
+		var r testRun
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&r))
+		f.Runs++
+		if r.Status == TestFailed {
+			f.Failures++
+			f.LastFailure, f.LastFailureBuild, f.LastFailureAttempt = r.Time, r.Build, r.Attempt
+		}
+		if r.T == Push {
+			// runs on the same commit conflict rather than flip
+			if l, ok := last[r.Ref]; ok && l.Status != r.Status && l.SHA != r.SHA {
+				f.Flips++
+			}
+			last[r.Ref] = r
+		}
+		if s, ok := statuses[r.SHA]; ok && s != r.Status {
+			conflicts[r.SHA] = true
+		}
+		statuses[r.SHA] = r.Status
+		return nil
+	}))
+	f.Conflicts = len(conflicts)
+	if f.Runs > 0 {
+		f.Score = float64(f.Flips+f.Conflicts) / float64(f.Runs)
+		if f.Score > 1 {
+			f.Score = 1
+		}
+	}
+	return f
+}
+
+// FlakyTests returns flaky tests, the flakiest first
+func (d *DB) FlakyTests() ([]FlakyTest, error) {
+	var fs []FlakyTest
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		history := tx.Bucket(testHistoryBucket)
+		if history == nil {
+			return nil
+		}
+		return history.ForEach(func(k, _ []byte) error {
+			if f := flakiness(k, history.Bucket(k)); f.Flaky() {
+				fs = append(fs, f)
+			}
+			return nil
+		})
+	}))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(fs, func(i, j int) bool {
+		if fs[i].Score != fs[j].Score {
+			return fs[i].Score > fs[j].Score
+		}
+		return fs[i].LastFailure.After(fs[j].LastFailure)
+	})
+	return fs, nil
+}
+
+// TestFlakiness returns the flakiness of the test of suite and name,
+// the test has no run if it is not found.
+func (d *DB) TestFlakiness(suite, name string) (FlakyTest, error) {
+	f := FlakyTest{Suite: suite, Name: name}
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		history := tx.Bucket(testHistoryBucket)
+		if history == nil {
+			return nil
+		}
+		key := testKey(suite, name)
+		if b := history.Bucket(key); b != nil {
+			f = flakiness(key, b)
+		}
+		return nil
+	}))
+	return f, err
+}
+
+// FlakyFailures returns the flakiness of failed tests of the attempt,
+// in the order of their results.
+func (a *Attempt) FlakyFailures() ([]FlakyTest, error) {
+	var fs []FlakyTest
+	err := a.db.view(makeSafeHandler(func(tx Tx) error {
+		history := tx.Bucket(testHistoryBucket)
+		for _, r := range testResults(tx, itob(a.BuildID), itob(a.Num)) {
+			if r.Status != TestFailed {
+				continue
+			}
+			f := FlakyTest{Suite: r.Suite, Name: r.Name}
+			key := testKey(r.Suite, r.Name)
+			if history != nil && history.Bucket(key) != nil {
+				f = flakiness(key, history.Bucket(key))
+			}
+			fs = append(fs, f)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
@@ -0,0 +1,163 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestFlakyTests(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	run := func(b db.Build, rs ...db.TestResult) db.Attempt {
+		a, err := b.NewAttempt("worker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.AddTestResults(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	pass := func(name string) db.TestResult { return db.TestResult{Suite: "pkg", Name: name, Status: db.TestPassed} }
+	fail := func(name string) db.TestResult { return db.TestResult{Suite: "pkg", Name: name, Status: db.TestFailed} }
+
+	// TestRetry fails and passes on the same commit, TestFlip flips on
+	// master, TestBroken is broken by a commit and TestOK never fails.
+	results := [][]db.TestResult{
+		{fail("TestRetry"), pass("TestFlip"), pass("TestBroken"), pass("TestOK")},
+		{fail("TestFlip"), fail("TestBroken"), pass("TestOK")},
+		{pass("TestFlip"), fail("TestBroken"), pass("TestOK")},
+		{fail("TestFlip"), fail("TestBroken"), pass("TestOK")},
+	}
+	var first db.Build
+	var last db.Attempt
+	for i, rs := range results {
+		b, err := d.CreateBuild(db.Push, "url", "master", string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = run(b, rs...)
+		if i == 0 {
+			first = b
+			run(b, pass("TestRetry"))
+		}
+	}
+	// a pull request does not flip tests on master
+	b, err := d.CreatePullRequestBuild("url", "master", "e", db.PullRequestInfo{Number: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(b, pass("TestBroken"))
+
+	fs, err := d.FlakyTests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 {
+		t.Fatal(fs)
+	}
+	if f := fs[0]; f.Name != "TestFlip" || f.Flips != 3 || f.Conflicts != 0 || f.Runs != 4 || f.Failures != 2 || f.Score != 0.75 || f.LastFailureBuild != 4 {
+		t.Fatal(f)
+	}
+	if f := fs[1]; f.Name != "TestRetry" || f.Conflicts != 1 || f.Runs != 2 || f.LastFailureBuild != first.ID || f.LastFailureAttempt != 1 {
+		t.Fatal(f)
+	}
+
+	f, err := d.TestFlakiness("pkg", "TestBroken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Flaky() || f.Flips != 1 || f.Runs != 5 {
+		t.Fatal(f)
+	}
+	f, err = d.TestFlakiness("pkg", "TestMissing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Flaky() || f.Runs != 0 {
+		t.Fatal(f)
+	}
+
+	fs, err = last.FlakyFailures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 2 || fs[0].Name != "TestFlip" || !fs[0].Flaky() || fs[1].Name != "TestBroken" || fs[1].Flaky() {
+		t.Fatal(fs)
+	}
+
+	// the history outlives deleted builds
+	err = d.DeleteBuild(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = d.TestFlakiness("pkg", "TestRetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Flaky() {
+		t.Fatal(f)
+	}
+}
+
+func TestTestHistoryLimit(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreateBuild(db.Push, "url", "master", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 105; i++ {
+		a, err := b.NewAttempt("worker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := db.TestPassed
+		if i == 0 {
+			status = db.TestFailed
+		}
+		rs := []db.TestResult{{Suite: "pkg", Name: "TestA", Status: status}}
+		err = a.AddTestResults(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 104 {
+			// recording an attempt again does not count it twice
+			err = a.AddTestResults(rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	f, err := d.TestFlakiness("pkg", "TestA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the oldest runs, including the only failure, are pruned
+	if f.Runs != 100 || f.Failures != 0 {
+		t.Fatal(f)
+	}
+}
@@ -0,0 +1,445 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+var versionKey = []byte("version")
+
+// migration changes the database from version-1 to version. migrate
+// runs in a read-write transaction and reports every change it makes
+// with change.
+type migration struct {
+	version     uint64
+	description string
+	migrate     func(tx Tx, change func(format string, a ...interface{}))
+}
+
+// migrations in the order they are applied, a new migration is
+// appended with the next version.
+var migrations = []migration{
+	{1, "move output of builds recorded before attempts into their first attempt", moveOutputToAttempts},
+	{2, "record creation time of builds from their first attempt", recordBuildCreated},
+	{3, "index builds by status and creation time", indexBuilds},
+	{4, "index build output for searching", indexBuildOutput},
+	{5, "compress build output into chunks", compressOutput},
+	{6, "aggregate statistics of finished builds", aggregateStats},
+	{7, "record history of test results for flakiness", recordTestHistory},
+}
+
+// MigrationReport describes the changes of a migration
+type MigrationReport struct {
+	Version     uint64
+	Description string
+	Changes     []string
+}
+
+// schemaVersion returns the schema version of the database, databases
+// created before versioning are of version 0.
+func schemaVersion(tx Tx) uint64 {
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return 0
+	}
+	v := b.Get(versionKey)
+	if v == nil {
+		return 0
+	}
+	return btoi(v)
+}
+
+func setSchemaVersion(tx Tx, version uint64) {
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	candy.Must(err)
+	candy.Must(b.Put(versionKey, itob(version)))
+}
+
+// isEmpty returns whether the database has no bucket at all
+func isEmpty(tx Tx) bool {
+	return tx.ForEach(func(_ []byte, _ Bucket) error {
+		return errNotEmpty
+	}) == nil
+}
+
+var (
+	errNotEmpty = errors.New("not empty")
+	errDryRun   = errors.New("dry run")
+)
+
+// apply applies migration m if the database is older than m
+func apply(tx Tx, m migration) (*MigrationReport, error) {
+	if m.version <= schemaVersion(tx) {
+		return nil, nil
+	}
+	r := &MigrationReport{Version: m.version, Description: m.description}
+	err := makeSafeHandler(func(tx Tx) error {
+		m.migrate(tx, func(format string, a ...interface{}) {
+			r.Changes = append(r.Changes, fmt.Sprintf(format, a...))
+		})
+		setSchemaVersion(tx, m.version)
+		return nil
+	})(tx)
+	if err != nil {
+		return nil, fmt.Errorf("migrate to version %d: %v", m.version, err)
+	}
+	return r, nil
+}
+
+// migrate applies pending migrations, each one in its own transaction.
+// In dry-run mode, migrations are applied in one transaction which is
+// rolled back, so that the database is not changed.
+func migrate(s Storage, dryRun bool) ([]MigrationReport, error) {
+	err := s.View(func(tx Tx) error {
+		latest := migrations[len(migrations)-1].version
+		if v := schemaVersion(tx); v > latest {
+			return fmt.Errorf("database schema version %d is newer than %d of this ci, run a newer ci", v, latest)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []MigrationReport
+	if dryRun {
+		err := s.Update(makeSafeHandler(func(tx Tx) error {
+			reports = nil // the transaction may be retried
+			if isEmpty(tx) {
+				// a new database has nothing to migrate
+				return errDryRun
+			}
+			for _, m := range migrations {
+				r, err := apply(tx, m)
+				if err != nil {
+					return err
+				}
+				if r != nil {
+					reports = append(reports, *r)
+				}
+			}
+			return errDryRun
+		}))
+		if err != errDryRun {
+			return reports, err
+		}
+		return reports, nil
+	}
+
+	err = s.Update(makeSafeHandler(func(tx Tx) error {
+		if isEmpty(tx) {
+			// a new database has nothing to migrate
+			setSchemaVersion(tx, migrations[len(migrations)-1].version)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		var r *MigrationReport
+		err = s.Update(func(tx Tx) (err error) {
+			r, err = apply(tx, m)
+			return err
+		})
+		if err != nil {
+			return reports, err
+		}
+		if r != nil {
+			log.Printf("db: migrated to version %d, %s: %d changes", r.Version, r.Description, len(r.Changes))
+			reports = append(reports, *r)
+		}
+	}
+	return reports, nil
+}
+
+// DryRun reports the changes pending migrations would make to the
+// database stored in the BoltDB file at path without changing it.
+func DryRun(path string) ([]MigrationReport, error) {
+	s, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return migrate(s, true)
+}
+
+// DryRunSQL is DryRun of a database stored in a SQL database, see
+// OpenSQL.
+func DryRunSQL(driver, dataSource string) ([]MigrationReport, error) {
+	s, err := openSQL(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return migrate(s, true)
+}
+
+// Version returns the schema version of the database
+func (d *DB) Version() (uint64, error) {
+	var v uint64
+	err := d.view(func(tx Tx) error {
+		v = schemaVersion(tx)
+		return nil
+	})
+	return v, err
+}
+
+func moveOutputToAttempts(tx Tx, change func(format string, a ...interface{})) {
+	output := tx.Bucket(outputBucket)
+	if output == nil {
+		return
+	}
+	var ids [][]byte
+	candy.Must(output.ForEach(func(id, _ []byte) error {
+		ids = append(ids, id)
+		return nil
+	}))
+
+	for _, id := range ids {
+		if latestAttempt(tx, btoi(id)) != 0 {
+			// output of builds with attempts has been recorded in attempts
+			continue
+		}
+		var created Build
+		if v := tx.Bucket(buildBucket).Get(id); v != nil {
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&created))
+		}
+
+		b, err := tx.CreateBucketIfNotExists(attemptBucket)
+		candy.Must(err)
+		b, err = b.CreateBucketIfNotExists(id)
+		candy.Must(err)
+		num, err := b.NextSequence()
+		candy.Must(err)
+		candy.Must(putGob(b, itob(num), Attempt{BuildID: btoi(id), Num: num, Created: created.Created}))
+
+		// a build without status is queued if it is pending, or else
+		// its status is unknown and left empty, rather than made up.
+		var state AttemptState
+		if s := tx.Bucket(statusBucket); s != nil && s.Get(id) != nil {
+			state.Status = BuildStatus(s.Get(id))
+		} else if p := tx.Bucket(pendingBucket); p != nil && p.Get(id) != nil {
+			state.Status = BuildQueued
+		} else {
+			change("build %d: status unknown", btoi(id))
+		}
+		b, err = tx.CreateBucketIfNotExists(attemptStateBucket)
+		candy.Must(err)
+		b, err = b.CreateBucketIfNotExists(id)
+		candy.Must(err)
+		candy.Must(putGob(b, itob(num), state))
+
+		b, err = tx.CreateBucketIfNotExists(attemptOutputBucket)
+		candy.Must(err)
+		b, err = b.CreateBucket(id)
+		candy.Must(err)
+		b, err = b.CreateBucket(itob(num))
+		candy.Must(err)
+		lines := 0
+		candy.Must(output.Bucket(id).ForEach(func(_, _ []byte) error {
+			lines++
+			return nil
+		}))
+		candy.Must(copyBucket(b, output.Bucket(id)))
+		candy.Must(output.DeleteBucket(id))
+		change("build %d: moved %d output lines into attempt %d", btoi(id), lines, num)
+	}
+}
+
+func recordBuildCreated(tx Tx, change func(format string, a ...interface{})) {
+	builds := tx.Bucket(buildBucket)
+	if builds == nil {
+		return
+	}
+	attempts := tx.Bucket(attemptBucket)
+	if attempts == nil {
+		return
+	}
+
+	updated := make(map[uint64]Build)
+	candy.Must(builds.ForEach(func(k, v []byte) error {
+		var build Build
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+		if !build.Created.IsZero() {
+			return nil
+		}
+		a := attempts.Bucket(k)
+		if a == nil {
+			return nil
+		}
+		_, first := a.Cursor().First()
+		if first == nil {
+			return nil
+		}
+		var attempt Attempt
+		candy.Must(gob.NewDecoder(bytes.NewReader(first)).Decode(&attempt))
+		if attempt.Created.IsZero() {
+			return nil
+		}
+		build.Created = attempt.Created
+		updated[build.ID] = build
+		return nil
+	}))
+
+	for id, build := range updated {
+		candy.Must(putGob(builds, itob(id), build))
+		change("build %d: created at %s", id, build.Created)
+	}
+}
+
+func indexBuilds(tx Tx, change func(format string, a ...interface{})) {
+	builds := tx.Bucket(buildBucket)
+	if builds == nil {
+		return
+	}
+	status := tx.Bucket(statusBucket)
+	n := 0
+	candy.Must(builds.ForEach(func(k, v []byte) error {
+		var build Build
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+		key := indexKey(build.Created, build.ID)
+		indexTime(tx, key)
+		if status != nil {
+			if s := status.Get(k); s != nil {
+				indexStatus(tx, key, "", BuildStatus(s))
+			}
+		}
+		n++
+		return nil
+	}))
+	change("indexed %d builds", n)
+}
+
+func indexBuildOutput(tx Tx, change func(format string, a ...interface{})) {
+	index := func(path [][]byte, b Bucket) {
+		n := 0
+		candy.Must(b.ForEach(func(k, v []byte) error {
+			var o OutputLine
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&o))
+			indexOutput(tx, path, btoi(k), o.Str)
+			n++
+			return nil
+		}))
+		build, attempt := outputOf(path)
+		change("build %d attempt %d: indexed %d lines", build, attempt, n)
+	}
+
+	if output := tx.Bucket(outputBucket); output != nil {
+		candy.Must(output.ForEach(func(id, _ []byte) error {
+			index([][]byte{outputBucket, id}, output.Bucket(id))
+			return nil
+		}))
+	}
+	if output := tx.Bucket(attemptOutputBucket); output != nil {
+		candy.Must(output.ForEach(func(id, _ []byte) error {
+			attempts := output.Bucket(id)
+			return attempts.ForEach(func(num, _ []byte) error {
+				index([][]byte{attemptOutputBucket, id, num}, attempts.Bucket(num))
+				return nil
+			})
+		}))
+	}
+}
+
+// forEachOutput calls fn with each output bucket and its path. Paths
+// are collected before calling fn, so that fn can change the buckets.
+func forEachOutput(tx Tx, fn func(path [][]byte, b Bucket)) {
+	var paths [][][]byte
+	if output := tx.Bucket(outputBucket); output != nil {
+		candy.Must(output.ForEach(func(id, _ []byte) error {
+			paths = append(paths, [][]byte{outputBucket, append([]byte{}, id...)})
+			return nil
+		}))
+	}
+	if output := tx.Bucket(attemptOutputBucket); output != nil {
+		candy.Must(output.ForEach(func(id, _ []byte) error {
+			return output.Bucket(id).ForEach(func(num, _ []byte) error {
+				paths = append(paths, [][]byte{attemptOutputBucket, append([]byte{}, id...), append([]byte{}, num...)})
+				return nil
+			})
+		}))
+	}
+
+	for _, path := range paths {
+		b := tx.Bucket(path[0])
+		for _, name := range path[1:] {
+			b = b.Bucket(name)
+		}
+		fn(path, b)
+	}
+}
+
+func compressOutput(tx Tx, change func(format string, a ...interface{})) {
+	forEachOutput(tx, func(path [][]byte, b Bucket) {
+		n := sealOutput(b)
+		if n == 0 {
+			return
+		}
+		build, attempt := outputOf(path)
+		change("build %d attempt %d: compressed %d lines", build, attempt, n)
+	})
+}
+
+func aggregateStats(tx Tx, change func(format string, a ...interface{})) {
+	builds := tx.Bucket(buildBucket)
+	status := tx.Bucket(statusBucket)
+	if builds == nil || status == nil {
+		return
+	}
+	type finished struct {
+		id      uint64
+		s       BuildStatus
+		created time.Time
+	}
+	var fs []finished
+	candy.Must(builds.ForEach(func(k, v []byte) error {
+		s := BuildStatus(status.Get(k))
+		if !isFinished(s) {
+			return nil
+		}
+		var build Build
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+		fs = append(fs, finished{build.ID, s, build.Created})
+		return nil
+	}))
+	for _, f := range fs {
+		// builds never attempted are assumed to finish when created
+		recordStats(tx, f.id, f.s, f.created)
+	}
+	change("aggregated %d finished builds", len(fs))
+}
+
+func recordTestHistory(tx Tx, change func(format string, a ...interface{})) {
+	results := tx.Bucket(testResultBucket)
+	if results == nil {
+		return
+	}
+	type attempt struct{ id, num []byte }
+	var as []attempt
+	candy.Must(results.ForEach(func(id, _ []byte) error {
+		return results.Bucket(id).ForEach(func(num, _ []byte) error {
+			as = append(as, attempt{append([]byte{}, id...), append([]byte{}, num...)})
+			return nil
+		})
+	}))
+	for _, a := range as {
+		var state AttemptState
+		if b := tx.Bucket(attemptStateBucket); b != nil {
+			if b = b.Bucket(a.id); b != nil {
+				if v := b.Get(a.num); v != nil {
+					candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&state))
+				}
+			}
+		}
+		rs := testResults(tx, a.id, a.num)
+		recordTestRuns(tx, btoi(a.id), btoi(a.num), rs, state.Finished)
+		change("build %d attempt %d: recorded %d test results", btoi(a.id), btoi(a.num), len(rs))
+	}
+}
@@ -0,0 +1,234 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/wangkuiyi/ci/db"
+)
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// createLegacyDB creates a database at path in the layout before
+// schema versioning: build output is not recorded in attempts.
+func createLegacyDB(t *testing.T, path string) {
+	d, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	err = d.Update(func(tx *bolt.Tx) error {
+		builds, err := tx.CreateBucket([]byte("build"))
+		if err != nil {
+			return err
+		}
+		id, err := builds.NextSequence()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(db.Build{T: db.Push, Ref: "ref", CloneURL: "url", CommitSHA: "sha", ID: id})
+		if err != nil {
+			return err
+		}
+		err = builds.Put(itob(id), buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		status, err := tx.CreateBucket([]byte("status"))
+		if err != nil {
+			return err
+		}
+		err = status.Put(itob(id), []byte(db.BuildSuccess))
+		if err != nil {
+			return err
+		}
+
+		output, err := tx.CreateBucket([]byte("output"))
+		if err != nil {
+			return err
+		}
+		output, err = output.CreateBucket(itob(id))
+		if err != nil {
+			return err
+		}
+		for _, s := range []string{"hello", "world"} {
+			// bolt keeps values until the transaction commits
+			var buf bytes.Buffer
+			err = gob.NewEncoder(&buf).Encode(db.OutputLine{T: db.Stdout, Str: s})
+			if err != nil {
+				return err
+			}
+			seq, err := output.NextSequence()
+			if err != nil {
+				return err
+			}
+			err = output.Put(itob(seq), buf.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	if driver != "bolt" {
+		t.Skip("legacy databases are stored in BoltDB files")
+	}
+	createLegacyDB(t, testPath)
+	defer os.Remove(testPath)
+
+	reports, err := db.DryRun(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 7 || reports[0].Version != 1 || len(reports[0].Changes) != 1 {
+		t.Fatal(reports)
+	}
+	// the change of migration 1 is seen by migration 2
+	if len(reports[1].Changes) != 0 {
+		t.Fatal(reports[1])
+	}
+
+	// dry run does not change the database
+	reports, err = db.DryRun(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 7 {
+		t.Fatal(reports)
+	}
+
+	d, err := db.Open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	v, err := d.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 7 {
+		t.Fatal(v)
+	}
+
+	b, err := d.Build(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := b.Attempts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0].Num != 1 {
+		t.Fatal(as)
+	}
+	s, err := as[0].Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != db.BuildSuccess {
+		t.Fatal(s)
+	}
+	p, err := d.QueryBuilds(db.BuildQuery{Status: db.BuildSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Builds) != 1 || p.Builds[0].ID != 1 {
+		t.Fatal(p)
+	}
+	rs, err := d.SearchOutput("world", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].BuildID != 1 || rs[0].Attempt != 1 || rs[0].Line != 2 {
+		t.Fatal(rs)
+	}
+	o, err := b.Output(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o) != 2 || o[0].Str != "hello" || o[1].Str != "world" {
+		t.Fatal(o)
+	}
+	err = b.AppendOutput(db.OutputLine{T: db.Stdout, Str: "again", Time: time.Now().UTC().Round(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err = as[0].Output(2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o) != 1 || o[0].Str != "again" {
+		t.Fatal(o)
+	}
+}
+
+func TestVersionOfNewDB(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testPath)
+	defer d.Close()
+
+	v, err := d.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 7 {
+		t.Fatal(v)
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	if driver != "bolt" {
+		t.Skip("the version is written into a BoltDB file")
+	}
+	d, err := bolt.Open(testPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testPath)
+	err = d.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("version"), itob(99))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.DryRun(testPath); err == nil {
+		t.FailNow()
+	}
+	if _, err := db.Open(testPath); err == nil {
+		t.FailNow()
+	}
+}
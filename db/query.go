@@ -0,0 +1,164 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// Builds are indexed by creation time in timeIndexBucket, and by status
+// and creation time in statusIndexBucket/<status>. Keys of both indexes
+// are index keys, see indexKey, with empty values.
+var (
+	timeIndexBucket   = []byte("time_index")
+	statusIndexBucket = []byte("status_index")
+)
+
+// defaultQueryLimit is the page size of a BuildQuery without Limit
+const defaultQueryLimit = 50
+
+// indexKey returns the index key of build id created at t: the Unix
+// time of t in nanoseconds followed by id, both 8-byte big endian, so
+// that builds are sorted by creation time. Builds created before their
+// creation time was recorded come first.
+func indexKey(t time.Time, id uint64) []byte {
+	k := make([]byte, 16)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	}
+	binary.BigEndian.PutUint64(k[8:], id)
+	return k
+}
+
+// buildIndexKey returns the index key of build id
+func buildIndexKey(tx Tx, id uint64) []byte {
+	var build Build
+	if b := tx.Bucket(buildBucket); b != nil {
+		if v := b.Get(itob(id)); v != nil {
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+		}
+	}
+	return indexKey(build.Created, id)
+}
+
+func indexTime(tx Tx, key []byte) {
+	b, err := tx.CreateBucketIfNotExists(timeIndexBucket)
+	candy.Must(err)
+	candy.Must(b.Put(key, []byte{}))
+}
+
+// indexStatus moves the build of index key from status old to s
+func indexStatus(tx Tx, key []byte, old, s BuildStatus) {
+	b, err := tx.CreateBucketIfNotExists(statusIndexBucket)
+	candy.Must(err)
+	if old != "" {
+		if ob := b.Bucket([]byte(old)); ob != nil {
+			candy.Must(ob.Delete(key))
+		}
+	}
+	b, err = b.CreateBucketIfNotExists([]byte(s))
+	candy.Must(err)
+	candy.Must(b.Put(key, []byte{}))
+}
+
+// unindex removes the build of index key with status s from indexes
+func unindex(tx Tx, key []byte, s BuildStatus) {
+	if b := tx.Bucket(timeIndexBucket); b != nil {
+		candy.Must(b.Delete(key))
+	}
+	if b := tx.Bucket(statusIndexBucket); b != nil && s != "" {
+		if b = b.Bucket([]byte(s)); b != nil {
+			candy.Must(b.Delete(key))
+		}
+	}
+}
+
+// BuildQuery selects builds by status and creation time, zero fields
+// match all builds.
+type BuildQuery struct {
+	Status BuildStatus
+	Since  time.Time // builds created at or after Since
+	Until  time.Time // builds created before Until
+	Limit  int       // size of a page, defaultQueryLimit if not set
+	Cursor string    // returns the page after the one Cursor is Next of
+}
+
+// BuildPage is a page of builds matching a BuildQuery
+type BuildPage struct {
+	Builds []Build // the newest build comes first
+	Next   string  // cursor of the next page, empty if this is the last page
+}
+
+// QueryBuilds returns a page of builds matching q
+func (d *DB) QueryBuilds(q BuildQuery) (BuildPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+
+	// keys of the page are in [lower, upper)
+	var lower, upper []byte
+	if !q.Since.IsZero() {
+		lower = indexKey(q.Since, 0)
+	}
+	if !q.Until.IsZero() {
+		upper = indexKey(q.Until, 0)
+	}
+	if q.Cursor != "" {
+		c, err := hex.DecodeString(q.Cursor)
+		if err != nil || len(c) != 16 {
+			return BuildPage{}, fmt.Errorf("invalid cursor: %s", q.Cursor)
+		}
+		if upper == nil || bytes.Compare(c, upper) < 0 {
+			upper = c
+		}
+	}
+
+	var page BuildPage
+	var ids []uint64
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		b := tx.Bucket(timeIndexBucket)
+		if q.Status != "" {
+			b = tx.Bucket(statusIndexBucket)
+			if b != nil {
+				b = b.Bucket([]byte(q.Status))
+			}
+		}
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		var k, last []byte
+		if upper == nil {
+			k, _ = c.Last()
+		} else if k, _ = c.Seek(upper); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && bytes.Compare(k, lower) >= 0; k, _ = c.Prev() {
+			if len(ids) == limit {
+				page.Next = hex.EncodeToString(last)
+				break
+			}
+			ids = append(ids, binary.BigEndian.Uint64(k[8:]))
+			last = k
+		}
+		return nil
+	}))
+	if err != nil {
+		return BuildPage{}, err
+	}
+
+	page.Builds, err = d.idsToBuilds(ids)
+	if err != nil {
+		return BuildPage{}, err
+	}
+	return page, nil
+}
@@ -0,0 +1,119 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestQueryBuilds(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	var bs []db.Build
+	for _, s := range []db.BuildStatus{db.BuildSuccess, db.BuildFailed, db.BuildRunning} {
+		b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.SetStatus(db.BuildQueued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.SetStatus(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs = append(bs, b)
+		// builds are created at different times
+		time.Sleep(time.Millisecond)
+	}
+
+	ids := func(p db.BuildPage) []uint64 {
+		var ids []uint64
+		for _, b := range p.Builds {
+			ids = append(ids, b.ID)
+		}
+		return ids
+	}
+	equal := func(a, b []uint64) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	cases := []struct {
+		q    db.BuildQuery
+		want []uint64
+	}{
+		{db.BuildQuery{}, []uint64{3, 2, 1}},
+		{db.BuildQuery{Status: db.BuildFailed}, []uint64{2}},
+		{db.BuildQuery{Status: db.BuildQueued}, nil},
+		{db.BuildQuery{Since: bs[1].Created}, []uint64{3, 2}},
+		{db.BuildQuery{Until: bs[1].Created}, []uint64{1}},
+		{db.BuildQuery{Since: bs[1].Created, Until: bs[2].Created}, []uint64{2}},
+		{db.BuildQuery{Status: db.BuildSuccess, Since: bs[1].Created}, nil},
+	}
+	for _, c := range cases {
+		p, err := d.QueryBuilds(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(ids(p), c.want) || p.Next != "" {
+			t.Fatal(c.q, ids(p), p.Next)
+		}
+	}
+
+	p, err := d.QueryBuilds(db.BuildQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(ids(p), []uint64{3, 2}) || p.Next == "" {
+		t.Fatal(ids(p), p.Next)
+	}
+	p, err = d.QueryBuilds(db.BuildQuery{Limit: 2, Cursor: p.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(ids(p), []uint64{1}) || p.Next != "" {
+		t.Fatal(ids(p), p.Next)
+	}
+
+	_, err = d.QueryBuilds(db.BuildQuery{Cursor: "invalid"})
+	if err == nil {
+		t.Fatal("invalid cursor accepted")
+	}
+
+	err = d.DeleteBuild(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []db.BuildQuery{{}, {Status: db.BuildFailed}} {
+		p, err = d.QueryBuilds(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids(p) {
+			if id == 2 {
+				t.Fatal("deleted build is queried", q)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// buildBuckets hold records keyed by build id, the records are
+// removed together with the build.
+var buildBuckets = [][]byte{
+	buildBucket,
+	pendingBucket,
+	statusBucket,
+	outputBucket,
+	attemptBucket,
+	attemptStateBucket,
+	attemptOutputBucket,
+	artifactBucket,
+	approvalBucket,
+	searchWordsBucket,
+	statsBuildBucket,
+	testResultBucket,
+	coverageBucket,
+}
+
+// RetentionPolicy decides which finished builds are kept by Collect.
+// A build is kept if any rule keeps it, and the latest build of each
+// ref is always kept. Collect keeps everything if both rules are zero.
+type RetentionPolicy struct {
+	KeepLast int           // keep the last KeepLast builds of each ref
+	KeepFor  time.Duration // keep builds younger than KeepFor
+}
+
+// Collect deletes finished builds not kept by policy p, returns the
+// ids of deleted builds.
+func (d *DB) Collect(p RetentionPolicy, now time.Time) ([]uint64, error) {
+	if p.KeepLast <= 0 && p.KeepFor <= 0 {
+		return nil, nil
+	}
+
+	keepLast := p.KeepLast
+	if keepLast < 1 {
+		keepLast = 1
+	}
+
+	var candidates []uint64
+	err := d.view(func(tx Tx) error {
+		b := tx.Bucket(refBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(t, _ []byte) error {
+			types := b.Bucket(t)
+			return types.ForEach(func(ref, _ []byte) error {
+				c := types.Bucket(ref).Cursor()
+				i := 0
+				for k, v := c.Last(); k != nil; k, v = c.Prev() {
+					if i >= keepLast {
+						candidates = append(candidates, btoi(v))
+					}
+					i++
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []uint64
+	for _, id := range candidates {
+		b, err := d.Build(id)
+		if err != nil {
+			return deleted, err
+		}
+		if p.KeepFor > 0 {
+			created, err := b.created()
+			if err != nil {
+				return deleted, err
+			}
+			// the age of a build created before its time was recorded
+			// is unknown, it is kept rather than taken as ancient.
+			if created.IsZero() || now.Sub(created) < p.KeepFor {
+				continue
+			}
+		}
+		s, err := b.Status()
+		if err != nil || !isFinished(s) {
+			continue
+		}
+		err = d.DeleteBuild(id)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, nil
+}
+
+// created returns the creation time of build b, or the time its
+// latest attempt is created if it is not recorded.
+func (b *Build) created() (time.Time, error) {
+	if !b.Created.IsZero() {
+		return b.Created, nil
+	}
+	as, err := b.Attempts()
+	if err != nil || len(as) == 0 {
+		return time.Time{}, err
+	}
+	return as[len(as)-1].Created, nil
+}
+
+// DeleteBuild deletes a build with its status, outputs, attempts,
+// artifact records and index entries.
+func (d *DB) DeleteBuild(id uint64) error {
+	return d.update(makeSafeHandler(func(tx Tx) error {
+		var build Build
+		b := tx.Bucket(buildBucket)
+		if b != nil {
+			if v := b.Get(itob(id)); v != nil {
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+			}
+		}
+		var s BuildStatus
+		if b = tx.Bucket(statusBucket); b != nil {
+			s = BuildStatus(b.Get(itob(id)))
+		}
+		unindex(tx, indexKey(build.Created, id), s)
+		unindexOutput(tx, id)
+
+		for _, name := range buildBuckets {
+			b := tx.Bucket(name)
+			if b == nil {
+				continue
+			}
+			if b.Bucket(itob(id)) != nil {
+				candy.Must(b.DeleteBucket(itob(id)))
+			} else {
+				candy.Must(b.Delete(itob(id)))
+			}
+		}
+
+		if b = tx.Bucket(shaBucket); b != nil {
+			removeIndex(b, []byte(build.CommitSHA), id)
+		}
+		if b = tx.Bucket(refBucket); b != nil {
+			if b = b.Bucket(itob(uint64(build.T))); b != nil {
+				removeIndex(b, []byte(build.Ref), id)
+			}
+		}
+		return nil
+	}))
+}
+
+// removeIndex removes id from the index bucket name in b, the index
+// bucket is deleted once it is empty.
+func removeIndex(b Bucket, name []byte, id uint64) {
+	index := b.Bucket(name)
+	if index == nil {
+		return
+	}
+	var keys [][]byte
+	candy.Must(index.ForEach(func(k, v []byte) error {
+		if btoi(v) == id {
+			keys = append(keys, k)
+		}
+		return nil
+	}))
+	for _, k := range keys {
+		candy.Must(index.Delete(k))
+	}
+	if k, _ := index.Cursor().First(); k == nil {
+		candy.Must(b.DeleteBucket(name))
+	}
+}
+
+// Compact reclaims space freed by deleted builds, see Storage.
+// Writes are blocked while compacting.
+func (d *DB) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.s.Compact()
+}
+
+func copyBucket(dst, src Bucket) error {
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, src.Bucket(k))
+	})
+}
+
+// ArtifactSums returns checksums of all recorded artifacts
+func (d *DB) ArtifactSums() (map[string]bool, error) {
+	sums := make(map[string]bool)
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		b := tx.Bucket(artifactBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(id, _ []byte) error {
+			return b.Bucket(id).ForEach(func(_, v []byte) error {
+				var a Artifact
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&a))
+				sums[a.SHA256] = true
+				return nil
+			})
+		})
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
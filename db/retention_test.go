@@ -0,0 +1,126 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestCollect(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	var bs []db.Build
+	for _, sha := range []string{"sha0", "sha1", "sha2", "sha3"} {
+		b, err := d.CreateBuild(db.Push, "url", "ref", sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.SetStatus(db.BuildSuccess)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.AppendOutput(db.OutputLine{T: db.Stdout, Str: sha})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs = append(bs, b)
+	}
+	// unfinished builds are never collected
+	err = bs[0].SetStatus(db.BuildRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.CreateBuild(db.Push, "url", "other", "sha0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SetStatus(db.BuildFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// everything is young
+	deleted, err := d.Collect(db.RetentionPolicy{KeepLast: 1, KeepFor: time.Hour}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Fatal(deleted)
+	}
+
+	// keep nothing, but the latest of each ref and unfinished builds
+	deleted, err = d.Collect(db.RetentionPolicy{KeepFor: time.Hour}, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0] != bs[2].ID || deleted[1] != bs[1].ID {
+		t.Fatal(deleted)
+	}
+
+	_, err = d.Build(bs[1].ID)
+	if err == nil {
+		t.FailNow()
+	}
+	l, err := bs[1].Output(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 0 {
+		t.Fatal(l)
+	}
+
+	refBuilds, err := d.RefBuilds(db.Push, "ref", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refBuilds) != 2 || refBuilds[0] != bs[3] || refBuilds[1] != bs[0] {
+		t.Fatal(refBuilds)
+	}
+	shaBuilds, err := d.SHABuilds("sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shaBuilds) != 0 {
+		t.Fatal(shaBuilds)
+	}
+	shaBuilds, err = d.SHABuilds("sha0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shaBuilds) != 2 {
+		t.Fatal(shaBuilds)
+	}
+
+	err = d.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// builds obtained before compaction are still usable
+	l, err = bs[3].Output(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].Str != "sha3" {
+		t.Fatal(l)
+	}
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != other.ID+1 {
+		t.Fatal(b.ID)
+	}
+}
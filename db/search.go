@@ -0,0 +1,276 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/topicai/candy"
+)
+
+// Output is indexed by words for searching. searchIndexBucket/<word>
+// holds the posting keys, see postingKey, of lines containing the word.
+// searchWordsBucket/<build id> holds words of the output of a build,
+// so that postings of a deleted build can be found.
+var (
+	searchIndexBucket = []byte("search_index")
+	searchWordsBucket = []byte("search_words")
+)
+
+const (
+	// words shorter than minWordLen are not indexed
+	minWordLen = 2
+	// words longer than maxWordLen are indexed by their prefix
+	maxWordLen = 64
+	// defaultSearchLimit is the number of results of a search without limit
+	defaultSearchLimit = 100
+)
+
+// SearchResult is an output line matching a search
+type SearchResult struct {
+	BuildID uint64
+	Attempt uint64 // 0 if the build is never attempted
+	Line    uint64 // line number in the output, starts from 1
+	Str     string
+}
+
+// words returns distinct lowercase words of s, a word is a sequence of
+// letters and digits.
+func words(s string) []string {
+	seen := make(map[string]bool)
+	var ws []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) < minWordLen {
+			continue
+		}
+		if len(w) > maxWordLen {
+			// cut on a rune boundary
+			i := maxWordLen
+			for !utf8.RuneStart(w[i]) {
+				i--
+			}
+			w = w[:i]
+		}
+		if !seen[w] {
+			seen[w] = true
+			ws = append(ws, w)
+		}
+	}
+	return ws
+}
+
+// postingKey returns the key of a line in the search index, which
+// sorts lines by build.
+func postingKey(build, attempt, line uint64) []byte {
+	k := make([]byte, 24)
+	binary.BigEndian.PutUint64(k, build)
+	binary.BigEndian.PutUint64(k[8:], attempt)
+	binary.BigEndian.PutUint64(k[16:], line)
+	return k
+}
+
+// outputOf returns the build and the attempt of the output bucket
+// given by path, see Build.outputPath.
+func outputOf(path [][]byte) (build, attempt uint64) {
+	build = btoi(path[1])
+	if bytes.Equal(path[0], attemptOutputBucket) {
+		attempt = btoi(path[2])
+	}
+	return build, attempt
+}
+
+// indexOutput adds line s of the output bucket given by path to the
+// search index.
+func indexOutput(tx Tx, path [][]byte, line uint64, s string) {
+	indexLines(tx, path, line, []OutputLine{{Str: s}})
+}
+
+// indexLines adds lines of the output bucket given by path, starting
+// from line number first, to the search index. Postings are grouped by
+// word, so the bucket of each word is written once.
+func indexLines(tx Tx, path [][]byte, first uint64, lines []OutputLine) {
+	postings := make(map[string][][]byte)
+	var ws []string
+	build, attempt := outputOf(path)
+	for i, l := range lines {
+		for _, w := range words(l.Str) {
+			if postings[w] == nil {
+				ws = append(ws, w)
+			}
+			postings[w] = append(postings[w], postingKey(build, attempt, first+uint64(i)))
+		}
+	}
+	if len(ws) == 0 {
+		return
+	}
+
+	index, err := tx.CreateBucketIfNotExists(searchIndexBucket)
+	candy.Must(err)
+	buildWords, err := tx.CreateBucketIfNotExists(searchWordsBucket)
+	candy.Must(err)
+	buildWords, err = buildWords.CreateBucketIfNotExists(itob(build))
+	candy.Must(err)
+	for _, w := range ws {
+		b, err := index.CreateBucketIfNotExists([]byte(w))
+		candy.Must(err)
+		for _, key := range postings[w] {
+			candy.Must(b.Put(key, []byte{}))
+		}
+		candy.Must(buildWords.Put([]byte(w), []byte{}))
+	}
+}
+
+// unindexOutput removes output of build id from the search index
+func unindexOutput(tx Tx, id uint64) {
+	buildWords := tx.Bucket(searchWordsBucket)
+	if buildWords == nil {
+		return
+	}
+	if buildWords = buildWords.Bucket(itob(id)); buildWords == nil {
+		return
+	}
+	index := tx.Bucket(searchIndexBucket)
+	if index == nil {
+		return
+	}
+	prefix := itob(id)
+	candy.Must(buildWords.ForEach(func(w, _ []byte) error {
+		b := index.Bucket(w)
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			candy.Must(b.Delete(k))
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			candy.Must(index.DeleteBucket(w))
+		}
+		return nil
+	}))
+}
+
+// SearchOutput returns output lines containing query, case-insensitive.
+// Lines of newer builds come first, at most limit lines are returned,
+// defaultSearchLimit if limit is not positive. Lines are indexed when
+// they are sealed, so up to chunkLines-1 latest lines of a running
+// build are not found until it finishes.
+func (d *DB) SearchOutput(query string, limit int) ([]SearchResult, error) {
+	ws := words(query)
+	if len(ws) == 0 {
+		return nil, errors.New("search query has no word")
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	phrase := strings.ToLower(strings.TrimSpace(query))
+
+	var rs []SearchResult
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		index := tx.Bucket(searchIndexBucket)
+		if index == nil {
+			return nil
+		}
+		// lines containing every word are candidates, postings of the
+		// longest word are probably the fewest.
+		var postings []Bucket
+		for _, w := range ws {
+			b := index.Bucket([]byte(w))
+			if b == nil {
+				return nil
+			}
+			postings = append(postings, b)
+		}
+		longest := 0
+		for i, w := range ws {
+			if len(w) > len(ws[longest]) {
+				longest = i
+			}
+		}
+
+		var lines outputReader
+		c := postings[longest].Cursor()
+	candidates:
+		for k, _ := c.Last(); k != nil && len(rs) < limit; k, _ = c.Prev() {
+			for _, b := range postings {
+				if b.Get(k) == nil {
+					continue candidates
+				}
+			}
+			r := SearchResult{
+				BuildID: binary.BigEndian.Uint64(k),
+				Attempt: binary.BigEndian.Uint64(k[8:]),
+				Line:    binary.BigEndian.Uint64(k[16:]),
+			}
+			o, ok := lines.line(tx, r)
+			if !ok || !strings.Contains(strings.ToLower(o.Str), phrase) {
+				continue
+			}
+			r.Str = o.Str
+			rs = append(rs, r)
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// outputReader reads output lines of search results. Results in the
+// same output come in a row, so the chunk of the last line read is
+// kept, and each chunk is decompressed once.
+type outputReader struct {
+	build, attempt uint64
+	first          uint64 // line number of the first line of lines
+	lines          []OutputLine
+}
+
+// line returns the output line of search result r
+func (o *outputReader) line(tx Tx, r SearchResult) (OutputLine, bool) {
+	if r.BuildID == o.build && r.Attempt == o.attempt && r.Line >= o.first && r.Line-o.first < uint64(len(o.lines)) {
+		return o.lines[r.Line-o.first], true
+	}
+
+	var b Bucket
+	if r.Attempt == 0 {
+		if b = tx.Bucket(outputBucket); b != nil {
+			b = b.Bucket(itob(r.BuildID))
+		}
+	} else if b = tx.Bucket(attemptOutputBucket); b != nil {
+		if b = b.Bucket(itob(r.BuildID)); b != nil {
+			b = b.Bucket(itob(r.Attempt))
+		}
+	}
+	if b == nil {
+		return OutputLine{}, false
+	}
+	if v := b.Get(itob(r.Line)); v != nil {
+		var l OutputLine
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&l))
+		return l, true
+	}
+	chunks := b.Bucket(chunksBucket)
+	if chunks == nil {
+		return OutputLine{}, false
+	}
+	k, v := seekChunk(chunks.Cursor(), r.Line)
+	if k == nil {
+		return OutputLine{}, false
+	}
+	o.build, o.attempt, o.first, o.lines = r.BuildID, r.Attempt, btoi(k), decodeChunk(v)
+	if r.Line < o.first || r.Line-o.first >= uint64(len(o.lines)) {
+		return OutputLine{}, false
+	}
+	return o.lines[r.Line-o.first], true
+}
@@ -0,0 +1,112 @@
+package db_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestSearchOutput(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	// a long word is indexed by its prefix cut on a rune boundary
+	long := "x" + strings.Repeat("é", 40)
+	outputs := [][]string{
+		{"go test ./...", "--- FAIL: TestFoo (0.01s)", "connection refused by 10.0.0.1"},
+		{"go test ./...", "ok", "token is s3cr3t-value", long},
+	}
+	for _, lines := range outputs {
+		b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := b.NewAttempt("worker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Mask("s3cr3t-value")
+		for _, l := range lines {
+			err = a.AppendOutput(db.OutputLine{T: db.Stdout, Str: l})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// output is indexed once sealed
+		err = a.SetStatus(db.BuildSuccess)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		query string
+		want  []db.SearchResult
+	}{
+		{"go test", []db.SearchResult{{2, 1, 1, "go test ./..."}, {1, 1, 1, "go test ./..."}}},
+		{"CONNECTION refused", []db.SearchResult{{1, 1, 3, "connection refused by 10.0.0.1"}}},
+		{"FAIL: TestFoo", []db.SearchResult{{1, 1, 2, "--- FAIL: TestFoo (0.01s)"}}},
+		// words of a phrase are in the line, but not the phrase
+		{"refused connection", nil},
+		{"s3cr3t", nil},
+		{strings.ToUpper(long), []db.SearchResult{{2, 1, 4, long}}},
+		{"missing", nil},
+	}
+	for _, c := range cases {
+		rs, err := d.SearchOutput(c.query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != len(c.want) {
+			t.Fatal(c.query, rs)
+		}
+		for i := range rs {
+			if rs[i] != c.want[i] {
+				t.Fatal(c.query, rs)
+			}
+		}
+	}
+
+	rs, err := d.SearchOutput("go test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].BuildID != 2 {
+		t.Fatal(rs)
+	}
+
+	_, err = d.SearchOutput("./", 0)
+	if err == nil {
+		t.Fatal("query without words accepted")
+	}
+
+	err = d.DeleteBuild(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err = d.SearchOutput("go test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].BuildID != 2 {
+		t.Fatal(rs)
+	}
+	rs, err = d.SearchOutput("connection", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 0 {
+		t.Fatal(rs)
+	}
+}
@@ -0,0 +1,514 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlStorage stores the database in two tables of a SQL database,
+// ci_bucket holds buckets and their sequences, ci_kv holds key/value
+// pairs of buckets. A bucket is identified by its path, the hex
+// encoded names of the bucket and its parents joined by "/", and
+// appears in its parent as a key with nested set. The root bucket,
+// whose path is "", holds the top level buckets.
+type sqlStorage struct {
+	db       *sql.DB
+	postgres bool
+}
+
+var (
+	errBucketExists      = errors.New("bucket already exists")
+	errBucketNotFound    = errors.New("bucket not found")
+	errIncompatibleValue = errors.New("incompatible value")
+)
+
+// OpenSQL opens a database stored in a SQL database given the name of
+// a registered database/sql driver and the data source. SQLite drivers
+// ("sqlite", "sqlite3") and PostgreSQL drivers ("postgres", "pgx") are
+// supported. The database is migrated to the latest schema version.
+func OpenSQL(driver, dataSource string) (*DB, error) {
+	s, err := openSQL(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	return OpenStorage(s)
+}
+
+func openSQL(driver, dataSource string) (*sqlStorage, error) {
+	s := &sqlStorage{}
+	switch driver {
+	case "sqlite", "sqlite3":
+	case "postgres", "pgx":
+		s.postgres = true
+	default:
+		return nil, fmt.Errorf("unsupported SQL driver: %s", driver)
+	}
+
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if !s.postgres {
+		// SQLite allows one writer, transactions are serialized
+		// rather than failing with "database is locked".
+		db.SetMaxOpenConns(1)
+	}
+	s.db = db
+
+	blob := "BLOB"
+	if s.postgres {
+		blob = "BYTEA"
+	}
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS ci_bucket (path TEXT PRIMARY KEY, seq BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS ci_kv (bucket TEXT NOT NULL, k ` + blob + ` NOT NULL, v ` + blob + `, nested INTEGER NOT NULL, PRIMARY KEY (bucket, k))`,
+	} {
+		_, err = db.Exec(q)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *sqlStorage) View(fn func(Tx) error) error {
+	return s.run(fn, false)
+}
+
+func (s *sqlStorage) Update(fn func(Tx) error) error {
+	return s.run(fn, true)
+}
+
+// sqlRetries is how many times a PostgreSQL transaction failing with
+// a serialization failure or a deadlock is retried.
+const sqlRetries = 10
+
+// run runs fn in a transaction. SQLite serializes transactions on its
+// single connection. On PostgreSQL, read-only transactions read a
+// consistent snapshot and read-write transactions are serializable, a
+// transaction conflicting with a concurrent one fails instead of
+// interleaving with it, and is run again up to sqlRetries times. fn
+// may be called more than once, so it must not keep state across
+// calls.
+func (s *sqlStorage) run(fn func(Tx) error, commit bool) error {
+	for i := 0; ; i++ {
+		err := s.runOnce(fn, commit)
+		if !s.postgres || i == sqlRetries || !retryable(err) {
+			return err
+		}
+		// back off randomly so that conflicting writers do not
+		// conflict again
+		time.Sleep(time.Duration(rand.Int63n(int64(time.Millisecond) << uint(i/2+1))))
+	}
+}
+
+// retryable returns whether err is a PostgreSQL serialization failure
+// or deadlock, the transaction succeeds if run again.
+func retryable(err error) bool {
+	var e interface{ SQLState() string }
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.SQLState() == "40001" || e.SQLState() == "40P01"
+}
+
+func (s *sqlStorage) runOnce(fn func(Tx) error, commit bool) (err error) {
+	var opts *sql.TxOptions
+	if s.postgres {
+		opts = &sql.TxOptions{Isolation: sql.LevelSerializable}
+		if !commit {
+			opts = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+		}
+	}
+	tx, err := s.db.BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case error:
+				err = e
+			default:
+				err = fmt.Errorf("recovered panic: %v", e)
+			}
+		}
+		if err != nil || !commit {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	return fn(&sqlTx{s: s, tx: tx})
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+// Compact vacuums the database. SQLite returns space freed by deleted
+// rows to the file system. PostgreSQL only makes the space reusable by
+// new rows of the tables, VACUUM FULL would return it but locks the
+// tables while rewriting them.
+func (s *sqlStorage) Compact() error {
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+type sqlTx struct {
+	s  *sqlStorage
+	tx *sql.Tx
+}
+
+// query rebinds "?" placeholders for PostgreSQL
+func (t *sqlTx) query(q string) string {
+	if !t.s.postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (t *sqlTx) exec(q string, args ...interface{}) {
+	_, err := t.tx.Exec(t.query(q), args...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// scan queries a row, returns false if no row is found
+func (t *sqlTx) scan(q string, args []interface{}, dest ...interface{}) bool {
+	err := t.tx.QueryRow(t.query(q), args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (t *sqlTx) Bucket(name []byte) Bucket {
+	return t.root().Bucket(name)
+}
+
+func (t *sqlTx) CreateBucket(name []byte) (Bucket, error) {
+	return t.root().CreateBucket(name)
+}
+
+func (t *sqlTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.root().CreateBucketIfNotExists(name)
+}
+
+func (t *sqlTx) DeleteBucket(name []byte) error {
+	return t.root().DeleteBucket(name)
+}
+
+func (t *sqlTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	root := t.root()
+	return root.ForEach(func(k, _ []byte) error {
+		return fn(k, root.Bucket(k))
+	})
+}
+
+// root returns the bucket holding top level buckets
+func (t *sqlTx) root() *sqlBucket {
+	return &sqlBucket{tx: t}
+}
+
+type sqlBucket struct {
+	tx   *sqlTx
+	path string
+}
+
+func (b *sqlBucket) child(name []byte) string {
+	if b.path == "" {
+		return hex.EncodeToString(name)
+	}
+	return b.path + "/" + hex.EncodeToString(name)
+}
+
+func (b *sqlBucket) Bucket(name []byte) Bucket {
+	path := b.child(name)
+	var one int
+	if !b.tx.scan(`SELECT 1 FROM ci_bucket WHERE path = ?`, []interface{}{path}, &one) {
+		return nil
+	}
+	return &sqlBucket{tx: b.tx, path: path}
+}
+
+func (b *sqlBucket) CreateBucket(name []byte) (Bucket, error) {
+	if len(name) == 0 {
+		return nil, errors.New("bucket name required")
+	}
+	if b.Bucket(name) != nil {
+		return nil, errBucketExists
+	}
+	if b.Get(name) != nil {
+		return nil, errIncompatibleValue
+	}
+	path := b.child(name)
+	b.tx.exec(`INSERT INTO ci_bucket (path, seq) VALUES (?, 0)`, path)
+	b.tx.exec(`INSERT INTO ci_kv (bucket, k, v, nested) VALUES (?, ?, NULL, 1)`, b.path, name)
+	return &sqlBucket{tx: b.tx, path: path}, nil
+}
+
+// CreateBucketIfNotExists inserts the bucket unless it exists rather
+// than checking first, so that ci servers sharing the database do not
+// race to create it.
+func (b *sqlBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if len(name) == 0 {
+		return nil, errors.New("bucket name required")
+	}
+	b.tx.exec(`INSERT INTO ci_kv (bucket, k, v, nested) VALUES (?, ?, NULL, 1) ON CONFLICT (bucket, k) DO NOTHING`, b.path, name)
+	var nested int
+	b.tx.scan(`SELECT nested FROM ci_kv WHERE bucket = ? AND k = ?`, []interface{}{b.path, name}, &nested)
+	if nested == 0 {
+		return nil, errIncompatibleValue
+	}
+	path := b.child(name)
+	b.tx.exec(`INSERT INTO ci_bucket (path, seq) VALUES (?, 0) ON CONFLICT (path) DO NOTHING`, path)
+	return &sqlBucket{tx: b.tx, path: path}, nil
+}
+
+func (b *sqlBucket) DeleteBucket(name []byte) error {
+	if b.Bucket(name) == nil {
+		return errBucketNotFound
+	}
+	path := b.child(name)
+	// hex encoded names contain no LIKE wildcards
+	b.tx.exec(`DELETE FROM ci_bucket WHERE path = ? OR path LIKE ?`, path, path+"/%")
+	b.tx.exec(`DELETE FROM ci_kv WHERE bucket = ? OR bucket LIKE ?`, path, path+"/%")
+	b.tx.exec(`DELETE FROM ci_kv WHERE bucket = ? AND k = ?`, b.path, name)
+	return nil
+}
+
+func (b *sqlBucket) Get(k []byte) []byte {
+	var v []byte
+	var nested int
+	if !b.tx.scan(`SELECT v, nested FROM ci_kv WHERE bucket = ? AND k = ?`, []interface{}{b.path, k}, &v, &nested) {
+		return nil
+	}
+	if nested != 0 {
+		return nil
+	}
+	if v == nil {
+		return []byte{}
+	}
+	return v
+}
+
+func (b *sqlBucket) Put(k, v []byte) error {
+	if len(k) == 0 {
+		return errors.New("key required")
+	}
+	if b.Bucket(k) != nil {
+		return errIncompatibleValue
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	b.tx.exec(`INSERT INTO ci_kv (bucket, k, v, nested) VALUES (?, ?, ?, 0) ON CONFLICT (bucket, k) DO UPDATE SET v = excluded.v`, b.path, k, v)
+	return nil
+}
+
+func (b *sqlBucket) Delete(k []byte) error {
+	if b.Bucket(k) != nil {
+		return errIncompatibleValue
+	}
+	b.tx.exec(`DELETE FROM ci_kv WHERE bucket = ? AND k = ?`, b.path, k)
+	return nil
+}
+
+// ForEach reads all pairs before calling fn, since a connection can
+// not run queries while reading rows.
+func (b *sqlBucket) ForEach(fn func(k, v []byte) error) error {
+	rows, err := b.tx.tx.Query(b.tx.query(`SELECT k, v, nested FROM ci_kv WHERE bucket = ? ORDER BY k`), b.path)
+	if err != nil {
+		return err
+	}
+	var keys, values [][]byte
+	for rows.Next() {
+		var k, v []byte
+		var nested int
+		err = rows.Scan(&k, &v, &nested)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if nested == 0 && v == nil {
+			v = []byte{}
+		}
+		if nested != 0 {
+			v = nil
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	err = rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		err = fn(keys[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sqlBucket) Cursor() Cursor {
+	return &sqlCursor{b: b}
+}
+
+func (b *sqlBucket) NextSequence() (uint64, error) {
+	b.tx.exec(`UPDATE ci_bucket SET seq = seq + 1 WHERE path = ?`, b.path)
+	return b.Sequence(), nil
+}
+
+func (b *sqlBucket) Sequence() uint64 {
+	var seq int64
+	b.tx.scan(`SELECT seq FROM ci_bucket WHERE path = ?`, []interface{}{b.path}, &seq)
+	return uint64(seq)
+}
+
+func (b *sqlBucket) SetSequence(v uint64) error {
+	b.tx.exec(`UPDATE ci_bucket SET seq = ? WHERE path = ?`, int64(v), b.path)
+	return nil
+}
+
+// Cursors read rows ahead in the direction they move, starting with
+// minCursorBatch rows and doubling up to maxCursorBatch, so that a
+// lookup reads one row and a scan takes few queries.
+const (
+	minCursorBatch = 8
+	maxCursorBatch = 256
+)
+
+type sqlRow struct {
+	k, v []byte
+}
+
+type sqlCursor struct {
+	b     *sqlBucket
+	key   []byte
+	ahead []sqlRow // rows after key in direction desc
+	desc  bool
+	batch int
+}
+
+// fetch queries at most limit rows of the bucket matching cond in key
+// order, descending if desc.
+func (c *sqlCursor) fetch(cond string, desc bool, limit int, args ...interface{}) []sqlRow {
+	order := "ASC"
+	if desc {
+		order = "DESC"
+	}
+	q := `SELECT k, v, nested FROM ci_kv WHERE bucket = ?` + cond + ` ORDER BY k ` + order + ` LIMIT ` + strconv.Itoa(limit)
+	rows, err := c.b.tx.tx.Query(c.b.tx.query(q), append([]interface{}{c.b.path}, args...)...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	var rs []sqlRow
+	for rows.Next() {
+		var r sqlRow
+		var nested int
+		err = rows.Scan(&r.k, &r.v, &nested)
+		if err != nil {
+			panic(err)
+		}
+		if nested != 0 {
+			r.v = nil
+		} else if r.v == nil {
+			r.v = []byte{}
+		}
+		rs = append(rs, r)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// position moves the cursor to the first row matching cond
+func (c *sqlCursor) position(cond string, desc bool, args ...interface{}) (k, v []byte) {
+	c.desc, c.batch = desc, 1
+	c.ahead = c.fetch(cond, desc, 1, args...)
+	return c.pop()
+}
+
+// step moves the cursor to the next row in direction desc
+func (c *sqlCursor) step(desc bool) (k, v []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	if desc == c.desc && len(c.ahead) > 0 {
+		return c.pop()
+	}
+	if desc != c.desc || c.batch < minCursorBatch {
+		c.batch = minCursorBatch
+	} else if c.batch < maxCursorBatch {
+		c.batch *= 2
+	}
+	c.desc = desc
+	cond := " AND k > ?"
+	if desc {
+		cond = " AND k < ?"
+	}
+	c.ahead = c.fetch(cond, desc, c.batch, c.key)
+	return c.pop()
+}
+
+func (c *sqlCursor) pop() (k, v []byte) {
+	if len(c.ahead) == 0 {
+		c.key = nil
+		return nil, nil
+	}
+	r := c.ahead[0]
+	c.ahead = c.ahead[1:]
+	c.key = r.k
+	return r.k, r.v
+}
+
+func (c *sqlCursor) First() (k, v []byte) {
+	return c.position("", false)
+}
+
+func (c *sqlCursor) Last() (k, v []byte) {
+	return c.position("", true)
+}
+
+func (c *sqlCursor) Next() (k, v []byte) {
+	return c.step(false)
+}
+
+func (c *sqlCursor) Prev() (k, v []byte) {
+	return c.step(true)
+}
+
+func (c *sqlCursor) Seek(seek []byte) (k, v []byte) {
+	return c.position(" AND k >= ?", false, seek)
+}
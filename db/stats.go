@@ -0,0 +1,278 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+// Statistics of finished builds are aggregated by series and day in
+// statsBucket/<series>/<day>. The contribution of each build is kept in
+// statsBuildBucket/<build id>, so that it is replaced when the build
+// finishes again, e.g., it is retried. Aggregates outlive builds deleted
+// by the retention policy.
+var (
+	statsBucket      = []byte("stats")
+	statsBuildBucket = []byte("stats_build")
+)
+
+// Series of statistics, push builds are aggregated by ref and
+// scheduled builds by schedule, like "schedule nightly"
+const (
+	// AllSeries is the series of all builds
+	AllSeries = "all"
+	// PullRequestSeries is the series of pull request builds
+	PullRequestSeries = "pull requests"
+	// ReleaseSeries is the series of release builds
+	ReleaseSeries = "releases"
+)
+
+const dayLayout = "2006-01-02"
+
+// statsDay is the aggregate of builds finished on a day in a series
+type statsDay struct {
+	Success, Failed, Error int
+	Durations              []time.Duration // run time of the latest attempts
+	Waits                  []time.Duration // time from creation to the start of the first attempt
+}
+
+// statsBuild is the contribution of a build to statistics
+type statsBuild struct {
+	Series   string
+	Day      string
+	Status   BuildStatus
+	Duration time.Duration // zero if unknown
+	Wait     time.Duration // zero if unknown
+}
+
+// StatsSummary summarizes finished builds
+type StatsSummary struct {
+	Builds         int
+	Success        int
+	Failed         int
+	Error          int
+	PassRate       float64 // Success / Builds, 0 if there is no build
+	MedianDuration time.Duration
+	P95Duration    time.Duration
+	MedianWait     time.Duration // time builds wait in the queue
+	P95Wait        time.Duration
+}
+
+// DayStats summarizes builds finished on a day
+type DayStats struct {
+	Day time.Time // midnight in UTC
+	StatsSummary
+}
+
+// SeriesStats summarizes builds of a series, a ref of push builds, a
+// schedule, PullRequestSeries or ReleaseSeries.
+type SeriesStats struct {
+	Series string
+	StatsSummary
+	Days []DayStats // days with finished builds, the earliest first
+}
+
+func seriesOf(b Build) string {
+	switch b.T {
+	case PullRequest:
+		return PullRequestSeries
+	case Scheduled:
+		return "schedule " + b.Schedule
+	case Release:
+		return ReleaseSeries
+	}
+	return b.Ref
+}
+
+func (s *statsDay) add(b statsBuild, n int) {
+	switch b.Status {
+	case BuildSuccess:
+		s.Success += n
+	case BuildFailed:
+		s.Failed += n
+	default:
+		s.Error += n
+	}
+	if n > 0 {
+		if b.Duration > 0 {
+			s.Durations = append(s.Durations, b.Duration)
+		}
+		if b.Wait > 0 {
+			s.Waits = append(s.Waits, b.Wait)
+		}
+		return
+	}
+	s.Durations = removeDuration(s.Durations, b.Duration)
+	s.Waits = removeDuration(s.Waits, b.Wait)
+}
+
+// removeDuration removes one d from ds
+func removeDuration(ds []time.Duration, d time.Duration) []time.Duration {
+	for i := range ds {
+		if ds[i] == d {
+			return append(ds[:i], ds[i+1:]...)
+		}
+	}
+	return ds
+}
+
+// addStats adds b to the aggregate of its day, n is 1 or -1
+func addStats(tx Tx, b statsBuild, n int) {
+	bucket, err := tx.CreateBucketIfNotExists(statsBucket)
+	candy.Must(err)
+	bucket, err = bucket.CreateBucketIfNotExists([]byte(b.Series))
+	candy.Must(err)
+	var day statsDay
+	if v := bucket.Get([]byte(b.Day)); v != nil {
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&day))
+	}
+	day.add(b, n)
+	candy.Must(putGob(bucket, []byte(b.Day), day))
+}
+
+// recordStats records build id finished with status s. The build
+// finished when its latest attempt finished, or at now if it has never
+// been attempted, it is not recorded if both are unknown.
+func recordStats(tx Tx, id uint64, s BuildStatus, now time.Time) {
+	var build Build
+	if b := tx.Bucket(buildBucket); b != nil {
+		if v := b.Get(itob(id)); v != nil {
+			candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&build))
+		}
+	}
+	rec := statsBuild{Series: seriesOf(build), Status: s}
+	finished := now
+
+	if states := tx.Bucket(attemptStateBucket); states != nil {
+		if states = states.Bucket(itob(id)); states != nil {
+			var first, last AttemptState
+			if _, v := states.Cursor().First(); v != nil {
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&first))
+			}
+			if _, v := states.Cursor().Last(); v != nil {
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&last))
+			}
+			if !last.Finished.IsZero() {
+				finished = last.Finished
+				if !last.Started.IsZero() {
+					rec.Duration = last.Finished.Sub(last.Started)
+				}
+			}
+			if !first.Started.IsZero() && !build.Created.IsZero() {
+				rec.Wait = first.Started.Sub(build.Created)
+			}
+		}
+	}
+	if finished.IsZero() {
+		return
+	}
+	rec.Day = finished.UTC().Format(dayLayout)
+
+	bucket, err := tx.CreateBucketIfNotExists(statsBuildBucket)
+	candy.Must(err)
+	if v := bucket.Get(itob(id)); v != nil {
+		var old statsBuild
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&old))
+		addStats(tx, old, -1)
+	}
+	addStats(tx, rec, 1)
+	candy.Must(putGob(bucket, itob(id), rec))
+}
+
+// percentile returns the p-th percentile of sorted ds
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	i := int(float64(len(ds))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(ds) {
+		i = len(ds) - 1
+	}
+	return ds[i]
+}
+
+func summarize(days ...statsDay) StatsSummary {
+	var s StatsSummary
+	var durations, waits []time.Duration
+	for _, d := range days {
+		s.Success += d.Success
+		s.Failed += d.Failed
+		s.Error += d.Error
+		durations = append(durations, d.Durations...)
+		waits = append(waits, d.Waits...)
+	}
+	s.Builds = s.Success + s.Failed + s.Error
+	if s.Builds > 0 {
+		s.PassRate = float64(s.Success) / float64(s.Builds)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	s.MedianDuration = percentile(durations, 50)
+	s.P95Duration = percentile(durations, 95)
+	s.MedianWait = percentile(waits, 50)
+	s.P95Wait = percentile(waits, 95)
+	return s
+}
+
+// Stats returns statistics of builds finished in days [since, until),
+// AllSeries comes first followed by other series sorted by name. Days
+// are in UTC.
+func (d *DB) Stats(since, until time.Time) ([]SeriesStats, error) {
+	from := since.UTC().Format(dayLayout)
+	to := until.UTC().Format(dayLayout)
+
+	all := make(map[string][]statsDay)
+	var ss []SeriesStats
+	err := d.view(makeSafeHandler(func(tx Tx) error {
+		b := tx.Bucket(statsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(series, _ []byte) error {
+			days := make(map[string][]statsDay)
+			c := b.Bucket(series).Cursor()
+			for k, v := c.Seek([]byte(from)); k != nil && string(k) < to; k, v = c.Next() {
+				var day statsDay
+				candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&day))
+				days[string(k)] = append(days[string(k)], day)
+				all[string(k)] = append(all[string(k)], day)
+			}
+			if len(days) > 0 {
+				ss = append(ss, seriesStats(string(series), days))
+			}
+			return nil
+		})
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	return append([]SeriesStats{seriesStats(AllSeries, all)}, ss...), nil
+}
+
+// seriesStats summarizes a series given aggregates by day
+func seriesStats(series string, days map[string][]statsDay) SeriesStats {
+	s := SeriesStats{Series: series}
+	var keys []string
+	for k := range days {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var all []statsDay
+	for _, k := range keys {
+		t, err := time.Parse(dayLayout, k)
+		candy.Must(err)
+		s.Days = append(s.Days, DayStats{Day: t, StatsSummary: summarize(days[k]...)})
+		all = append(all, days[k]...)
+	}
+	s.StatsSummary = summarize(all...)
+	return s
+}
@@ -0,0 +1,113 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestStats(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	run := func(b db.Build, s db.BuildStatus) {
+		a, err := b.NewAttempt("worker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.SetStatus(db.BuildRunning)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		err = a.SetStatus(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range []db.BuildStatus{db.BuildSuccess, db.BuildSuccess, db.BuildFailed} {
+		b, err := d.CreateBuild(db.Push, "url", "refs/heads/master", "sha")
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(b, s)
+	}
+	b, err := d.CreatePullRequestBuild("url", "feature", "sha", db.PullRequestInfo{Number: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(b, db.BuildFailed)
+	// the retry replaces the failure
+	run(b, db.BuildSuccess)
+	// unfinished builds are not counted
+	_, err = d.CreateBuild(db.Push, "url", "refs/heads/master", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	check := func() {
+		ss, err := d.Stats(now.Add(-24*time.Hour), now.Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ss) != 3 {
+			t.Fatal(ss)
+		}
+		want := []struct {
+			series                  string
+			builds, success, failed int
+		}{
+			{db.AllSeries, 4, 3, 1},
+			{db.PullRequestSeries, 1, 1, 0},
+			{"refs/heads/master", 3, 2, 1},
+		}
+		for i, w := range want {
+			s := ss[i]
+			if s.Series != w.series || s.Builds != w.builds || s.Success != w.success || s.Failed != w.failed {
+				t.Fatal(i, s)
+			}
+			if s.PassRate != float64(w.success)/float64(w.builds) {
+				t.Fatal(s.PassRate)
+			}
+			if s.MedianDuration <= 0 || s.P95Duration < s.MedianDuration || s.MedianWait <= 0 {
+				t.Fatal(s.StatsSummary)
+			}
+			n := 0
+			for _, day := range s.Days {
+				n += day.Builds
+			}
+			if n != w.builds {
+				t.Fatal(s.Days)
+			}
+		}
+	}
+	check()
+
+	// statistics outlive deleted builds
+	err = d.DeleteBuild(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	ss, err := d.Stats(now.Add(24*time.Hour), now.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 0 {
+		t.Fatal(ss)
+	}
+}
@@ -0,0 +1,67 @@
+package db
+
+// Storage is the storage of the database. It is a transactional
+// key/value store of nested buckets, keys of a bucket are sorted in
+// byte order. BoltDB and SQL databases are supported, see Open and
+// OpenSQL, other storages are opened by OpenStorage.
+type Storage interface {
+	// View executes a read-only transaction
+	View(fn func(Tx) error) error
+	// Update executes a read-write transaction, the transaction is
+	// rolled back if fn returns an error. fn may be called again if
+	// the transaction conflicts with a concurrent one.
+	Update(fn func(Tx) error) error
+	// Compact reclaims space freed by deleted data, whether the file
+	// system gets it back depends on the storage. No read-write
+	// transaction runs while compacting, read-only ones may.
+	Compact() error
+	Close() error
+}
+
+// Tx is a transaction of Storage. Errors of methods not returning an
+// error are raised as panics, which are returned as errors of the
+// transaction.
+type Tx interface {
+	// Bucket returns the top level bucket name, nil if not exist
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	// ForEach calls fn with each top level bucket
+	ForEach(fn func(name []byte, b Bucket) error) error
+}
+
+// Bucket is a collection of key/value pairs and nested buckets
+type Bucket interface {
+	// Bucket returns the nested bucket name, nil if not exist
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+
+	// Get returns the value of key k, nil if not exist or k is a
+	// nested bucket.
+	Get(k []byte) []byte
+	Put(k, v []byte) error
+	Delete(k []byte) error
+	// ForEach calls fn with each key/value pair in key order, v is
+	// nil for nested buckets.
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() Cursor
+
+	// NextSequence returns an autoincrementing integer of the bucket
+	NextSequence() (uint64, error)
+	Sequence() uint64
+	SetSequence(v uint64) error
+}
+
+// Cursor iterates keys of a bucket in order, k is nil if the cursor
+// moves beyond the first or the last key. v is nil for nested buckets.
+type Cursor interface {
+	First() (k, v []byte)
+	Last() (k, v []byte)
+	Next() (k, v []byte)
+	Prev() (k, v []byte)
+	// Seek moves to k, or the next key if k does not exist
+	Seek(k []byte) (key, v []byte)
+}
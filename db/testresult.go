@@ -0,0 +1,122 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/topicai/candy"
+)
+
+var testResultBucket = []byte("test_result")
+
+// TestStatus is the result of a test case
+type TestStatus string
+
+// Statuses of test cases
+const (
+	TestPassed  TestStatus = "passed"
+	TestFailed  TestStatus = "failed"
+	TestSkipped TestStatus = "skipped"
+)
+
+// TestResult is the result of a test case in a test report of an
+// attempt
+type TestResult struct {
+	Suite    string // test suite or package of the test case
+	Name     string
+	Status   TestStatus
+	Duration time.Duration
+	Message  string // failure message or skip reason
+	Line     uint64 // output line reporting the failure, starts from 1, 0 if unknown
+}
+
+// TestSummary counts test results by status
+type TestSummary struct {
+	Total, Passed, Failed, Skipped int
+}
+
+// SummarizeTests counts results rs by status
+func SummarizeTests(rs []TestResult) TestSummary {
+	s := TestSummary{Total: len(rs)}
+	for _, r := range rs {
+		switch r.Status {
+		case TestPassed:
+			s.Passed++
+		case TestFailed:
+			s.Failed++
+		case TestSkipped:
+			s.Skipped++
+		}
+	}
+	return s
+}
+
+// putTestResults appends results rs of attempt num of build id, the
+// tests ran at t.
+func putTestResults(tx Tx, id, num uint64, rs []TestResult, t time.Time) {
+	b, err := tx.CreateBucketIfNotExists(testResultBucket)
+	candy.Must(err)
+	b, err = b.CreateBucketIfNotExists(itob(id))
+	candy.Must(err)
+	b, err = b.CreateBucketIfNotExists(itob(num))
+	candy.Must(err)
+	for _, r := range rs {
+		seq, err := b.NextSequence()
+		candy.Must(err)
+		candy.Must(putGob(b, itob(seq), r))
+	}
+	recordTestRuns(tx, id, num, rs, t)
+}
+
+// testResults returns results of attempt num of build id in the order
+// they are added
+func testResults(tx Tx, id, num []byte) []TestResult {
+	b := tx.Bucket(testResultBucket)
+	if b == nil {
+		return nil
+	}
+	if b = b.Bucket(id); b == nil {
+		return nil
+	}
+	if b = b.Bucket(num); b == nil {
+		return nil
+	}
+	var rs []TestResult
+	candy.Must(b.ForEach(func(_, v []byte) error {
+		var r TestResult
+		candy.Must(gob.NewDecoder(bytes.NewReader(v)).Decode(&r))
+		rs = append(rs, r)
+		return nil
+	}))
+	return rs
+}
+
+// AddTestResults records results of test cases parsed from test
+// reports of the attempt
+func (a *Attempt) AddTestResults(rs []TestResult) error {
+	if a.mask != nil {
+		rs = append([]TestResult(nil), rs...)
+		for i := range rs {
+			rs[i].Message = a.mask.Replace(rs[i].Message)
+		}
+	}
+	return a.db.update(makeSafeHandler(func(tx Tx) error {
+		putTestResults(tx, a.BuildID, a.Num, rs, time.Now().UTC().Round(0))
+		return nil
+	}))
+}
+
+// TestResults returns results of test cases of the attempt in the
+// order they are added
+func (a *Attempt) TestResults() ([]TestResult, error) {
+	var rs []TestResult
+	err := a.db.view(makeSafeHandler(func(tx Tx) error {
+		rs = testResults(tx, itob(a.BuildID), itob(a.Num))
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
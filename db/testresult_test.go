@@ -0,0 +1,93 @@
+package db_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+func TestTestResults(t *testing.T) {
+	d, err := open(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := d.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	defer os.Remove(testPath)
+
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, err := b.NewAttempt("worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := b.NewAttempt("worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := a1.TestResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 0 {
+		t.Fatal(rs)
+	}
+
+	want := []db.TestResult{
+		{Suite: "pkg", Name: "TestA", Status: db.TestPassed, Duration: time.Second},
+		{Suite: "pkg", Name: "TestB", Status: db.TestFailed, Message: "want 1, got 2", Line: 42},
+		{Suite: "pkg", Name: "TestC", Status: db.TestSkipped, Message: "short mode"},
+	}
+	err = a1.AddTestResults(want[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a1.AddTestResults(want[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a2.AddTestResults(want[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err = a1.TestResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rs, want) {
+		t.Fatal(rs)
+	}
+	if s := db.SummarizeTests(rs); s != (db.TestSummary{Total: 3, Passed: 1, Failed: 1, Skipped: 1}) {
+		t.Fatal(s)
+	}
+	rs, err = a2.TestResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rs, want[:1]) {
+		t.Fatal(rs)
+	}
+
+	err = d.DeleteBuild(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err = a1.TestResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 0 {
+		t.Fatal(rs)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/wangkuiyi/ci/db"
+	"github.com/wangkuiyi/ci/webhook"
+)
+
+// deliveries shown on a page of the delivery log
+const deliveryPageSize = 50
+
+// deliveryLog records webhook deliveries in the database
+type deliveryLog struct {
+	db *db.DB
+}
+
+func (l deliveryLog) Add(d webhook.Delivery) (uint64, bool, error) {
+	dv, dup, err := l.db.AddDelivery(db.Delivery{
+		ID:      d.ID,
+		Event:   d.Event,
+		Header:  d.Header,
+		Body:    d.Body,
+		Outcome: d.Outcome,
+	})
+	return dv.Seq, dup, err
+}
+
+func (l deliveryLog) SetOutcome(seq uint64, outcome string) error {
+	return l.db.SetDeliveryOutcome(seq, outcome)
+}
+
+func (l deliveryLog) Pending(n int) ([]webhook.Delivery, int, error) {
+	dvs, total, err := l.db.PendingDeliveries(n)
+	if err != nil {
+		return nil, 0, err
+	}
+	ds := make([]webhook.Delivery, len(dvs))
+	for i, dv := range dvs {
+		ds[i] = webhook.Delivery{
+			Seq:      dv.Seq,
+			ID:       dv.ID,
+			Event:    dv.Event,
+			Header:   dv.Header,
+			Body:     dv.Body,
+			Received: dv.Received,
+			Outcome:  dv.Outcome,
+		}
+	}
+	return ds, total, nil
+}
+
+// WebhookStats are metrics of webhook ingestion, durations are in
+// seconds
+type WebhookStats struct {
+	Accepted  uint64
+	Processed uint64
+	Pending   int
+	Blocked   float64
+	Latency   float64
+}
+
+func (h *HTTPServer) webhookStats() WebhookStats {
+	s := h.hook.Stats()
+	return WebhookStats{
+		Accepted:  s.Accepted,
+		Processed: s.Processed,
+		Pending:   s.Pending,
+		Blocked:   s.Blocked.Seconds(),
+		Latency:   s.Latency.Seconds(),
+	}
+}
+
+func (h *HTTPServer) webhookStatsAPIHandler(res http.ResponseWriter, req *http.Request) {
+	dat, err := json.Marshal(h.webhookStats())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_, err = res.Write(dat)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// DeliveryHeader is a header of a delivery
+type DeliveryHeader struct {
+	Name  string
+	Value string
+}
+
+func (h *HTTPServer) deliveriesHandler(res http.ResponseWriter, req *http.Request) {
+	var before uint64
+	if b := req.FormValue("before"); b != "" {
+		var err error
+		before, err = strconv.ParseUint(b, 10, 64)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("400 Bad Request - invalid before: %q", b), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ds, err := h.db.Deliveries(before, deliveryPageSize)
+	if err != nil {
+		log.Panic(err)
+	}
+	var next uint64
+	if len(ds) == deliveryPageSize {
+		next = ds[len(ds)-1].Seq
+	}
+
+	h.render(res, req, "deliveries", map[string]interface{}{
+		"Deliveries": ds,
+		"Next":       next,
+		"Stats":      h.webhookStats(),
+	})
+}
+
+func (h *HTTPServer) deliveryHandler(res http.ResponseWriter, req *http.Request) {
+	seq, err := strconv.ParseUint(mux.Vars(req)["seq"], 10, 64)
+	if err != nil {
+		log.Panic(err)
+	}
+	dv, err := h.db.Delivery(seq)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var headers []DeliveryHeader
+	for name, vs := range dv.Header {
+		headers = append(headers, DeliveryHeader{Name: name, Value: strings.Join(vs, ", ")})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+
+	body := string(dv.Body)
+	var buf bytes.Buffer
+	if json.Indent(&buf, dv.Body, "", "  ") == nil {
+		body = buf.String()
+	}
+
+	h.render(res, req, "delivery", map[string]interface{}{
+		"Delivery": dv,
+		"Headers":  headers,
+		"Body":     body,
+		"CSRF":     h.csrfToken(fmt.Sprintf("/admin/deliveries/%d/replay", seq)),
+	})
+}
+
+// replayHandler marks a recorded delivery pending again, so that its
+// event is sent to the event queue as if github redelivered it.
+func (h *HTTPServer) replayHandler(res http.ResponseWriter, req *http.Request) {
+	seq, err := strconv.ParseUint(mux.Vars(req)["seq"], 10, 64)
+	if err != nil {
+		log.Panic(err)
+	}
+	dv, err := h.db.Delivery(seq)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	e, err := webhook.Decode(dv.Event, dv.Body)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("400 Bad Request - delivery %d is malformed: %v", seq, err), http.StatusBadRequest)
+		return
+	}
+	if e == nil {
+		http.Error(res, fmt.Sprintf("400 Bad Request - %q events are not handled", dv.Event), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.SetDeliveryReplayed(seq)
+	if err != nil {
+		log.Panic(err)
+	}
+	user, _, _ := req.BasicAuth()
+	log.Println("delivery", seq, dv.ID, "replayed by", user)
+	err = h.db.SetDeliveryOutcome(seq, db.DeliveryPending)
+	if err != nil {
+		log.Panic(err)
+	}
+	http.Redirect(res, req, fmt.Sprintf("/admin/deliveries/%d", seq), http.StatusSeeOther)
+}
@@ -0,0 +1,160 @@
+// Filtering events which do not need builds.
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/wangkuiyi/ci/webhook"
+)
+
+// triggerSetting filters pushes and pull requests triggering builds.
+// Patterns are globs like path.Match, and ** matches any number of
+// directories, such as docs/** and **/*.md.
+type triggerSetting struct {
+	Branches       []string // branches to build, all branches if empty
+	IgnoreBranches []string // branches not to build
+	Paths          []string // changed files triggering builds, all files if empty
+	IgnorePaths    []string // changed files not triggering builds
+}
+
+// maxPushCommits is the most commits listed in a push event, files
+// changed by a push listing as many commits may be incomplete.
+const maxPushCommits = 20
+
+// skipMarkers in head commit messages skip builds
+var skipMarkers = []string{"[skip ci]", "[ci skip]"}
+
+func (t triggerSetting) check() error {
+	for _, ps := range [][]string{t.Branches, t.IgnoreBranches, t.Paths, t.IgnorePaths} {
+		for _, p := range ps {
+			for _, s := range strings.Split(p, "/") {
+				if _, err := path.Match(s, ""); err != nil {
+					return fmt.Errorf("invalid pattern %q: %v", p, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// branch returns whether branch name is built
+func (t triggerSetting) branch(name string) bool {
+	return (len(t.Branches) == 0 || matchAny(t.Branches, name)) && !matchAny(t.IgnoreBranches, name)
+}
+
+// files returns whether changing files triggers a build
+func (t triggerSetting) files(files []string) bool {
+	for _, f := range files {
+		if (len(t.Paths) == 0 || matchAny(t.Paths, f)) && !matchAny(t.IgnorePaths, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t triggerSetting) filterPaths() bool {
+	return len(t.Paths) > 0 || len(t.IgnorePaths) > 0
+}
+
+// skipPush returns why push e of a branch does not need a build, empty
+// if it does. Pushes of tags are always built.
+func (t triggerSetting) skipPush(e webhook.PushEvent) string {
+	if !strings.HasPrefix(e.Ref, "refs/heads/") {
+		return ""
+	}
+	if !t.branch(strings.TrimPrefix(e.Ref, "refs/heads/")) {
+		return "branch is filtered"
+	}
+	if skipCI(e.HeadCommit.Message) {
+		return "head commit skips ci"
+	}
+	if !t.filterPaths() || len(e.Commits) == 0 || len(e.Commits) >= maxPushCommits {
+		return ""
+	}
+	var files []string
+	for _, c := range e.Commits {
+		files = append(files, c.Added...)
+		files = append(files, c.Removed...)
+		files = append(files, c.Modified...)
+	}
+	if !t.files(files) {
+		return "no changed file triggers builds"
+	}
+	return ""
+}
+
+// skipPullRequest returns why pull request e does not need a build,
+// empty if it does. Pull requests are filtered by their base branch,
+// message of the head commit and files they change, which are read
+// through the github API.
+func (t triggerSetting) skipPullRequest(e webhook.PullRequestEvent, message func(sha string) (string, error), files func(number int) ([]string, error)) (string, error) {
+	if !t.branch(e.PullRequest.Base.Ref) {
+		return "base branch is filtered", nil
+	}
+	m, err := message(e.PullRequest.Head.Sha)
+	if err != nil {
+		return "", err
+	}
+	if skipCI(m) {
+		return "head commit skips ci", nil
+	}
+	if !t.filterPaths() {
+		return "", nil
+	}
+	fs, err := files(e.Number)
+	if err != nil {
+		return "", err
+	}
+	if !t.files(fs) {
+		return "no changed file triggers builds", nil
+	}
+	return "", nil
+}
+
+// skipCI returns whether commit message asks not to build the commit
+func skipCI(message string) bool {
+	for _, m := range skipMarkers {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchGlob(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns whether slash separated name matches pattern, **
+// in pattern matches any number of path elements.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(ps, ns []string) bool {
+	for len(ps) > 0 {
+		if ps[0] == "**" {
+			for i := 0; i <= len(ns); i++ {
+				if matchElems(ps[1:], ns[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(ns) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(ps[0], ns[0]); !ok {
+			return false
+		}
+		ps, ns = ps[1:], ns[1:]
+	}
+	return len(ns) == 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wangkuiyi/ci/webhook"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"master", "master", true},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/fix", false},
+		{"release/**", "release/1.0/fix", true},
+		{"*.md", "README.md", true},
+		{"*.md", "doc/design.md", false},
+		{"**/*.md", "doc/design.md", true},
+		{"**/*.md", "README.md", true},
+		{"doc/**", "doc", true},
+		{"doc/**", "docs/a.md", false},
+		{"**", "a/b/c", true},
+	}
+	for _, c := range cases {
+		if matchGlob(c.pattern, c.name) != c.match {
+			t.Errorf("matchGlob(%q, %q) != %v", c.pattern, c.name, c.match)
+		}
+	}
+}
+
+func TestTriggerCheck(t *testing.T) {
+	if err := (triggerSetting{Paths: []string{"doc/[a"}}).check(); err == nil {
+		t.Fatal("invalid pattern passed check")
+	}
+	if err := (triggerSetting{Branches: []string{"release/**"}}).check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pushEvent(ref, message string, files ...string) webhook.PushEvent {
+	var e webhook.PushEvent
+	e.Ref = ref
+	e.HeadCommit.Message = message
+	if len(files) > 0 {
+		e.Commits = []webhook.Commit{{Modified: files}}
+	}
+	return e
+}
+
+func TestSkipPush(t *testing.T) {
+	tr := triggerSetting{
+		Branches:       []string{"master", "release/*"},
+		IgnoreBranches: []string{"release/old"},
+		IgnorePaths:    []string{"doc/**", "**/*.md"},
+	}
+	cases := []struct {
+		e    webhook.PushEvent
+		skip bool
+	}{
+		{pushEvent("refs/heads/master", "fix", "main.go"), false},
+		{pushEvent("refs/heads/release/1.0", "fix", "main.go"), false},
+		{pushEvent("refs/heads/release/old", "fix", "main.go"), true},
+		{pushEvent("refs/heads/feature", "fix", "main.go"), true},
+		{pushEvent("refs/heads/master", "fix [skip ci]", "main.go"), true},
+		{pushEvent("refs/heads/master", "[ci skip] fix", "main.go"), true},
+		{pushEvent("refs/heads/master", "doc", "doc/a.png", "db/README.md"), true},
+		{pushEvent("refs/heads/master", "doc", "doc/a.png", "db/db.go"), false},
+		{pushEvent("refs/heads/master", "no commits"), false},
+		{pushEvent("refs/tags/v1.0", "[skip ci]"), false},
+	}
+	for i, c := range cases {
+		if reason := tr.skipPush(c.e); (reason != "") != c.skip {
+			t.Errorf("case %d: skip %q, expected %v", i, reason, c.skip)
+		}
+	}
+	if reason := (triggerSetting{}).skipPush(pushEvent("refs/heads/any", "doc", "a.md")); reason != "" {
+		t.Error(reason)
+	}
+}
+
+func TestSkipPullRequest(t *testing.T) {
+	tr := triggerSetting{Branches: []string{"develop"}, Paths: []string{"**/*.go"}}
+	var e webhook.PullRequestEvent
+	e.Number = 7
+	e.PullRequest.Base.Ref = "develop"
+	e.PullRequest.Head.Sha = "abc"
+
+	message := func(m string) func(string) (string, error) {
+		return func(sha string) (string, error) {
+			if sha != "abc" {
+				t.Fatal(sha)
+			}
+			return m, nil
+		}
+	}
+	files := func(fs ...string) func(int) ([]string, error) {
+		return func(n int) ([]string, error) {
+			if n != 7 {
+				t.Fatal(n)
+			}
+			return fs, nil
+		}
+	}
+
+	reason, err := tr.skipPullRequest(e, message("fix"), files("README.md", "db/db.go"))
+	if err != nil || reason != "" {
+		t.Fatal(reason, err)
+	}
+	reason, err = tr.skipPullRequest(e, message("fix"), files("README.md"))
+	if err != nil || reason == "" {
+		t.Fatal(reason, err)
+	}
+	reason, err = tr.skipPullRequest(e, message("wip [skip ci]"), files("db/db.go"))
+	if err != nil || reason == "" {
+		t.Fatal(reason, err)
+	}
+	_, err = tr.skipPullRequest(e, message("fix"), func(int) ([]string, error) { return nil, errors.New("rate limited") })
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	e.PullRequest.Base.Ref = "master"
+	reason, err = tr.skipPullRequest(e, message("fix"), files("db/db.go"))
+	if err != nil || reason == "" {
+		t.Fatal(reason, err)
+	}
+}
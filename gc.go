@@ -0,0 +1,41 @@
+// Deleting builds not kept by the retention policy.
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/wangkuiyi/ci/artifact"
+	"github.com/wangkuiyi/ci/db"
+)
+
+// collectGarbage deletes builds not kept by policy p every interval.
+// After builds are deleted, the database is compacted and artifacts
+// no longer referenced are removed.
+func collectGarbage(d *db.DB, artifacts *artifact.Store, p db.RetentionPolicy, interval time.Duration) {
+	for {
+		deleted, err := d.Collect(p, time.Now())
+		if err != nil {
+			log.Println("collect builds:", err)
+		}
+		if len(deleted) > 0 {
+			log.Println("deleted", len(deleted), "builds")
+			err = d.Compact()
+			if err != nil {
+				log.Println("compact db:", err)
+			}
+
+			sums, err := d.ArtifactSums()
+			if err != nil {
+				log.Println(err)
+			} else {
+				n, err := artifacts.Sweep(sums, time.Now().Add(-interval))
+				if err != nil {
+					log.Println("sweep artifacts:", err)
+				}
+				log.Println("removed", n, "artifacts")
+			}
+		}
+		time.Sleep(interval)
+	}
+}
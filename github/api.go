@@ -1,7 +1,9 @@
 package github
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
@@ -19,7 +21,7 @@ type API struct {
 // New creates a new github api
 func New(endpoint, description, owner, name, token string) *API {
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	tc := oauth2.NewClient(context.Background(), ts)
 	g := github.NewClient(tc)
 	return &API{
 		cli:         g,
@@ -42,24 +44,52 @@ const (
 
 // CheckRepo check if github repository is valid
 func (g *API) CheckRepo() error {
-	_, _, err := g.cli.Repositories.Get(g.owner, g.name)
+	_, _, err := g.cli.Repositories.Get(context.Background(), g.owner, g.name)
 	return err
 }
 
 // CreateStatus will a check status for version `sha`.
 func (g *API) CreateStatus(sha string, status string) error {
+	return g.CreateStatusWithDescription(sha, status, g.description)
+}
+
+// CreateStatusWithDescription creates a check status for version
+// `sha` with description shown on github instead of the description
+// of the ci.
+func (g *API) CreateStatusWithDescription(sha, status, description string) error {
+	return g.CreateStatusInContext(sha, "", status, description)
+}
+
+// CreateStatusInContext creates a check status for version `sha` in
+// statusContext, statuses of a commit in different contexts are shown
+// separately on github. The context is the default one if empty, and
+// the description is the description of the ci if empty.
+func (g *API) CreateStatusInContext(sha, statusContext, status, description string) error {
+	if description == "" {
+		description = g.description
+	}
 	url := fmt.Sprintf("%s/status/%s", g.endpoint, sha)
-	_, _, err := g.cli.Repositories.CreateStatus(g.owner, g.name, sha, &github.RepoStatus{
+	s := &github.RepoStatus{
 		TargetURL:   &url,
 		State:       &status,
-		Description: &g.description,
-	})
+		Description: &description,
+	}
+	if statusContext != "" {
+		s.Context = &statusContext
+	}
+	_, _, err := g.cli.Repositories.CreateStatus(context.Background(), g.owner, g.name, sha, s)
 	return err
 }
 
+// IsCollaborator checks if user is a collaborator of the repository
+func (g *API) IsCollaborator(user string) (bool, error) {
+	ok, _, err := g.cli.Repositories.IsCollaborator(context.Background(), g.owner, g.name, user)
+	return ok, err
+}
+
 // ListRemoteBranches List all remote branches
 func (g *API) ListRemoteBranches() ([]string, error) {
-	branches, _, err := g.cli.Repositories.ListBranches(g.owner, g.name, nil)
+	branches, _, err := g.cli.Repositories.ListBranches(context.Background(), g.owner, g.name, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -69,3 +99,104 @@ func (g *API) ListRemoteBranches() ([]string, error) {
 	}
 	return retv, nil
 }
+
+// BranchHead returns the SHA of the head commit of branch
+func (g *API) BranchHead(branch string) (string, error) {
+	b, _, err := g.cli.Repositories.GetBranch(context.Background(), g.owner, g.name, branch)
+	if err != nil {
+		return "", err
+	}
+	if b.Commit == nil || b.Commit.SHA == nil {
+		return "", fmt.Errorf("branch %s has no head commit", branch)
+	}
+	return *b.Commit.SHA, nil
+}
+
+// TagCommit returns the SHA of the commit tag points to
+func (g *API) TagCommit(tag string) (string, error) {
+	c, _, err := g.cli.Repositories.GetCommit(context.Background(), g.owner, g.name, "refs/tags/"+tag)
+	if err != nil {
+		return "", err
+	}
+	if c.SHA == nil {
+		return "", fmt.Errorf("tag %s has no commit", tag)
+	}
+	return *c.SHA, nil
+}
+
+// CommitMessage returns the message of commit sha
+func (g *API) CommitMessage(sha string) (string, error) {
+	c, _, err := g.cli.Repositories.GetCommit(context.Background(), g.owner, g.name, sha)
+	if err != nil {
+		return "", err
+	}
+	if c.Commit == nil || c.Commit.Message == nil {
+		return "", fmt.Errorf("commit %s has no message", sha)
+	}
+	return *c.Commit.Message, nil
+}
+
+// PullRequestFiles returns names of files changed by pull request
+// number
+func (g *API) PullRequestFiles(number int) ([]string, error) {
+	var files []string
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		fs, resp, err := g.cli.PullRequests.ListFiles(context.Background(), g.owner, g.name, number, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fs {
+			if f.Filename != nil {
+				files = append(files, *f.Filename)
+			}
+		}
+		if resp.NextPage == 0 {
+			return files, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// PullRequest is a pull request read through the github API
+type PullRequest struct {
+	Author   string // login of the author
+	HeadRef  string
+	HeadSHA  string
+	CloneURL string // clone URL of the head repository
+	Fork     bool   // whether the head repository is not the repository
+	Base     string // the branch the pull request merges into
+}
+
+// PullRequest returns pull request number. Webhook payloads are not
+// trusted to tell whether a pull request comes from a fork.
+func (g *API) PullRequest(number int) (PullRequest, error) {
+	pr, _, err := g.cli.PullRequests.Get(context.Background(), g.owner, g.name, number)
+	if err != nil {
+		return PullRequest{}, err
+	}
+	head := pr.GetHead()
+	if head.GetRepo() == nil {
+		return PullRequest{}, fmt.Errorf("the head repository of pull request %d is deleted", number)
+	}
+	return PullRequest{
+		Author:   pr.GetUser().GetLogin(),
+		HeadRef:  head.GetRef(),
+		HeadSHA:  head.GetSHA(),
+		CloneURL: head.GetRepo().GetCloneURL(),
+		Fork:     !strings.EqualFold(head.GetRepo().GetFullName(), g.owner+"/"+g.name),
+		Base:     pr.GetBase().GetRef(),
+	}, nil
+}
+
+// CloneURL returns the URL to clone the repository
+func (g *API) CloneURL() (string, error) {
+	r, _, err := g.cli.Repositories.Get(context.Background(), g.owner, g.name)
+	if err != nil {
+		return "", err
+	}
+	if r.CloneURL == nil {
+		return "", fmt.Errorf("repository %s/%s has no clone URL", g.owner, g.name)
+	}
+	return *r.CloneURL, nil
+}
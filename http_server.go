@@ -2,6 +2,11 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"io/ioutil"
 	"net/http"
 
@@ -14,12 +19,21 @@ import (
 
 	"path"
 
+	"sort"
+
 	"strconv"
 
+	"time"
+
 	"encoding/json"
 
+	"mime"
+	"net/url"
+	"os"
+
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
+	"github.com/wangkuiyi/ci/artifact"
 	"github.com/wangkuiyi/ci/db"
 	"github.com/wangkuiyi/ci/github"
 	"github.com/wangkuiyi/ci/webhook"
@@ -34,8 +48,27 @@ type HTTPServer struct {
 
 	db *db.DB // Database
 
-	renderer *Renderer
-	github   *github.API
+	renderer  *Renderer
+	github    *github.API
+	artifacts *artifact.Store
+
+	eventQueue chan<- interface{} // events from the website, like approveEvent
+	hook       *webhook.Receiver
+	admin      adminSetting
+	csrfKey    []byte // signs tokens of forms maintainers post
+}
+
+// adminSetting is the credential of maintainers on the website
+type adminSetting struct {
+	User     string
+	Password string
+}
+
+// approveEvent is sent to the event queue when a maintainer has
+// approved a build on the website, the approval is recorded already.
+type approveEvent struct {
+	BuildID uint64
+	By      string
 }
 
 // Renderer is a http middleware for render template
@@ -92,28 +125,90 @@ func (renderer *Renderer) render(rw http.ResponseWriter, name string, data map[s
 	}
 }
 
-func newHTTPServer(db *db.DB, github *github.API, eventQueue chan<- interface{}, addr, dir, owner, name, description string) *HTTPServer {
+func newHTTPServer(db *db.DB, github *github.API, artifacts *artifact.Store, eventQueue chan<- interface{}, addr, dir, owner, name, description, secret string, admin adminSetting) *HTTPServer {
 	serv := &HTTPServer{
-		addr:     addr,
-		router:   mux.NewRouter(),
-		n:        negroni.New(),
-		db:       db,
-		renderer: newRenderer(dir, owner, name, description),
-		github:   github,
-	}
-	hook := &webhook.Receiver{Ch: eventQueue}
+		addr:       addr,
+		router:     mux.NewRouter(),
+		n:          negroni.New(),
+		db:         db,
+		renderer:   newRenderer(dir, owner, name, description),
+		github:     github,
+		artifacts:  artifacts,
+		eventQueue: eventQueue,
+		admin:      admin,
+		csrfKey:    make([]byte, 32),
+	}
+	_, err := rand.Read(serv.csrfKey)
+	if err != nil {
+		log.Panic(err)
+	}
+	serv.hook = &webhook.Receiver{Ch: eventQueue, Log: deliveryLog{db}, Repo: owner + "/" + name, Secret: secret}
 	serv.n.Use(negroni.NewRecovery())
-	serv.router.HandleFunc("/ci/", hook.ServeHTTP)
+	serv.router.HandleFunc("/ci/", serv.hook.ServeHTTP)
 	serv.router.HandleFunc("/", serv.homeHandler).Methods("Get").Name("home")
 	serv.router.HandleFunc("/status/{sha:[0-9a-f]+}", serv.statusHandler).Methods("Get").Name("status")
+	serv.router.HandleFunc("/builds", serv.buildListHandler).Methods("Get").Name("buildList")
 	serv.router.HandleFunc("/builds/{buildID:[0-9]+}", serv.buildsHandler).Methods("Get").Name("builds")
+	serv.router.HandleFunc("/builds/{buildID:[0-9]+}/coverage", serv.coverageHandler).Methods("Get").Name("coverage")
+	serv.router.HandleFunc("/builds/{buildID:[0-9]+}/approve", serv.requireAdmin(serv.approveFormHandler)).Methods("Get").Name("approveForm")
+	serv.router.HandleFunc("/builds/{buildID:[0-9]+}/approve", serv.requireAdmin(serv.approveHandler)).Methods("Post").Name("approve")
+	serv.router.HandleFunc("/admin/backup", serv.requireAdmin(serv.backupHandler)).Methods("Get").Name("backup")
+	serv.router.HandleFunc("/admin/export", serv.requireAdmin(serv.exportHandler)).Methods("Get").Name("export")
+	serv.router.HandleFunc("/admin/deliveries", serv.requireAdmin(serv.deliveriesHandler)).Methods("Get").Name("deliveries")
+	serv.router.HandleFunc("/admin/deliveries/{seq:[0-9]+}", serv.requireAdmin(serv.deliveryHandler)).Methods("Get").Name("delivery")
+	serv.router.HandleFunc("/admin/deliveries/{seq:[0-9]+}/replay", serv.requireAdmin(serv.replayHandler)).Methods("Post").Name("replay")
 	serv.router.HandleFunc("/build_output/", serv.buildOutputHandler).Methods("Get").Name("buildOutput")
+	serv.router.HandleFunc("/build_list/", serv.buildListAPIHandler).Methods("Get").Name("buildListAPI")
+	serv.router.HandleFunc("/search", serv.searchHandler).Methods("Get").Name("search")
+	serv.router.HandleFunc("/search_output/", serv.searchAPIHandler).Methods("Get").Name("searchAPI")
+	serv.router.HandleFunc("/flaky", serv.flakyHandler).Methods("Get").Name("flaky")
+	serv.router.HandleFunc("/stats", serv.statsHandler).Methods("Get").Name("stats")
+	serv.router.HandleFunc("/build_stats/", serv.statsAPIHandler).Methods("Get").Name("statsAPI")
+	serv.router.HandleFunc("/webhook_stats/", serv.webhookStatsAPIHandler).Methods("Get").Name("webhookStatsAPI")
+	serv.router.HandleFunc("/build_artifacts/", serv.buildArtifactsHandler).Methods("Get").Name("buildArtifacts")
+	serv.router.HandleFunc("/artifacts/{sha256:[0-9a-f]{64}}/{name}", serv.artifactHandler).Methods("Get").Name("artifact")
 	serv.n.UseHandler(serv.router)
 	return serv
 }
 
-// ListenAndServe by using configuration.
+// requireAdmin wraps f so that it is only served to maintainers
+// authenticated with HTTP basic auth. Browsers send the credentials
+// with requests other sites make as well, so posts must carry the
+// csrf token of their path, which only pages served to maintainers
+// render.
+func (h *HTTPServer) requireAdmin(f http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if h.admin.User == "" || h.admin.Password == "" {
+			http.Error(res, "403 Forbidden - admin is not configured", http.StatusForbidden)
+			return
+		}
+		user, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(h.admin.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.admin.Password)) != 1 {
+			res.Header().Set("WWW-Authenticate", `Basic realm="ci"`)
+			http.Error(res, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method == "POST" && !hmac.Equal([]byte(req.PostFormValue("csrf")), []byte(h.csrfToken(req.URL.Path))) {
+			http.Error(res, "403 Forbidden - invalid csrf token, submit the form on the ci website", http.StatusForbidden)
+			return
+		}
+		f(res, req)
+	}
+}
+
+// csrfToken returns the token of forms posting to path
+func (h *HTTPServer) csrfToken(path string) string {
+	mac := hmac.New(sha256.New, h.csrfKey)
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ListenAndServe by using configuration, webhook events are sent to
+// the event queue in the background.
 func (h *HTTPServer) ListenAndServe() error {
+	go h.hook.Run()
 	return http.ListenAndServe(h.addr, h.n)
 }
 
@@ -137,23 +232,41 @@ type VersionWithStatus struct {
 func (h *HTTPServer) homeHandler(res http.ResponseWriter, req *http.Request) {
 	type BranchBuilds struct {
 		Name     string
+		Archived time.Time // zero if the branch is not archived
 		Versions []VersionWithStatus
 	}
 	// view objects
 	var vo struct {
-		Branches []BranchBuilds
+		Archived  bool // list archived branches instead of active ones
+		Branches  []BranchBuilds
+		Releases  []ReleaseBuild
+		Schedules []ScheduleBuilds
 	}
 
-	refs, err := h.db.Refs(db.Push)
-	if err != nil {
-		// TODO(helin): better HTTP handler error handling than panic and recover
-		log.Panic(err)
+	// active refs are not archived, their archived time is zero
+	var refs []db.ArchivedRef
+	var err error
+	if vo.Archived = req.FormValue("archived") != ""; vo.Archived {
+		refs, err = h.db.ArchivedRefs(db.Push)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		active, err := h.db.Refs(db.Push)
+		if err != nil {
+			// TODO(helin): better HTTP handler error handling than panic and recover
+			log.Panic(err)
+		}
+		for _, r := range active {
+			refs = append(refs, db.ArchivedRef{Ref: r})
+		}
 	}
 
 	vo.Branches = make([]BranchBuilds, len(refs))
 	for i, r := range refs {
-		vo.Branches[i].Name = r
-		builds, err := h.db.RefBuilds(db.Push, r, 0, 20)
+		vo.Branches[i].Name = r.Ref
+		vo.Branches[i].Archived = r.Archived
+		builds, err := h.db.RefBuilds(db.Push, r.Ref, 0, 20)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -168,12 +281,114 @@ func (h *HTTPServer) homeHandler(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	vo.Releases, err = h.releaseBuilds(20)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	vo.Schedules, err = h.scheduleBuilds(20)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	dat := make(map[string]interface{})
 	dat["Vo"] = vo
 
 	h.render(res, req, "index", dat)
 }
 
+// ReleaseBuild is the latest build of a tag
+type ReleaseBuild struct {
+	Tag string
+	db.ReleaseInfo
+	BuildWithStatus
+}
+
+// releaseBuilds returns the latest builds of at most n tags, the
+// latest tag first.
+func (h *HTTPServer) releaseBuilds(n int) ([]ReleaseBuild, error) {
+	refs, err := h.db.Refs(db.Release)
+	if err != nil {
+		return nil, err
+	}
+	var bs []db.Build
+	for _, r := range refs {
+		builds, err := h.db.RefBuilds(db.Release, r, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		bs = append(bs, builds...)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].ID > bs[j].ID })
+
+	rs := make([]ReleaseBuild, minInt(n, len(bs)))
+	for i := range rs {
+		b := bs[i]
+		stat, err := b.Status()
+		if err != nil {
+			log.Println(b, err)
+		}
+		rs[i] = ReleaseBuild{
+			Tag:             b.Tag(),
+			ReleaseInfo:     b.Release,
+			BuildWithStatus: BuildWithStatus{ID: b.ID, Ref: b.Ref, CommitSHA: b.CommitSHA, Status: stat, Created: b.Created},
+		}
+	}
+	return rs, nil
+}
+
+// ScheduleBuilds are the latest builds of a schedule
+type ScheduleBuilds struct {
+	Name   string
+	Builds []BuildWithStatus
+}
+
+// scheduleBuilds returns at most n latest builds of each schedule,
+// schedules are sorted by name.
+func (h *HTTPServer) scheduleBuilds(n int) ([]ScheduleBuilds, error) {
+	refs, err := h.db.Refs(db.Scheduled)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := h.db.ArchivedRefs(db.Scheduled)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range archived {
+		refs = append(refs, r.Ref)
+	}
+	builds := make(map[string][]db.Build)
+	for _, r := range refs {
+		bs, err := h.db.RefBuilds(db.Scheduled, r, 0, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bs {
+			builds[b.Schedule] = append(builds[b.Schedule], b)
+		}
+	}
+
+	var names []string
+	for name := range builds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ss := make([]ScheduleBuilds, len(names))
+	for i, name := range names {
+		bs := builds[name]
+		sort.Slice(bs, func(i, j int) bool { return bs[i].ID > bs[j].ID })
+		ss[i].Name = name
+		for _, b := range bs[:minInt(n, len(bs))] {
+			stat, err := b.Status()
+			if err != nil {
+				log.Println(b, err)
+			}
+			ss[i].Builds = append(ss[i].Builds, BuildWithStatus{ID: b.ID, Ref: b.Ref, CommitSHA: b.CommitSHA, Status: stat, Created: b.Created})
+		}
+	}
+	return ss, nil
+}
+
 func (h *HTTPServer) statusHandler(res http.ResponseWriter, req *http.Request) {
 	sha := path.Base(req.RequestURI)
 	bs, err := h.db.SHABuilds(sha)
@@ -192,9 +407,228 @@ func (h *HTTPServer) statusHandler(res http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// BuildWithStatus build with its status
+type BuildWithStatus struct {
+	ID        uint64         `json:"ID"`
+	Ref       string         `json:"Ref"`
+	CommitSHA string         `json:"CommitSHA"`
+	Status    db.BuildStatus `json:"Status"`
+	Created   time.Time      `json:"Created"`
+}
+
+// buildStatuses are the statuses builds can be filtered by
+var buildStatuses = []db.BuildStatus{
+	db.BuildQueued,
+	db.BuildRunning,
+	db.BuildSuccess,
+	db.BuildFailed,
+	db.BuildError,
+	db.BuildAwaitingApproval,
+	db.BuildCanceled,
+}
+
+// parseTime parses t in RFC 3339 or as a date like 2006-01-02
+func parseTime(t string) (time.Time, error) {
+	if d, err := time.Parse("2006-01-02", t); err == nil {
+		return d, nil
+	}
+	return time.Parse(time.RFC3339, t)
+}
+
+// parseBuildQuery parses the query of builds from URL parameters:
+// status, since and until, within (builds created within a duration
+// like 24h), limit and cursor.
+func parseBuildQuery(v url.Values, now time.Time) (db.BuildQuery, error) {
+	var q db.BuildQuery
+	var err error
+	q.Status = db.BuildStatus(v.Get("status"))
+	if s := v.Get("since"); s != "" {
+		q.Since, err = parseTime(s)
+		if err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		q.Until, err = parseTime(s)
+		if err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("within"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return q, err
+		}
+		q.Since = now.Add(-d)
+	}
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			return q, err
+		}
+	}
+	q.Cursor = v.Get("cursor")
+	return q, nil
+}
+
+// queryBuilds returns builds queried by URL parameters of req, and the
+// cursor of the next page, empty if it is the last page.
+func (h *HTTPServer) queryBuilds(req *http.Request) ([]BuildWithStatus, string, error) {
+	q, err := parseBuildQuery(req.URL.Query(), time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := h.db.QueryBuilds(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bs := make([]BuildWithStatus, len(p.Builds))
+	for i, b := range p.Builds {
+		stat, err := b.Status()
+		if err != nil {
+			log.Println(b, err)
+		}
+		bs[i] = BuildWithStatus{ID: b.ID, Ref: b.Ref, CommitSHA: b.CommitSHA, Status: stat, Created: b.Created}
+	}
+	return bs, p.Next, nil
+}
+
+func (h *HTTPServer) buildListHandler(res http.ResponseWriter, req *http.Request) {
+	bs, cursor, err := h.queryBuilds(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the next page keeps the filters
+	v := req.URL.Query()
+	var next string
+	if cursor != "" {
+		v.Set("cursor", cursor)
+		next = "/builds?" + v.Encode()
+	}
+	h.render(res, req, "buildlist", map[string]interface{}{
+		"Builds":   bs,
+		"Next":     next,
+		"Statuses": buildStatuses,
+		"Status":   v.Get("status"),
+		"Since":    v.Get("since"),
+		"Until":    v.Get("until"),
+		"Within":   v.Get("within"),
+	})
+}
+
+func (h *HTTPServer) buildListAPIHandler(res http.ResponseWriter, req *http.Request) {
+	bs, cursor, err := h.queryBuilds(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dat, err := json.Marshal(struct {
+		Builds []BuildWithStatus
+		Next   string
+	}{
+		Builds: bs,
+		Next:   cursor,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_, err = res.Write(dat)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// SearchResult is an output line matching a search
+type SearchResult struct {
+	BuildID uint64 `json:"BuildID"`
+	Attempt uint64 `json:"Attempt"`
+	Line    uint64 `json:"Line"`
+	Content string `json:"Content"`
+}
+
+// searchOutput returns output lines matching URL parameter q of req,
+// at most URL parameter limit lines. The latest lines of running
+// builds are not found yet, see db.DB.SearchOutput.
+func (h *HTTPServer) searchOutput(req *http.Request) ([]SearchResult, error) {
+	limit := 0
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rs, err := h.db.SearchOutput(req.URL.Query().Get("q"), limit)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SearchResult, len(rs))
+	for i, r := range rs {
+		results[i] = SearchResult{BuildID: r.BuildID, Attempt: r.Attempt, Line: r.Line, Content: r.Str}
+	}
+	return results, nil
+}
+
+func (h *HTTPServer) searchHandler(res http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query().Get("q")
+	var results []SearchResult
+	var errMsg string
+	if q != "" {
+		var err error
+		results, err = h.searchOutput(req)
+		if err != nil {
+			errMsg = err.Error()
+		}
+	}
+
+	h.render(res, req, "search", map[string]interface{}{
+		"Query":   q,
+		"Results": results,
+		"Error":   errMsg,
+	})
+}
+
+func (h *HTTPServer) searchAPIHandler(res http.ResponseWriter, req *http.Request) {
+	results, err := h.searchOutput(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dat, err := json.Marshal(struct {
+		Results []SearchResult
+	}{
+		Results: results,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_, err = res.Write(dat)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// AttemptWithState attempt of a build with its state
+type AttemptWithState struct {
+	Num      uint64
+	Worker   string
+	Status   db.BuildStatus
+	Started  time.Time
+	Finished time.Time
+	Active   bool // whether the attempt is the one being shown
+}
+
 func (h *HTTPServer) buildsHandler(res http.ResponseWriter, req *http.Request) {
-	bidStr := path.Base(req.RequestURI)
-	bid, err := strconv.ParseUint(bidStr, 10, 64)
+	bid, err := strconv.ParseUint(mux.Vars(req)["buildID"], 10, 64)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -204,44 +638,288 @@ func (h *HTTPServer) buildsHandler(res http.ResponseWriter, req *http.Request) {
 		log.Panic(err)
 	}
 
+	as, err := b.Attempts()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// show the latest attempt unless one is specified
+	var num uint64
+	if len(as) > 0 {
+		num = as[len(as)-1].Num
+	}
+	if a := req.URL.Query().Get("attempt"); a != "" {
+		num, err = strconv.ParseUint(a, 10, 64)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	var tests []db.TestResult
+	var failures []FailedTest
+	attempts := make([]AttemptWithState, len(as))
+	for i, a := range as {
+		if a.Num == num {
+			tests, failures = testResults(a)
+		}
+		state, err := a.State()
+		if err != nil {
+			log.Println(a, err)
+		}
+		attempts[i] = AttemptWithState{
+			Num:      a.Num,
+			Worker:   a.Worker,
+			Status:   state.Status,
+			Started:  state.Started,
+			Finished: state.Finished,
+			Active:   a.Num == num,
+		}
+	}
+
+	artifacts, err := b.Artifacts()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	stat, err := b.Status()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	approval, approved, err := b.Approval()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cov, hasCoverage, err := b.Coverage()
+	if err != nil {
+		log.Panic(err)
+	}
+
 	h.render(res, req, "builds", map[string]interface{}{
-		"Head": b.CommitSHA,
-		"Ref":  b.Ref,
-		"Id":   b.ID,
+		"Head":      b.CommitSHA,
+		"Ref":       b.Ref,
+		"Id":        b.ID,
+		"PR":        b.PR,
+		"Awaiting":  stat == db.BuildAwaitingApproval,
+		"Approved":  approved,
+		"Approval":  approval,
+		"Attempt":   num,
+		"Attempts":  attempts,
+		"Artifacts": artifactLinks(artifacts),
+		"Tests":     db.SummarizeTests(tests),
+		"Failures":  failures,
+
+		"HasCoverage": hasCoverage,
+		"Coverage":    db.TotalCoverage(cov).Percent(),
 	})
 }
 
-func (h *HTTPServer) buildOutputHandler(res http.ResponseWriter, req *http.Request) {
-	id, err := strconv.ParseUint(req.URL.Query().Get("id"), 10, 64)
+// FailedTest is a failed test with its flakiness
+type FailedTest struct {
+	db.TestResult
+	Flaky bool
+	Score float64
+}
+
+// testResults returns test results and failed tests of attempt a
+func testResults(a db.Attempt) ([]db.TestResult, []FailedTest) {
+	rs, err := a.TestResults()
 	if err != nil {
 		log.Panic(err)
 	}
+	fs, err := a.FlakyFailures()
+	if err != nil {
+		log.Panic(err)
+	}
+	var failed []FailedTest
+	for _, r := range rs {
+		if r.Status != db.TestFailed {
+			continue
+		}
+		f := FailedTest{TestResult: r}
+		if len(fs) > 0 {
+			f.Flaky, f.Score = fs[0].Flaky(), fs[0].Score
+			fs = fs[1:]
+		}
+		failed = append(failed, f)
+	}
+	return rs, failed
+}
 
-	start, err := strconv.Atoi(req.URL.Query().Get("start"))
+// FileCoverageDelta is the coverage of a file with its change versus
+// the coverage of the file in the base build
+type FileCoverageDelta struct {
+	File           string
+	Covered, Total int
+	Percent        float64
+	Delta          float64
+	InBase         bool // whether the file is covered in the base build
+}
+
+func (h *HTTPServer) coverageHandler(res http.ResponseWriter, req *http.Request) {
+	bid, err := strconv.ParseUint(mux.Vars(req)["buildID"], 10, 64)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	end, err := strconv.Atoi(req.URL.Query().Get("end"))
+	b, err := h.db.Build(bid)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	b, err := h.db.Build(id)
+	fs, ok, err := b.Coverage()
 	if err != nil {
 		log.Panic(err)
 	}
 
-	output, err := b.Output(start, end)
+	base, baseFiles, hasBase, err := b.BaseCoverage()
 	if err != nil {
 		log.Panic(err)
 	}
+	baseCoverage := make(map[string]db.Coverage)
+	for _, f := range baseFiles {
+		baseCoverage[f.File] = f.Coverage
+	}
 
+	files := make([]FileCoverageDelta, len(fs))
+	for i, f := range fs {
+		files[i] = FileCoverageDelta{File: f.File, Covered: f.Covered, Total: f.Total, Percent: f.Percent()}
+		if c, ok := baseCoverage[f.File]; ok {
+			files[i].InBase = true
+			files[i].Delta = f.Percent() - c.Percent()
+		}
+	}
+
+	total := db.TotalCoverage(fs)
+	h.render(res, req, "coverage", map[string]interface{}{
+		"Id":          b.ID,
+		"Head":        b.CommitSHA,
+		"Ref":         b.Ref,
+		"HasCoverage": ok,
+		"Total":       total,
+		"Percent":     total.Percent(),
+		"HasBase":     hasBase,
+		"Base":        base,
+		"BaseBranch":  b.PR.Base,
+		"Delta":       total.Percent() - db.TotalCoverage(baseFiles).Percent(),
+		"Files":       files,
+	})
+}
+
+func (h *HTTPServer) flakyHandler(res http.ResponseWriter, req *http.Request) {
+	fs, err := h.db.FlakyTests()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	h.render(res, req, "flaky", map[string]interface{}{
+		"Tests": fs,
+	})
+}
+
+// approveFormHandler asks the maintainer to confirm approving a build
+func (h *HTTPServer) approveFormHandler(res http.ResponseWriter, req *http.Request) {
+	bid, err := strconv.ParseUint(mux.Vars(req)["buildID"], 10, 64)
+	if err != nil {
+		log.Panic(err)
+	}
+	b, err := h.db.Build(bid)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
 	stat, err := b.Status()
 	if err != nil {
 		log.Panic(err)
 	}
 
+	h.render(res, req, "approve", map[string]interface{}{
+		"Id":       b.ID,
+		"Head":     b.CommitSHA,
+		"PR":       b.PR,
+		"Awaiting": stat == db.BuildAwaitingApproval,
+		"CSRF":     h.csrfToken(req.URL.Path),
+	})
+}
+
+func (h *HTTPServer) approveHandler(res http.ResponseWriter, req *http.Request) {
+	bid, err := strconv.ParseUint(mux.Vars(req)["buildID"], 10, 64)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	b, err := h.db.Build(bid)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	user, _, _ := req.BasicAuth()
+	err = b.Approve(user)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Println("build", b.ID, "approved by", user)
+	// the approval is recorded, the main loop queues the build when
+	// it is free, the maintainer does not wait for it.
+	go func() {
+		h.eventQueue <- approveEvent{BuildID: bid, By: user}
+	}()
+	http.Redirect(res, req, fmt.Sprintf("/builds/%d", bid), http.StatusSeeOther)
+}
+
+func (h *HTTPServer) buildOutputHandler(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	start, err := strconv.Atoi(req.URL.Query().Get("start"))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	end, err := strconv.Atoi(req.URL.Query().Get("end"))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	b, err := h.db.Build(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var output []db.OutputLine
+	var stat db.BuildStatus
+	if a := req.URL.Query().Get("attempt"); a != "" && a != "0" {
+		num, err := strconv.ParseUint(a, 10, 64)
+		if err != nil {
+			log.Panic(err)
+		}
+		attempt, err := b.Attempt(num)
+		if err != nil {
+			log.Panic(err)
+		}
+		output, err = attempt.Output(start, end)
+		if err != nil {
+			log.Panic(err)
+		}
+		stat, err = attempt.Status()
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		output, err = b.Output(start, end)
+		if err != nil {
+			log.Panic(err)
+		}
+		stat, err = b.Status()
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
 	type line struct {
 		Content string `json:"Content"`
 		Channel int    `json:"Channel"`
@@ -269,3 +947,121 @@ func (h *HTTPServer) buildOutputHandler(res http.ResponseWriter, req *http.Reque
 		log.Panic(err)
 	}
 }
+
+// ArtifactLink is an artifact with its download link
+type ArtifactLink struct {
+	Name    string `json:"Name"`
+	SHA256  string `json:"SHA256"`
+	Size    int64  `json:"Size"`
+	Attempt uint64 `json:"Attempt"`
+	URL     string `json:"URL"`
+}
+
+func artifactLinks(as []db.Artifact) []ArtifactLink {
+	links := make([]ArtifactLink, len(as))
+	for i, a := range as {
+		links[i] = ArtifactLink{
+			Name:    a.Name,
+			SHA256:  a.SHA256,
+			Size:    a.Size,
+			Attempt: a.Attempt,
+			URL:     fmt.Sprintf("/artifacts/%s/%s", a.SHA256, url.PathEscape(path.Base(a.Name))),
+		}
+	}
+	return links
+}
+
+func (h *HTTPServer) buildArtifactsHandler(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	b, err := h.db.Build(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	as, err := b.Artifacts()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	dat, err := json.Marshal(struct {
+		Artifacts []ArtifactLink
+	}{
+		Artifacts: artifactLinks(as),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_, err = res.Write(dat)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (h *HTTPServer) artifactHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	f, err := h.artifacts.Open(vars["sha256"])
+	if os.IsNotExist(err) {
+		http.NotFound(res, req)
+		return
+	} else if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/octet-stream")
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": vars["name"]}))
+	http.ServeContent(res, req, vars["name"], fi.ModTime(), f)
+}
+
+// errWriter records whether anything is written, after which an error
+// can not be reported by the status code.
+type errWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (h *HTTPServer) backupHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/octet-stream")
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "ci.db"}))
+	w := &errWriter{ResponseWriter: res}
+	_, err := h.db.Backup(w)
+	if err != nil && !w.written {
+		res.Header().Del("Content-Disposition")
+		http.Error(res, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Println("backup:", err)
+	}
+}
+
+func (h *HTTPServer) exportHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "ci.jsonl"}))
+	w := &errWriter{ResponseWriter: res}
+	err := h.db.Export(w)
+	if err != nil && !w.written {
+		res.Header().Del("Content-Disposition")
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Println("export:", err)
+	}
+}
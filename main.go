@@ -4,18 +4,32 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"fmt"
 
+	"github.com/wangkuiyi/ci/artifact"
+	"github.com/wangkuiyi/ci/cache"
 	"github.com/wangkuiyi/ci/db"
 	"github.com/wangkuiyi/ci/github"
 	"github.com/wangkuiyi/ci/webhook"
+
+	// SQL database drivers of -db-driver
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 const (
 	buildDir = "./build"
+	// how often builds not kept by the retention policy are deleted
+	gcInterval = time.Hour
+	// a collaborator comments this on a pull request to approve its
+	// builds held for approval
+	approveCommand = "/ci approve"
 )
 
 // settings that user need to define
@@ -25,10 +39,68 @@ type setting struct {
 	Concurrency int
 	// The build environment can be anything. Such as OS=osx OS_VERSION=10.11
 	Env map[string]string
+	// Glob patterns of files to keep after build, relative to repository.
+	// Such as dist/*.whl
+	Artifacts []string
+	// Glob patterns of test reports written by the ci script, JUnit
+	// XML or the output of go test -json, relative to repository.
+	// Such as build/test-results/*.xml
+	TestReports []string
+	// Glob patterns of coverage reports written by the ci script, Go
+	// coverprofiles, Cobertura XML or lcov, relative to repository.
+	// Such as coverage.out
+	Coverage []string
+	// Caches saved after a successful build and restored before
+	// the following builds, such as downloaded dependencies.
+	Caches []cacheSetting
+	// Size limit of all caches in MB, 0 means no limit.
+	CacheSize int64
+	// Secrets are environment variables whose values are read from
+	// files. They are never echoed, withheld from pull requests
+	// from forks, and masked in build output.
+	Secrets map[string]string
+	// Policy of pull requests from forks of the repository
+	Forks struct {
+		// Run builds of pull requests from non-collaborators
+		// without approval of a maintainer
+		Autorun bool
+		// Pass secrets to builds of pull requests from forks
+		// once they are approved
+		Secrets bool
+	}
+	// Pipeline of release builds, which are triggered by pushing tags
+	// and publishing github releases
+	Release struct {
+		Filename string            // release script filename, the ci script if not set
+		Secrets  map[string]string // secrets passed to release builds only, such as tokens to publish packages
+	}
+	// Flaky tests both passed and failed on a commit, or flipped
+	// repeatedly on a branch
+	Flaky struct {
+		// Annotate failed statuses of pull requests with "failure
+		// likely flaky" if all failed tests are flaky
+		Annotate bool
+	}
+	// Retention policy of finished builds. A build is kept if any
+	// rule keeps it, the latest build of each ref is always kept.
+	// Builds are kept forever if no rule is set.
+	Retention struct {
+		KeepLast int // keep the last KeepLast builds of each ref
+		KeepDays int // keep builds younger than KeepDays days
+	}
+	// Filters of branches and changed files of pushes and pull
+	// requests triggering builds
+	Trigger triggerSetting
+	// Schedules trigger builds of branches periodically, such as
+	// nightly builds
+	Schedules []scheduleSetting
+	// Credential of maintainers on the website, required by actions
+	// like approving builds. These actions are disabled if not set.
+	Admin adminSetting
 	// repo settings
 	Github struct {
 		Description string // description for CI shown on github integration comment
-		Secret      string // github webhook secret
+		Secret      string // github webhook secret, deliveries not signed with it are rejected
 		Token       string // github personal token.
 		Owner       string // repository owner
 		Name        string // repository name
@@ -38,12 +110,58 @@ type setting struct {
 }
 
 func main() {
-	path := flag.String("db", "/data/ci.db", "path to db")
+	path := flag.String("db", "/data/ci.db", "path to db, or data source of the SQL database if -db-driver is set")
+	driver := flag.String("db-driver", "", "SQL database driver storing the db: sqlite or postgres, the db is stored in a BoltDB file if not set")
 	cfg := flag.String("config", "/data/ci.yaml", "configuration file")
 	port := flag.Int("port", 8000, "ci server port")
 	template := flag.String("template", "/templates", "ci server template directory")
+	artifactDir := flag.String("artifacts", "/data/artifacts", "directory to store build artifacts")
+	cacheDir := flag.String("cache", "/data/cache", "directory to store build caches")
+	dryRun := flag.Bool("migrate-dry-run", false, "print changes pending database migrations would make and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), commandUsage)
+	}
 	flag.Parse()
 
+	var err error
+	if *dryRun {
+		var reports []db.MigrationReport
+		if *driver == "" {
+			reports, err = db.DryRun(*path)
+		} else {
+			reports, err = db.DryRunSQL(*driver, *path)
+		}
+		if err != nil {
+			panic(err)
+		}
+		if len(reports) == 0 {
+			fmt.Println("database is up to date")
+		}
+		for _, r := range reports {
+			fmt.Printf("version %d: %s\n", r.Version, r.Description)
+			for _, c := range r.Changes {
+				fmt.Println("  " + c)
+			}
+		}
+		return
+	}
+
+	openDB := func() (*db.DB, error) {
+		if *driver == "" {
+			return db.Open(*path)
+		}
+		return db.OpenSQL(*driver, *path)
+	}
+	if flag.NArg() > 0 {
+		err = command(flag.Args(), openDB)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	setting := &setting{}
 	content, err := ioutil.ReadFile(*cfg)
 	if err != nil {
@@ -56,6 +174,10 @@ func main() {
 	if setting.Concurrency <= 0 {
 		log.Println(fmt.Sprintf("warning: concurrency set to %d, no build will run", setting.Concurrency))
 	}
+	if setting.Github.Secret == "" {
+		// unsigned deliveries could approve builds and push tags
+		panic("github.secret is required to verify webhook deliveries")
+	}
 	g := github.New(
 		setting.Github.Endpoint,
 		setting.Github.Description,
@@ -68,11 +190,26 @@ func main() {
 		panic(err)
 	}
 
-	d, err := db.Open(*path)
+	d, err := openDB()
 	if err != nil {
 		panic(err)
 	}
 
+	artifacts, err := artifact.NewStore(*artifactDir)
+	if err != nil {
+		panic(err)
+	}
+
+	caches, err := cache.NewStore(*cacheDir, setting.CacheSize<<20)
+	if err != nil {
+		panic(err)
+	}
+
+	go collectGarbage(d, artifacts, db.RetentionPolicy{
+		KeepLast: setting.Retention.KeepLast,
+		KeepFor:  time.Duration(setting.Retention.KeepDays) * 24 * time.Hour,
+	}, gcInterval)
+
 	buildChan := make(chan db.Build, 256)
 	pending, err := d.PendingBuilds()
 	if err != nil {
@@ -81,25 +218,96 @@ func main() {
 
 	go func() {
 		for _, b := range pending {
+			if s, err := b.Status(); err == nil && s == db.BuildAwaitingApproval {
+				continue
+			}
 			b.SetStatus(db.BuildQueued)
 			log.Println("queued build:", b.ID, b.Ref, b.CommitSHA)
 			buildChan <- b
 		}
 	}()
 
-	builder, err := newBuilder(buildChan, g, setting.Concurrency, buildDir, setting.Github.Filename, setting.Env)
+	cloneURL, err := g.CloneURL()
+	if err != nil {
+		panic(err)
+	}
+	builder, err := newBuilder(buildChan, g, cloneURL, artifacts, caches, buildDir, setting)
+	if err != nil {
+		panic(err)
+	}
 	builder.Start()
 
+	err = setting.Trigger.check()
+	if err != nil {
+		panic(err)
+	}
+
+	var crons []*cronSchedule
+	for _, s := range setting.Schedules {
+		if s.Name == "" || s.Branch == "" {
+			panic(fmt.Sprintf("schedule %q: name and branch are required", s.Name))
+		}
+		c, err := parseCron(s.Cron)
+		if err != nil {
+			panic(fmt.Sprintf("schedule %s: %v", s.Name, err))
+		}
+		crons = append(crons, c)
+	}
+
+	// unbuffered, so that webhook deliveries wait in the database
+	// rather than in memory until the main loop handles them
 	eventQueue := make(chan interface{})
-	serv := newHTTPServer(d, g, eventQueue, fmt.Sprintf(":%d", *port), *template, setting.Github.Owner, setting.Github.Name, setting.Github.Description)
+	serv := newHTTPServer(d, g, artifacts, eventQueue, fmt.Sprintf(":%d", *port), *template, setting.Github.Owner, setting.Github.Name, setting.Github.Description, setting.Github.Secret, setting.Admin)
 	go func() {
 		log.Println(serv.ListenAndServe())
 	}()
+	for i, c := range crons {
+		go runSchedule(setting.Schedules[i], c, eventQueue)
+	}
+
+	queueApproved := func(b db.Build) {
+		go func(b db.Build) {
+			log.Println("queued build", b.ID, b.Ref, b.CommitSHA)
+			buildChan <- b
+		}(b)
+	}
+	approve := func(b db.Build, by string) {
+		err := b.Approve(by)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Println("build", b.ID, "approved by", by)
+		queueApproved(b)
+	}
 
 	for ev := range eventQueue {
 		switch e := ev.(type) {
 		case webhook.PushEvent:
-			b, err := d.CreateBuild(db.Push, e.Repository.CloneURL, e.Ref, e.HeadCommit.ID)
+			if e.Deleted {
+				canceled, err := archiveRef(d, e.Ref)
+				if err != nil {
+					log.Println("archive", e.Ref, err)
+					continue
+				}
+				log.Println("archived deleted", e.Ref, "canceled builds", canceled)
+				continue
+			}
+			if reason := setting.Trigger.skipPush(e); reason != "" {
+				log.Println("skip push", e.Ref, e.HeadCommit.ID+":", reason)
+				continue
+			}
+			var b db.Build
+			if strings.HasPrefix(e.Ref, "refs/tags/") {
+				var ok bool
+				b, ok, err = createReleaseBuild(d, g, strings.TrimPrefix(e.Ref, "refs/tags/"), db.ReleaseInfo{})
+				if err != nil || !ok {
+					log.Println("skip build of tag", e.Ref, err)
+					continue
+				}
+			} else {
+				b, err = d.CreateBuild(db.Push, e.Repository.CloneURL, e.Ref, e.HeadCommit.ID)
+			}
 			if err != nil {
 				log.Println(err, e)
 				err = g.CreateStatus(e.HeadCommit.ID, github.Failure)
@@ -117,21 +325,193 @@ func main() {
 			if e.Action != "opened" && e.Action != "synchronize" {
 				continue
 			}
-			b, err := d.CreateBuild(db.PullRequest, e.PullRequest.Head.Repo.CloneURL, e.PullRequest.Head.Ref, e.PullRequest.Head.Sha)
+			reason, err := setting.Trigger.skipPullRequest(e, g.CommitMessage, g.PullRequestFiles)
+			if err != nil {
+				log.Println("filter pull request", e.Number, err)
+			}
+			if reason != "" {
+				log.Println("skip pull request", e.Number, e.PullRequest.Head.Sha+":", reason)
+				continue
+			}
+			// whether the pull request comes from a fork, which decides
+			// whether it gets secrets, is read through the github API
+			pr, err := g.PullRequest(e.Number)
+			if err != nil {
+				log.Println("pull request", e.Number, err)
+				continue
+			}
+			if pr.HeadSHA != e.PullRequest.Head.Sha {
+				log.Println("skip pull request", e.Number, e.PullRequest.Head.Sha+": head moved to", pr.HeadSHA)
+				continue
+			}
+			b, err := d.CreatePullRequestBuild(pr.CloneURL, pr.HeadRef, pr.HeadSHA, db.PullRequestInfo{
+				Number: e.Number,
+				Author: pr.Author,
+				Fork:   pr.Fork,
+				Base:   pr.Base,
+			})
 			if err != nil {
 				log.Println(err, e)
-				err = g.CreateStatus(e.PullRequest.Head.Sha, github.Failure)
+				err = g.CreateStatus(pr.HeadSHA, github.Failure)
 				if err != nil {
 					log.Println(err)
 				}
 				continue
 			}
 
+			held, err := needsApproval(g, setting, b.PR)
+			if err != nil {
+				log.Println(err)
+			}
+			if held {
+				b.SetStatus(db.BuildAwaitingApproval)
+				log.Println("build", b.ID, "of", b.PR.Author, "is awaiting approval")
+				err = g.CreateStatusWithDescription(b.CommitSHA, github.Pending, "Awaiting approval from a maintainer")
+				if err != nil {
+					log.Println(err)
+				}
+				continue
+			}
+
+			b.SetStatus(db.BuildQueued)
+			go func(b db.Build) {
+				log.Println("queued build", b.ID, b.Ref, b.CommitSHA)
+				buildChan <- b
+			}(b)
+		case webhook.ReleaseEvent:
+			if e.Action != "published" || e.Release.Draft {
+				continue
+			}
+			b, ok, err := createReleaseBuild(d, g, e.Release.TagName, db.ReleaseInfo{
+				Name:       e.Release.Name,
+				Prerelease: e.Release.Prerelease,
+			})
+			if err != nil || !ok {
+				log.Println("skip build of release", e.Release.TagName, err)
+				continue
+			}
 			b.SetStatus(db.BuildQueued)
 			go func(b db.Build) {
 				log.Println("queued build", b.ID, b.Ref, b.CommitSHA)
 				buildChan <- b
 			}(b)
+		case webhook.IssueCommentEvent:
+			if e.Action != "created" || e.Issue.PullRequest == nil || strings.TrimSpace(e.Comment.Body) != approveCommand {
+				continue
+			}
+			ok, err := g.IsCollaborator(e.Comment.User.Login)
+			if err != nil || !ok {
+				log.Println("ignore approval from", e.Comment.User.Login, err)
+				continue
+			}
+			bs, err := d.AwaitingBuilds()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			for _, b := range bs {
+				if b.PR.Number == e.Issue.Number {
+					approve(b, e.Comment.User.Login)
+				}
+			}
+		case scheduleEvent:
+			sha, err := g.BranchHead(e.Branch)
+			if err != nil {
+				log.Println("schedule", e.Name, err)
+				continue
+			}
+			cloneURL, err := g.CloneURL()
+			if err != nil {
+				log.Println("schedule", e.Name, err)
+				continue
+			}
+			b, err := d.CreateScheduledBuild(cloneURL, "refs/heads/"+e.Branch, sha, e.Name)
+			if err != nil {
+				log.Println(err, e)
+				continue
+			}
+			b.SetStatus(db.BuildQueued)
+			go func(b db.Build) {
+				log.Println("queued build", b.ID, b.Schedule, b.Ref, b.CommitSHA)
+				buildChan <- b
+			}(b)
+		case approveEvent:
+			// approved on the website, which has recorded the approval
+			b, err := d.Build(e.BuildID)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			queueApproved(b)
+		}
+	}
+}
+
+// archiveRef archives deleted branch or tag ref, builds of the ref not
+// started yet are canceled, returns ids of canceled builds.
+func archiveRef(d *db.DB, ref string) ([]uint64, error) {
+	types := []db.BuildType{db.Push, db.Scheduled}
+	if strings.HasPrefix(ref, "refs/tags/") {
+		types = []db.BuildType{db.Release}
+	}
+	var canceled []uint64
+	for _, t := range types {
+		ids, err := d.ArchiveRef(t, ref)
+		if err != nil {
+			return canceled, err
 		}
+		canceled = append(canceled, ids...)
+	}
+	return canceled, nil
+}
+
+// createReleaseBuild creates a release build of tag, ok is false if the
+// commit of the tag has a release build. Release builds get release
+// secrets, so the commit and the clone URL are resolved through the
+// github API rather than taken from the webhook.
+func createReleaseBuild(d *db.DB, g *github.API, tag string, info db.ReleaseInfo) (b db.Build, ok bool, err error) {
+	ref := "refs/tags/" + tag
+	sha, err := g.TagCommit(tag)
+	if err != nil {
+		return b, false, err
+	}
+	built, err := releaseBuilt(d, ref, sha)
+	if err != nil || built {
+		return b, false, err
+	}
+	cloneURL, err := g.CloneURL()
+	if err != nil {
+		return b, false, err
+	}
+	b, err = d.CreateReleaseBuild(cloneURL, ref, sha, info)
+	return b, err == nil, err
+}
+
+// releaseBuilt returns whether commit sha of tag ref has a release
+// build, so that publishing a release and pushing its tag build once.
+func releaseBuilt(d *db.DB, ref, sha string) (bool, error) {
+	bs, err := d.RefBuilds(db.Release, ref, 0, -1)
+	if err != nil {
+		return false, err
+	}
+	for _, b := range bs {
+		if b.CommitSHA == sha {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// needsApproval returns whether builds of pull request pr are held
+// until a maintainer approves them. Builds are held if the author
+// can not be checked.
+func needsApproval(g *github.API, s *setting, pr db.PullRequestInfo) (bool, error) {
+	if !pr.Fork || s.Forks.Autorun {
+		return false, nil
+	}
+	ok, err := g.IsCollaborator(pr.Author)
+	if err != nil {
+		return true, err
 	}
+	return !ok, nil
 }
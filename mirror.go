@@ -0,0 +1,223 @@
+// Bare mirrors of repositories shared by all build goroutines.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorTTL is how long a mirror is kept without being used, like the
+// mirror of a fork which sent a single pull request.
+const mirrorTTL = 14 * 24 * time.Hour
+
+// Mirrors keeps a bare mirror for each repository under dir. Builds
+// clone with --reference to a mirror and --dissociate, so only objects
+// missing in the mirror are downloaded, and builds do not depend on
+// the mirror once cloned.
+type Mirrors struct {
+	dir string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // mirror path to its lock
+}
+
+func newMirrors(dir string) (*Mirrors, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirrors{dir: dir, locks: make(map[string]*sync.Mutex)}, nil
+}
+
+// lock returns the lock of mirror p
+func (m *Mirrors) lock(p string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[p]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[p] = l
+	}
+	return l
+}
+
+// path returns the path of the mirror of cloneURL
+func (m *Mirrors) path(cloneURL string) string {
+	sum := sha256.Sum256([]byte(cloneURL))
+	return path.Join(m.dir, hex.EncodeToString(sum[:8])+".git")
+}
+
+// Update fetches the repository of cloneURL into its mirror, as well
+// as the submodules of commit sha into theirs. It returns the path of
+// the mirror and the paths of mirrors of submodules by the paths of
+// the submodules. If the mirror cannot be fetched but is intact, its
+// path is returned together with the error, so builds still borrow
+// objects from it. Mirrors not used for mirrorTTL are removed.
+func (m *Mirrors) Update(cloneURL, sha string) (string, map[string]string, error) {
+	defer m.evict()
+
+	p, err := m.update(cloneURL)
+	if p == "" {
+		return "", nil, err
+	}
+	// submodules are updated after the lock of p is released, a lock
+	// is never held while waiting for another one.
+	subs := make(map[string]string)
+	for sp, u := range submodules(p, cloneURL, sha) {
+		q, e := m.update(u)
+		if q != "" {
+			subs[sp] = q
+		} else {
+			log.Println("mirror submodule", sp, e)
+		}
+	}
+	return p, subs, err
+}
+
+// update fetches the repository of cloneURL into its mirror and
+// returns the path of the mirror. A mirror is cloned again only if it
+// is corrupt.
+func (m *Mirrors) update(cloneURL string) (string, error) {
+	p := m.path(cloneURL)
+	l := m.lock(p)
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := os.Stat(p); err == nil {
+		now := time.Now()
+		err = os.Chtimes(p, now, now) // the mirror is used, see evict
+		if err != nil {
+			return "", err
+		}
+		err = git("-C", p, "fetch", "--prune", "--quiet", "origin")
+		if err == nil {
+			return p, nil
+		}
+		// the remote may be unreachable, keep an intact mirror
+		if git("-C", p, "fsck", "--connectivity-only", "--no-dangling") == nil {
+			return p, err
+		}
+		log.Println("mirror", p, "of", cloneURL, "is corrupt, clone it again:", err)
+		err = os.RemoveAll(p)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := git("clone", "--mirror", "--quiet", "--", cloneURL, p)
+	if err != nil {
+		os.RemoveAll(p)
+		return "", err
+	}
+	return p, nil
+}
+
+// evict removes mirrors not used for mirrorTTL
+func (m *Mirrors) evict() {
+	ps, err := filepath.Glob(path.Join(m.dir, "*.git"))
+	if err != nil {
+		log.Println("evict mirrors", err)
+		return
+	}
+	stale := func(p string) bool {
+		fi, err := os.Stat(p)
+		return err == nil && time.Since(fi.ModTime()) > mirrorTTL
+	}
+	for _, p := range ps {
+		if !stale(p) {
+			continue
+		}
+		l := m.lock(p)
+		l.Lock()
+		// it may be used while waiting for the lock
+		if stale(p) {
+			log.Println("evict mirror", p)
+			err = os.RemoveAll(p)
+			if err != nil {
+				log.Println("evict mirror", p, err)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+// scpURL matches clone URLs in the scp-like syntax, like
+// git@github.com:owner/name.git
+var scpURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/]`)
+
+// submoduleURL resolves the URL u of a submodule of cloneURL like git
+// does. It returns false if u is not a network URL, so that a
+// repository can not make the ci mirror local files.
+func submoduleURL(cloneURL, u string) (string, bool) {
+	if strings.HasPrefix(u, "./") || strings.HasPrefix(u, "../") {
+		base, err := url.Parse(cloneURL)
+		if err != nil {
+			return "", false
+		}
+		base.Path = path.Join(base.Path, u)
+		return base.String(), true
+	}
+	for _, s := range []string{"https://", "http://", "git://", "ssh://"} {
+		if strings.HasPrefix(u, s) {
+			return u, true
+		}
+	}
+	return u, scpURL.MatchString(u)
+}
+
+// submodules returns the URLs of submodules of commit sha in mirror p
+// of cloneURL by their paths. Submodules whose paths can not be passed
+// to scripts or URLs are not network URLs are left out.
+func submodules(p, cloneURL, sha string) map[string]string {
+	out, err := exec.Command("git", "-C", p, "config", "-z", "--blob", sha+":.gitmodules",
+		"--get-regexp", `^submodule\..*\.(path|url)$`).Output()
+	if err != nil {
+		// no .gitmodules, or sha is not fetched yet
+		return nil
+	}
+	paths := make(map[string]string) // name to path
+	urls := make(map[string]string)  // name to URL
+	for _, kv := range bytes.Split(out, []byte{0}) {
+		i := bytes.IndexByte(kv, '\n')
+		if i < 0 {
+			continue
+		}
+		k, v := strings.TrimPrefix(string(kv[:i]), "submodule."), string(kv[i+1:])
+		if strings.HasSuffix(k, ".path") {
+			paths[strings.TrimSuffix(k, ".path")] = v
+		} else {
+			urls[strings.TrimSuffix(k, ".url")] = v
+		}
+	}
+	subs := make(map[string]string)
+	for name, sp := range paths {
+		if sp == "" || strings.HasPrefix(sp, "-") || strings.ContainsAny(sp, "\x00\t\r\n") {
+			continue
+		}
+		u, ok := submoduleURL(cloneURL, urls[name])
+		if ok && !strings.HasPrefix(u, "-") {
+			subs[sp] = u
+		}
+	}
+	return subs
+}
+
+func git(args ...string) error {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %v: %v: %s", args, err, out)
+	}
+	return nil
+}
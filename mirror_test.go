@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+// gitEnv lets tests commit and use submodules of local repositories
+func gitEnv(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip(err)
+	}
+	for k, v := range map[string]string{
+		"GIT_AUTHOR_NAME":     "ci",
+		"GIT_AUTHOR_EMAIL":    "ci@localhost",
+		"GIT_COMMITTER_NAME":  "ci",
+		"GIT_COMMITTER_EMAIL": "ci@localhost",
+		"GIT_CONFIG_COUNT":    "1",
+		"GIT_CONFIG_KEY_0":    "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0":  "always",
+	} {
+		t.Setenv(k, v)
+	}
+}
+
+func mustGit(t *testing.T, args ...string) string {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatal(args, err, string(out))
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newRepo creates a repository at dir with a commit, returns its SHA
+func newRepo(t *testing.T, dir string) string {
+	mustGit(t, "init", "-q", dir)
+	mustGit(t, "-C", dir, "commit", "-q", "--allow-empty", "-m", "init")
+	return mustGit(t, "-C", dir, "rev-parse", "HEAD")
+}
+
+func TestMirrorsUpdate(t *testing.T) {
+	gitEnv(t)
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := path.Join(dir, "origin")
+	newRepo(t, origin)
+	m, err := newMirrors(path.Join(dir, "mirrors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, subs, err := m.Update(origin, "HEAD")
+	if err != nil || len(subs) != 0 {
+		t.Fatal(subs, err)
+	}
+
+	mustGit(t, "-C", origin, "commit", "-q", "--allow-empty", "-m", "second")
+	sha := mustGit(t, "-C", origin, "rev-parse", "HEAD")
+	if q, _, err := m.Update(origin, sha); err != nil || q != p {
+		t.Fatal(q, err)
+	}
+	if got := mustGit(t, "-C", p, "rev-parse", "HEAD"); got != sha {
+		t.Fatal(got)
+	}
+
+	// an unreachable remote keeps the mirror
+	err = os.Rename(origin, origin+".moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _, err := m.Update(origin, sha); err == nil || q != p {
+		t.Fatal(q, err)
+	}
+	if got := mustGit(t, "-C", p, "rev-parse", "HEAD"); got != sha {
+		t.Fatal(got)
+	}
+
+	// a corrupt mirror is cloned again
+	err = os.Rename(origin+".moved", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll(path.Join(p, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(path.Join(p, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _, err := m.Update(origin, sha); err != nil || q != p {
+		t.Fatal(q, err)
+	}
+	if got := mustGit(t, "-C", p, "rev-parse", "HEAD"); got != sha {
+		t.Fatal(got)
+	}
+}
+
+func TestMirrorsSubmodules(t *testing.T) {
+	gitEnv(t)
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub := path.Join(dir, "sub")
+	subSHA := newRepo(t, sub)
+	super := path.Join(dir, "super")
+	newRepo(t, super)
+	mustGit(t, "-C", super, "submodule", "add", "-q", "../sub", "lib/sub")
+	// a local path is never mirrored
+	mustGit(t, "-C", super, "config", "-f", ".gitmodules", "submodule.local.path", "local")
+	mustGit(t, "-C", super, "config", "-f", ".gitmodules", "submodule.local.url", sub)
+	mustGit(t, "-C", super, "commit", "-q", "-am", "add submodules")
+	sha := mustGit(t, "-C", super, "rev-parse", "HEAD")
+
+	m, err := newMirrors(path.Join(dir, "mirrors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, subs, err := m.Update(super, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs["lib/sub"] != m.path(sub) {
+		t.Fatal(subs)
+	}
+
+	// the clone script borrows objects from the mirrors and dissociates
+	b, err := newBuilder(nil, nil, "", nil, nil, path.Join(dir, "build"), &setting{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var script bytes.Buffer
+	err = b.pushEventCloneTpl.Execute(&script, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := db.Build{Ref: mustGit(t, "-C", super, "symbolic-ref", "HEAD"), CloneURL: super, CommitSHA: sha}
+	cmd := exec.Command("bash", "-e", "-c", script.String())
+	cmd.Env = append(os.Environ(), scriptEnv(build, dir, p, subs, "ci.sh")...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out), err)
+	}
+	repo := path.Join(dir, "repo")
+	if got := mustGit(t, "-C", path.Join(repo, "lib", "sub"), "rev-parse", "HEAD"); got != subSHA {
+		t.Fatal(got)
+	}
+	for _, f := range []string{".git/objects/info/alternates", ".git/modules/lib/sub/objects/info/alternates"} {
+		if _, err := os.Stat(path.Join(repo, f)); !os.IsNotExist(err) {
+			t.Fatal(f, err)
+		}
+	}
+
+	// builds fall back to a plain clone if the mirror is broken
+	err = os.RemoveAll(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("bash", "-e", "-c", script.String())
+	cmd.Env = append(os.Environ(), scriptEnv(build, dir, path.Join(dir, "not-exist"), nil, "ci.sh")...)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out), err)
+	}
+	if got := mustGit(t, "-C", repo, "rev-parse", "HEAD"); got != sha {
+		t.Fatal(got)
+	}
+}
+
+func TestMirrorsEvict(t *testing.T) {
+	gitEnv(t)
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := path.Join(dir, "a"), path.Join(dir, "b")
+	newRepo(t, a)
+	newRepo(t, b)
+	m, err := newMirrors(path.Join(dir, "mirrors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa, _, err := m.Update(a, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-mirrorTTL - time.Hour)
+	err = os.Chtimes(pa, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, _, err := m.Update(b, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pa); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pb); err != nil {
+		t.Fatal(err)
+	}
+}
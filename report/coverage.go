@@ -0,0 +1,203 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CoverageFile is the coverage of a source file, counted in statements
+// for Go coverprofiles and in lines for other formats
+type CoverageFile struct {
+	File           string
+	Covered, Total int
+}
+
+// block is a line or a block of statements of a file
+type block struct {
+	n       int // number of statements
+	covered bool
+}
+
+// Coverage merges coverage reports of Go coverprofiles, Cobertura XML
+// and lcov, a line or a block is covered if any report covers it. The
+// zero value is an empty coverage.
+type Coverage struct {
+	// Root is the directory of the repository, files named by paths
+	// under Root are recorded relative to it, so that a file has the
+	// same name in the reports of every build workspace.
+	Root string
+
+	files map[string]map[string]*block
+}
+
+// name normalizes file name to a slash separated path, relative to
+// Root if it is under Root.
+func (c *Coverage) name(file string) string {
+	file = path.Clean(filepath.ToSlash(file))
+	if c.Root == "" {
+		return file
+	}
+	root := path.Clean(filepath.ToSlash(c.Root))
+	if strings.HasPrefix(file, root+"/") {
+		return file[len(root)+1:]
+	}
+	return file
+}
+
+func (c *Coverage) add(file, key string, n int, covered bool) {
+	file = c.name(file)
+	if c.files == nil {
+		c.files = make(map[string]map[string]*block)
+	}
+	blocks := c.files[file]
+	if blocks == nil {
+		blocks = make(map[string]*block)
+		c.files[file] = blocks
+	}
+	b := blocks[key]
+	if b == nil {
+		b = &block{n: n}
+		blocks[key] = b
+	}
+	b.covered = b.covered || covered
+}
+
+// Parse parses a coverage report from r and merges it into c, the
+// format is detected from the content.
+func (c *Coverage) Parse(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("mode:")):
+		return c.parseGo(trimmed)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return c.parseCobertura(trimmed)
+	case bytes.Contains(trimmed, []byte("SF:")):
+		return c.parseLcov(trimmed)
+	}
+	return errors.New("unknown coverage format, expect Go coverprofile, Cobertura XML or lcov")
+}
+
+// parseGo parses a Go coverprofile, lines are like
+// file.go:12.3,14.5 2 1, which are the block, the number of statements
+// and the count.
+func (c *Coverage) parseGo(data []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return errors.New("invalid coverprofile line: " + line)
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) != 3 {
+			return errors.New("invalid coverprofile line: " + line)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return err
+		}
+		// packages outside GOPATH and modules are named like
+		// _/abs/dir, which is the absolute path of the directory
+		file := line[:i]
+		if strings.HasPrefix(file, "_/") {
+			file = file[1:]
+		}
+		c.add(file, fields[0], n, count > 0)
+	}
+	return s.Err()
+}
+
+type cobertura struct {
+	Sources []string `xml:"sources>source"`
+	Classes []struct {
+		Filename string `xml:"filename,attr"`
+		Lines    []struct {
+			Number int   `xml:"number,attr"`
+			Hits   int64 `xml:"hits,attr"`
+		} `xml:"lines>line"`
+	} `xml:"packages>package>classes>class"`
+}
+
+func (c *Coverage) parseCobertura(data []byte) error {
+	var cov cobertura
+	err := xml.Unmarshal(data, &cov)
+	if err != nil {
+		return err
+	}
+	for _, class := range cov.Classes {
+		file := class.Filename
+		// file names are relative to a source directory, which is
+		// usually an absolute path of the workspace
+		if !path.IsAbs(filepath.ToSlash(file)) && len(cov.Sources) > 0 {
+			file = path.Join(filepath.ToSlash(strings.TrimSpace(cov.Sources[0])), filepath.ToSlash(file))
+		}
+		for _, l := range class.Lines {
+			c.add(file, strconv.Itoa(l.Number), 1, l.Hits > 0)
+		}
+	}
+	return nil
+}
+
+// parseLcov parses lcov tracefiles, a file starts with SF:<file>, and
+// each line is DA:<line>,<hits>.
+func (c *Coverage) parseLcov(data []byte) error {
+	var file string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			file = line[len("SF:"):]
+		case strings.HasPrefix(line, "DA:"):
+			fields := strings.Split(line[len("DA:"):], ",")
+			if file == "" || len(fields) < 2 {
+				return errors.New("invalid lcov line: " + line)
+			}
+			hits, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			c.add(file, fields[0], 1, hits > 0)
+		case line == "end_of_record":
+			file = ""
+		}
+	}
+	return s.Err()
+}
+
+// Files returns coverage of files, sorted by file name
+func (c *Coverage) Files() []CoverageFile {
+	var fs []CoverageFile
+	for name, blocks := range c.files {
+		f := CoverageFile{File: name}
+		for _, b := range blocks {
+			f.Total += b.n
+			if b.covered {
+				f.Covered += b.n
+			}
+		}
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].File < fs[j].File })
+	return fs
+}
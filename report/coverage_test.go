@@ -0,0 +1,116 @@
+package report_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wangkuiyi/ci/report"
+)
+
+func TestCoverage(t *testing.T) {
+	const goProfile = `mode: set
+example.com/a/a.go:3.10,5.2 2 1
+example.com/a/a.go:7.10,9.2 3 0
+example.com/a/b.go:3.10,5.2 1 0
+`
+	// covers the block of b.go left uncovered by the profile above
+	const goProfile2 = `mode: count
+example.com/a/b.go:3.10,5.2 1 4
+`
+	const cobertura = `<?xml version="1.0" ?>
+<coverage line-rate="0.5">
+  <packages>
+    <package name="pkg">
+      <classes>
+        <class name="m" filename="pkg/m.py">
+          <lines>
+            <line number="1" hits="1"/>
+            <line number="2" hits="0"/>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`
+	const lcov = `TN:
+SF:src/x.js
+DA:1,1
+DA:2,0
+DA:3,5
+LF:3
+LH:2
+end_of_record
+`
+
+	var c report.Coverage
+	for _, r := range []string{goProfile, goProfile2, cobertura, lcov} {
+		err := c.Parse(strings.NewReader(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []report.CoverageFile{
+		{File: "example.com/a/a.go", Covered: 2, Total: 5},
+		{File: "example.com/a/b.go", Covered: 1, Total: 1},
+		{File: "pkg/m.py", Covered: 1, Total: 2},
+		{File: "src/x.js", Covered: 2, Total: 3},
+	}
+	if fs := c.Files(); !reflect.DeepEqual(fs, want) {
+		t.Fatal(fs)
+	}
+
+	err := c.Parse(strings.NewReader("ok  example.com/a 0.1s coverage: 40.0% of statements"))
+	if err == nil {
+		t.Fatal("parsed a coverage report of unknown format")
+	}
+}
+
+func TestCoverageRoot(t *testing.T) {
+	const goProfile = `mode: set
+_/ws/1/repo/a.go:3.10,5.2 2 1
+example.com/a/b.go:3.10,5.2 1 0
+`
+	const cobertura = `<?xml version="1.0" ?>
+<coverage line-rate="0.5">
+  <sources>
+    <source>/ws/1/repo/src</source>
+  </sources>
+  <packages>
+    <package name="pkg">
+      <classes>
+        <class name="m" filename="pkg/m.py">
+          <lines>
+            <line number="1" hits="1"/>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`
+	const lcov = `SF:/ws/1/repo/src/../x.js
+DA:1,1
+end_of_record
+SF:/ws/1/other/y.js
+DA:1,0
+end_of_record
+`
+
+	c := report.Coverage{Root: "/ws/1/repo/"}
+	for _, r := range []string{goProfile, cobertura, lcov} {
+		err := c.Parse(strings.NewReader(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []report.CoverageFile{
+		{File: "/ws/1/other/y.js", Covered: 0, Total: 1},
+		{File: "a.go", Covered: 2, Total: 2},
+		{File: "example.com/a/b.go", Covered: 0, Total: 1},
+		{File: "src/pkg/m.py", Covered: 1, Total: 1},
+		{File: "x.js", Covered: 1, Total: 1},
+	}
+	if fs := c.Files(); !reflect.DeepEqual(fs, want) {
+		t.Fatal(fs)
+	}
+}
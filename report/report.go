@@ -0,0 +1,205 @@
+// Package report parses reports written by test runners: test
+// reports, JUnit XML and the JSON output of go test -json, into results
+// of test cases, and coverage reports into coverage of source files.
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Status is the result of a test case
+type Status string
+
+// Statuses of test cases, a JUnit error counts as a failure
+const (
+	Passed  Status = "passed"
+	Failed  Status = "failed"
+	Skipped Status = "skipped"
+)
+
+// maxMessage is the size limit of messages, longer messages keep their
+// end, where test runners usually print the cause of a failure.
+const maxMessage = 16 << 10
+
+// Case is the result of a test case
+type Case struct {
+	Suite    string // test suite of JUnit or package of go test
+	Name     string
+	Status   Status
+	Duration time.Duration
+	Message  string // failure message or skip reason
+}
+
+// Parse parses a test report from r, the format is detected from the
+// content: JUnit XML starts with '<', otherwise the report is taken as
+// go test JSON.
+func Parse(r io.Reader) ([]Case, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	if trimmed[0] == '<' {
+		return parseJUnit(trimmed)
+	}
+	return parseGoTest(trimmed)
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (m *junitMessage) String() string {
+	msg := strings.TrimSpace(m.Message)
+	text := strings.TrimSpace(m.Text)
+	if msg == "" || strings.Contains(text, msg) {
+		return text
+	}
+	if text == "" {
+		return msg
+	}
+	return msg + "\n" + text
+}
+
+// parseJUnit parses a JUnit XML report, the root element is either
+// testsuites or testsuite.
+func parseJUnit(data []byte) ([]Case, error) {
+	var root junitSuite
+	err := xml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+	var cases []Case
+	var walk func(s junitSuite)
+	walk = func(s junitSuite) {
+		for _, tc := range s.Cases {
+			c := Case{Suite: tc.Classname, Name: tc.Name, Status: Passed}
+			if c.Suite == "" {
+				c.Suite = s.Name
+			}
+			if sec, err := strconv.ParseFloat(strings.Replace(tc.Time, ",", "", -1), 64); err == nil {
+				c.Duration = time.Duration(sec * float64(time.Second))
+			}
+			switch {
+			case tc.Failure != nil:
+				c.Status, c.Message = Failed, tc.Failure.String()
+			case tc.Error != nil:
+				c.Status, c.Message = Failed, tc.Error.String()
+			case tc.Skipped != nil:
+				c.Status, c.Message = Skipped, tc.Skipped.String()
+			}
+			c.Message = truncate(c.Message)
+			cases = append(cases, c)
+		}
+		for _, sub := range s.Suites {
+			walk(sub)
+		}
+	}
+	walk(root)
+	return cases, nil
+}
+
+// goTestEvent is a line of go test -json output, see go doc test2json
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64 // seconds
+	Output  string
+}
+
+// parseGoTest parses the output of go test -json, lines which are not
+// JSON, like those printed by the ci script around go test, are
+// skipped.
+func parseGoTest(data []byte) ([]Case, error) {
+	type key struct{ pkg, test string }
+	var cases []Case
+	events := 0
+	output := make(map[key]*strings.Builder)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var e goTestEvent
+		if json.Unmarshal(line, &e) != nil || e.Action == "" {
+			continue
+		}
+		events++
+		if e.Test == "" {
+			continue
+		}
+		k := key{e.Package, e.Test}
+		c := Case{Suite: e.Package, Name: e.Test, Duration: time.Duration(e.Elapsed * float64(time.Second))}
+		switch e.Action {
+		case "output":
+			if output[k] == nil {
+				output[k] = &strings.Builder{}
+			}
+			output[k].WriteString(e.Output)
+			continue
+		case "pass":
+			c.Status = Passed
+		case "fail":
+			c.Status = Failed
+		case "skip":
+			c.Status = Skipped
+		default:
+			continue
+		}
+		if c.Status != Passed && output[k] != nil {
+			c.Message = truncate(strings.TrimSpace(output[k].String()))
+		}
+		delete(output, k)
+		cases = append(cases, c)
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	if events == 0 {
+		return nil, errors.New("unknown test report format, expect JUnit XML or go test -json output")
+	}
+	return cases, nil
+}
+
+func truncate(s string) string {
+	if len(s) <= maxMessage {
+		return s
+	}
+	i := len(s) - maxMessage
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+	return "..." + s[i:]
+}
@@ -0,0 +1,82 @@
+package report_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/report"
+)
+
+func TestParseJUnit(t *testing.T) {
+	const xml = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="pkg.Suite" tests="4">
+    <testcase classname="pkg.Suite" name="testPass" time="0.5"/>
+    <testcase classname="pkg.Suite" name="testFail" time="1.25">
+      <failure message="expected 1 got 2" type="AssertionError">Traceback
+  at pkg.Suite.testFail</failure>
+    </testcase>
+    <testcase name="testError" time="0">
+      <error message="boom"/>
+    </testcase>
+    <testcase classname="pkg.Suite" name="testSkip">
+      <skipped message="not on linux"/>
+    </testcase>
+  </testsuite>
+</testsuites>`
+
+	cases, err := report.Parse(strings.NewReader(xml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []report.Case{
+		{Suite: "pkg.Suite", Name: "testPass", Status: report.Passed, Duration: 500 * time.Millisecond},
+		{Suite: "pkg.Suite", Name: "testFail", Status: report.Failed, Duration: 1250 * time.Millisecond, Message: "expected 1 got 2\nTraceback\n  at pkg.Suite.testFail"},
+		{Suite: "pkg.Suite", Name: "testError", Status: report.Failed, Message: "boom"},
+		{Suite: "pkg.Suite", Name: "testSkip", Status: report.Skipped, Message: "not on linux"},
+	}
+	if len(cases) != len(want) {
+		t.Fatal(cases)
+	}
+	for i := range want {
+		if cases[i] != want[i] {
+			t.Fatalf("case %d: %+v, want %+v", i, cases[i], want[i])
+		}
+	}
+}
+
+func TestParseGoTest(t *testing.T) {
+	const out = `go test -json ./...
+{"Action":"run","Package":"example.com/a","Test":"TestOK"}
+{"Action":"output","Package":"example.com/a","Test":"TestOK","Output":"=== RUN   TestOK\n"}
+{"Action":"pass","Package":"example.com/a","Test":"TestOK","Elapsed":0.01}
+{"Action":"run","Package":"example.com/a","Test":"TestBad"}
+{"Action":"output","Package":"example.com/a","Test":"TestBad","Output":"=== RUN   TestBad\n"}
+{"Action":"output","Package":"example.com/a","Test":"TestBad","Output":"    a_test.go:9: want 1\n"}
+{"Action":"output","Package":"example.com/a","Test":"TestBad","Output":"--- FAIL: TestBad (0.02s)\n"}
+{"Action":"fail","Package":"example.com/a","Test":"TestBad","Elapsed":0.02}
+{"Action":"fail","Package":"example.com/a","Elapsed":0.03}
+`
+
+	cases, err := report.Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 {
+		t.Fatal(cases)
+	}
+	if c := cases[0]; c.Name != "TestOK" || c.Status != report.Passed || c.Message != "" || c.Duration != 10*time.Millisecond {
+		t.Fatal(c)
+	}
+	if c := cases[1]; c.Suite != "example.com/a" || c.Status != report.Failed || !strings.Contains(c.Message, "a_test.go:9: want 1") {
+		t.Fatal(c)
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	_, err := report.Parse(strings.NewReader("PASS\nok example.com/a\n"))
+	if err == nil {
+		t.Fatal("parsed a report of unknown format")
+	}
+}
@@ -0,0 +1,158 @@
+// Triggering builds on cron schedules.
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleSetting declares builds of a branch triggered periodically,
+// such as nightly builds
+type scheduleSetting struct {
+	Name   string // name of the schedule, passed to ci scripts as CI_SCHEDULE
+	Cron   string // cron expression in the local time of the server, like "0 2 * * *"
+	Branch string // branch to build
+}
+
+// scheduleEvent is sent to the event queue when a schedule fires
+type scheduleEvent struct {
+	Name   string
+	Branch string
+}
+
+// cronSchedule is a parsed cron expression, each field is a bit set of
+// the values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// standard cron matches a day if either day of month or day of
+	// week matches when both are restricted
+	domStar, dowStar bool
+}
+
+// cronMacros are shorthands of cron expressions
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+}
+
+// parseCron parses a cron expression of five fields: minute, hour,
+// day of month, month and day of week. A field is *, a value, a range
+// like 1-5, or a list of them like 1,3,5, optionally followed by a
+// step like */15. Day of week 0 and 7 are Sunday.
+func parseCron(spec string) (*cronSchedule, error) {
+	if m, ok := cronMacros[strings.TrimSpace(spec)]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q: expect 5 fields", spec)
+	}
+	c := &cronSchedule{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	bounds := []struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", spec, err)
+		}
+		*sets[i] = set
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step: %q", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(r[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value: %q", part)
+			}
+			hi = lo
+			if len(r) == 2 {
+				hi, err = strconv.Atoi(r[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value: %q", part)
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 to the end every 15
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range [%d, %d]: %q", min, max, part)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t matching the schedule, it
+// returns the zero time if nothing matches within 5 years, e.g., on
+// February 30th.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runSchedule sends a scheduleEvent of s to ch whenever s fires
+func runSchedule(s scheduleSetting, c *cronSchedule, ch chan<- interface{}) {
+	for {
+		next := c.next(time.Now())
+		if next.IsZero() {
+			log.Println("schedule", s.Name, "never fires")
+			return
+		}
+		time.Sleep(time.Until(next))
+		log.Println("schedule", s.Name, "fired")
+		ch <- scheduleEvent{Name: s.Name, Branch: s.Branch}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{
+		"0 2 * * *",
+		"*/15 * * * *",
+		"0 9-17 * * 1-5",
+		"30 4 1,15 * 0",
+		"5/20 * * * 7",
+		"@weekly",
+	} {
+		_, err := parseCron(spec)
+		if err != nil {
+			t.Fatal(spec, err)
+		}
+	}
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@never",
+	} {
+		_, err := parseCron(spec)
+		if err == nil {
+			t.Fatal(spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, c := range []struct {
+		spec, now, next string
+	}{
+		{"0 2 * * *", "2026-10-19 01:59", "2026-10-19 02:00"},
+		{"0 2 * * *", "2026-10-19 02:00", "2026-10-20 02:00"},
+		{"*/15 * * * *", "2026-10-19 10:07", "2026-10-19 10:15"},
+		{"*/15 * * * *", "2026-10-19 23:59", "2026-10-20 00:00"},
+		// Sunday, 0 and 7 alike
+		{"0 3 * * 0", "2026-10-19 12:00", "2026-10-25 03:00"},
+		{"0 3 * * 7", "2026-10-19 12:00", "2026-10-25 03:00"},
+		// weekdays from 9 to 17
+		{"30 9-17 * * 1-5", "2026-10-23 17:31", "2026-10-26 09:30"},
+		// day of month or day of week when both are restricted
+		{"0 0 1 * 1", "2026-10-19 12:00", "2026-10-26 00:00"},
+		{"0 0 1 * 1", "2026-10-27 12:00", "2026-11-01 00:00"},
+		{"@monthly", "2026-12-15 00:00", "2027-01-01 00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 30 2 *", "2026-03-01 00:00", "0001-01-01 00:00"},
+	} {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.next(at(c.now)); !got.Equal(at(c.next)) {
+			t.Fatalf("%s after %s: %s, want %s", c.spec, c.now, got, c.next)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Passing values from webhooks and settings into generated scripts.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+// shellQuote quotes s as a single word for bash, so that no character
+// of s is interpreted by the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// scriptEnv returns environment variables through which generated
+// scripts read values of the build. The values are never spliced into
+// scripts, scripts refer to them as quoted variables like "$CI_REF".
+// Mirrors of submodules are passed in CI_SUBMODULE_MIRRORS, a line of
+// the submodule path and the mirror path separated by a tab for each.
+func scriptEnv(build db.Build, buildPath, mirror string, subMirrors map[string]string, ciPath string) []string {
+	var subs []string
+	for p, m := range subMirrors {
+		subs = append(subs, p+"\t"+m)
+	}
+	sort.Strings(subs)
+	return []string{
+		"CI_BUILD_PATH=" + buildPath,
+		"CI_CLONE_URL=" + build.CloneURL,
+		"CI_REF=" + build.Ref,
+		"CI_HEAD=" + build.CommitSHA,
+		"CI_MIRROR=" + mirror,
+		"CI_SUBMODULE_MIRRORS=" + strings.Join(subs, "\n"),
+		"CI_SCRIPT=" + ciPath,
+		"CI_SCHEDULE=" + build.Schedule,
+		"CI_TAG=" + build.Tag(),
+		"CI_RELEASE=" + build.Release.Name,
+	}
+}
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// checkBuild rejects builds whose values, which come from webhooks,
+// could be taken as command line options by git or can not be passed
+// as environment variables.
+func checkBuild(build db.Build) error {
+	if !commitSHA.MatchString(build.CommitSHA) {
+		return fmt.Errorf("invalid commit SHA: %q", build.CommitSHA)
+	}
+	for _, v := range []string{build.Ref, build.CloneURL} {
+		if v == "" || strings.HasPrefix(v, "-") || strings.ContainsAny(v, "\x00\r\n") {
+			return fmt.Errorf("invalid ref or clone URL: %q", v)
+		}
+	}
+	if strings.ContainsRune(build.Release.Name, 0) {
+		return fmt.Errorf("invalid release name: %q", build.Release.Name)
+	}
+	return nil
+}
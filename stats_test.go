@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChart(t *testing.T) {
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ds := []DayStats{{Day: "2020-01-02"}}
+	ds[0].Builds, ds[0].Success, ds[0].MedianDuration = 4, 3, 60
+
+	for _, days := range []int{1, defaultStatsDays, maxStatsDays} {
+		c := chart(ds, since, days)
+		if len(c.Bars) != days {
+			t.Fatal(days, len(c.Bars))
+		}
+		for i, b := range c.Bars {
+			if b.Width <= 0 || b.X < 0 || b.X+b.Width > chartWidth {
+				t.Fatal(days, i, b)
+			}
+			if i > 0 && b.X < c.Bars[i-1].X+c.Bars[i-1].Width {
+				t.Fatal(days, i, b)
+			}
+		}
+		if days > 1 {
+			b := c.Bars[1]
+			if b.PassHeight != chartHeight*3/4 || b.FailHeight != chartHeight/4 || c.Durations == "" {
+				t.Fatal(days, b, c.Durations)
+			}
+		}
+	}
+}
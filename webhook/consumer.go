@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	consumeBatch = 32          // pending deliveries loaded at a time
+	pollInterval = time.Second // for deliveries pending without waking Run up, like replayed ones
+	retryDelay   = 5 * time.Second
+)
+
+// Stats are metrics of webhook ingestion. Pending deliveries piling up
+// and a large Blocked mean the event channel is consumed slowly.
+type Stats struct {
+	Accepted  uint64        // deliveries accepted since the receiver started
+	Processed uint64        // deliveries whose events are sent to the event channel
+	Pending   int           // deliveries waiting to be processed
+	Blocked   time.Duration // total time waiting for the event channel to accept events
+	Latency   time.Duration // time from receiving to queueing the last processed delivery
+}
+
+// Stats returns metrics of webhook ingestion
+func (r *Receiver) Stats() Stats {
+	r.mu.Lock()
+	s := r.stats
+	r.mu.Unlock()
+	return s
+}
+
+func (r *Receiver) init() {
+	r.once.Do(func() {
+		r.wake = make(chan struct{}, 1)
+	})
+}
+
+// accepted counts an accepted delivery and wakes Run up
+func (r *Receiver) accepted() {
+	r.init()
+	r.mu.Lock()
+	r.stats.Accepted++
+	r.stats.Pending++
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends events of pending deliveries to Ch in the order they were
+// received, including those left pending when the ci was stopped. It
+// never returns unless Log is nil. A delivery is marked queued once
+// its event is received from Ch, so Ch should be unbuffered to keep
+// events in Log until they are handled. An event may be sent twice if
+// the ci stops before its delivery is marked queued.
+func (r *Receiver) Run() {
+	if r.Log == nil {
+		return
+	}
+	r.init()
+	for {
+		ds, total, err := r.Log.Pending(consumeBatch)
+		if err != nil {
+			log.Println("load pending deliveries", err)
+			time.Sleep(retryDelay)
+			continue
+		}
+		r.mu.Lock()
+		r.stats.Pending = total
+		r.mu.Unlock()
+
+		if len(ds) == 0 {
+			select {
+			case <-r.wake:
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		for _, d := range ds {
+			if r.consume(d) != nil {
+				time.Sleep(retryDelay)
+				break
+			}
+		}
+	}
+}
+
+// consume sends the event of pending delivery d to Ch, and records the
+// outcome.
+func (r *Receiver) consume(d Delivery) error {
+	e, err := Decode(d.Event, d.Body)
+	if err != nil {
+		return r.setOutcome(d.Seq, "malformed: "+err.Error())
+	}
+	if e == nil {
+		return r.setOutcome(d.Seq, Ignored)
+	}
+
+	start := time.Now()
+	r.Ch <- e
+	blocked := time.Since(start)
+	err = r.setOutcome(d.Seq, Queued)
+
+	r.mu.Lock()
+	r.stats.Processed++
+	if r.stats.Pending > 0 {
+		r.stats.Pending--
+	}
+	r.stats.Blocked += blocked
+	if !d.Received.IsZero() {
+		r.stats.Latency = time.Since(d.Received)
+	}
+	r.mu.Unlock()
+	return err
+}
@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Events are the types of events the ci handles
+var Events = []string{"push", "pull_request", "issue_comment", "release"}
+
+// PingEvent is sent by github when a webhook is created, it describes
+// the configuration of the webhook
+type PingEvent struct {
+	Zen    string `json:"zen"`
+	HookID int    `json:"hook_id"`
+	Hook   struct {
+		Type   string   `json:"type"`
+		Active bool     `json:"active"`
+		Events []string `json:"events"`
+		Config struct {
+			ContentType string `json:"content_type"`
+			URL         string `json:"url"`
+		} `json:"config"`
+	} `json:"hook"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"` // nil if the webhook is of an organization
+}
+
+// Check checks the configuration of the webhook sending ping event p
+// against the repository repo built by the ci. A webhook with problems
+// does not work, warnings are about events not sent.
+func (p PingEvent) Check(repo string) (problems, warnings []string) {
+	if t := p.Hook.Config.ContentType; t != "" && t != "json" {
+		problems = append(problems, fmt.Sprintf("content type is %s, set it to application/json", t))
+	}
+	if p.Repository != nil && repo != "" && !strings.EqualFold(p.Repository.FullName, repo) {
+		problems = append(problems, fmt.Sprintf("webhook is of repository %s, the ci builds %s", p.Repository.FullName, repo))
+	}
+
+	sent := make(map[string]bool)
+	for _, e := range p.Hook.Events {
+		sent[e] = true
+	}
+	if sent["*"] {
+		return
+	}
+	var missing []string
+	for _, e := range Events {
+		if !sent[e] {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == len(Events) {
+		problems = append(problems, fmt.Sprintf("webhook sends none of the events the ci handles, select %s", strings.Join(Events, ", ")))
+	} else if len(missing) > 0 {
+		warnings = append(warnings, fmt.Sprintf("webhook does not send %s events", strings.Join(missing, ", ")))
+	}
+	return
+}
+
+// ping checks ping event in body, returns a report of the webhook
+// configuration and the outcome of the delivery. The response status
+// is 400 if the webhook has problems.
+func (r *Receiver) ping(body []byte) (code int, report, outcome string) {
+	var p PingEvent
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return http.StatusBadRequest, err.Error(), "malformed: " + err.Error()
+	}
+
+	problems, warnings := p.Check(r.Repo)
+	lines := []string{fmt.Sprintf("webhook %d sends %s events", p.HookID, strings.Join(p.Hook.Events, ", "))}
+	if p.Repository != nil {
+		lines[0] += " of " + p.Repository.FullName
+	}
+	for _, s := range problems {
+		lines = append(lines, "error: "+s)
+	}
+	for _, s := range warnings {
+		lines = append(lines, "warning: "+s)
+	}
+	for _, s := range lines {
+		log.Println("ping:", s)
+	}
+
+	report = strings.Join(lines, "\n")
+	if len(problems) > 0 {
+		return http.StatusBadRequest, report, "ping: " + strings.Join(problems, "; ")
+	}
+	return http.StatusOK, report, "ping: ok"
+}
+
+// repository returns the full name of the repository of an event in
+// body, empty if the event has no repository.
+func repository(body []byte) string {
+	var e struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	// malformed events are reported by Decode
+	json.Unmarshal(body, &e)
+	return e.Repository.FullName
+}
+
+// isRepo returns whether events of repository repo are received
+func (r *Receiver) isRepo(repo string) bool {
+	return r.Repo == "" || repo == "" || strings.EqualFold(repo, r.Repo)
+}
@@ -0,0 +1,100 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wangkuiyi/ci/webhook"
+)
+
+// ping is the body of a ping event with events, content type and
+// repository to fill in
+const ping = `{
+  "zen": "Keep it logically awesome.",
+  "hook_id": 42,
+  "hook": {
+    "type": "Repository",
+    "active": true,
+    "events": [%s],
+    "config": {"content_type": "%s", "url": "https://ci.example.com/ci/"}
+  },
+  "repository": {"full_name": "%s"}
+}`
+
+func TestPingCheck(t *testing.T) {
+	cases := []struct {
+		events, contentType, repo string
+		problems, warnings        int
+	}{
+		{`"push", "pull_request", "issue_comment", "release"`, "json", "wangkuiyi/ci", 0, 0},
+		{`"*"`, "json", "WangKuiyi/CI", 0, 0},
+		{`"push", "pull_request"`, "json", "wangkuiyi/ci", 0, 1},
+		{`"watch"`, "json", "wangkuiyi/ci", 1, 0},
+		{`"*"`, "form", "wangkuiyi/ci", 1, 0},
+		{`"*"`, "json", "someone/fork", 1, 0},
+		{`"issues"`, "form", "someone/fork", 3, 0},
+	}
+	for i, c := range cases {
+		var p webhook.PingEvent
+		err := json.Unmarshal([]byte(fmt.Sprintf(ping, c.events, c.contentType, c.repo)), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, warnings := p.Check("wangkuiyi/ci")
+		if len(problems) != c.problems || len(warnings) != c.warnings {
+			t.Errorf("case %d: problems %q, warnings %q", i, problems, warnings)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	l := &memLog{outcomes: make(map[uint64]string)}
+	r := &webhook.Receiver{Log: l, Repo: "wangkuiyi/ci"}
+	send := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/ci/", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "ping")
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("application/json", fmt.Sprintf(ping, `"push", "pull_request"`, "json", "wangkuiyi/ci"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "warning: webhook does not send issue_comment, release events") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if l.outcome(1) != "ping: ok" {
+		t.Fatal(l.outcomes)
+	}
+
+	w = send("application/json", fmt.Sprintf(ping, `"*"`, "json", "someone/fork"))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "error: webhook is of repository someone/fork") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	w = send("application/x-www-form-urlencoded", "payload=%7B%7D")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "set it to application/json") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestReceiverRepository(t *testing.T) {
+	ch := make(chan interface{}, 1)
+	r := &webhook.Receiver{Ch: ch, Repo: "wangkuiyi/ci"}
+	for _, repo := range []string{"someone/fork", "wangkuiyi/ci"} {
+		req := httptest.NewRequest("POST", "/ci/", strings.NewReader(`{"ref":"refs/heads/master","repository":{"full_name":"`+repo+`"}}`))
+		req.Header.Set("X-GitHub-Event", "push")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if (w.Code == http.StatusOK) != (repo == "wangkuiyi/ci") {
+			t.Fatal(repo, w.Code, w.Body.String())
+		}
+	}
+	if len(ch) != 1 {
+		t.Fatal(len(ch))
+	}
+}
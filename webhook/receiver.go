@@ -1,40 +1,176 @@
 package webhook
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 // PushEvent is a webhook push event
 type PushEvent struct {
 	Ref        string `json:"ref"`
+	Deleted    bool   `json:"deleted"` // the ref is deleted, head_commit is null
 	HeadCommit struct {
-		ID string `json:"id"`
+		ID      string `json:"id"`
+		Message string `json:"message"`
 	} `json:"head_commit"`
+	Commits    []Commit `json:"commits"` // at most 20 commits, the earliest first
 	Repository struct {
 		CloneURL string `json:"clone_url"`
 	} `json:"repository"`
 }
 
+// Commit is a commit in a push event
+type Commit struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
 // PullRequestEvent is a webhook pull request event
 type PullRequestEvent struct {
 	Action      string `json:"action"`
+	Number      int    `json:"number"`
 	PullRequest struct {
 		ID   int `json:"id"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
 		Head struct {
 			Sha  string `json:"sha"`
 			Ref  string `json:"ref"`
 			Repo struct {
 				CloneURL string `json:"clone_url"`
+				FullName string `json:"full_name"`
 			} `json:"repo"`
 		} `json:"head"`
+		Base struct {
+			Ref  string `json:"ref"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"base"`
 	} `json:"pull_request"`
 }
 
-// Receiver receives webhook events
+// ReleaseEvent is a webhook release event
+type ReleaseEvent struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName    string `json:"tag_name"`
+		Name       string `json:"name"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	} `json:"release"`
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+	} `json:"repository"`
+}
+
+// IssueCommentEvent is a webhook issue comment event, comments on
+// pull requests are issue comments as well
+type IssueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number      int `json:"number"`
+		PullRequest *struct {
+			URL string `json:"url"`
+		} `json:"pull_request"` // nil if the issue is not a pull request
+	} `json:"issue"`
+	Comment struct {
+		Body string `json:"body"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"comment"`
+}
+
+// Delivery is a webhook delivery
+type Delivery struct {
+	Seq      uint64      // set by Log
+	ID       string      // the X-GitHub-Delivery header
+	Event    string      // the X-GitHub-Event header
+	Header   http.Header // headers without credentials
+	Body     []byte
+	Received time.Time // set by Log
+	Outcome  string
+}
+
+// Log records webhook deliveries
+type Log interface {
+	// Add records delivery d, returns the sequence number of the
+	// recorded delivery. dup is true if a delivery with the same id
+	// has been recorded with outcome Pending, Queued or Ignored, its
+	// sequence number is returned.
+	Add(d Delivery) (seq uint64, dup bool, err error)
+	// SetOutcome records how delivery seq was handled
+	SetOutcome(seq uint64, outcome string) error
+	// Pending returns at most n deliveries whose outcome is Pending,
+	// the earliest first, and the number of pending deliveries.
+	Pending(n int) (ds []Delivery, total int, err error)
+}
+
+// Outcomes of deliveries
+const (
+	Pending = "pending" // the event waits to be sent to the event channel
+	Queued  = "queued"  // the event is sent to the event channel
+	Ignored = "ignored" // the event type is not handled
+)
+
+// Decode decodes the body of an event of type event, returns nil if
+// events of the type are not handled.
+func Decode(event string, body []byte) (interface{}, error) {
+	switch event {
+	case "push":
+		e := PushEvent{}
+		err := json.Unmarshal(body, &e)
+		return e, err
+	case "pull_request":
+		e := PullRequestEvent{}
+		err := json.Unmarshal(body, &e)
+		return e, err
+	case "release":
+		e := ReleaseEvent{}
+		err := json.Unmarshal(body, &e)
+		return e, err
+	case "issue_comment":
+		e := IssueCommentEvent{}
+		err := json.Unmarshal(body, &e)
+		return e, err
+	}
+	return nil, nil
+}
+
+// Receiver receives webhook events. If Log is nil, events are sent to
+// Ch while github waits for the response. Otherwise deliveries are
+// recorded in Log and acknowledged at once, redeliveries of recorded
+// deliveries are dropped, and Run sends events of pending deliveries
+// to Ch, which should be unbuffered.
 type Receiver struct {
-	Ch chan<- interface{}
+	Ch  chan<- interface{}
+	Log Log
+	// Repo is the full name of the repository built by the ci, like
+	// owner/name. Events of other repositories are rejected, unless
+	// Repo is empty.
+	Repo string
+	// Secret is the secret of the webhook, deliveries not signed with
+	// it are rejected before they are recorded or decoded. Deliveries
+	// are not verified if Secret is empty.
+	Secret string
+
+	once  sync.Once
+	wake  chan struct{} // wakes Run up when a delivery is pending
+	mu    sync.Mutex
+	stats Stats
 }
 
 func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -45,34 +181,126 @@ func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	eventType := req.Header.Get("X-GitHub-Event")
-	if eventType == "" {
-		http.Error(w, "400 Bad Request - Missing X-GitHub-Event Header", http.StatusBadRequest)
-		return
-	}
-
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !r.verify(req.Header.Get("X-Hub-Signature-256"), body) {
+		log.Println("rejected delivery", req.Header.Get("X-GitHub-Delivery"), "from", req.RemoteAddr, "with an invalid signature")
+		http.Error(w, "401 Unauthorized - invalid X-Hub-Signature-256, set the secret of the webhook to github.secret in ci.yaml", http.StatusUnauthorized)
+		return
+	}
 
-	switch eventType {
-	case "push":
-		e := PushEvent{}
-		err = json.Unmarshal(body, &e)
+	d := Delivery{
+		ID:     req.Header.Get("X-GitHub-Delivery"),
+		Event:  req.Header.Get("X-GitHub-Event"),
+		Header: make(http.Header),
+		Body:   body,
+	}
+	for k, v := range req.Header {
+		if k != "Authorization" && k != "Cookie" {
+			d.Header[k] = v
+		}
+	}
+	code, msg, e := r.check(&d, req.Header.Get("Content-Type"))
+
+	if r.Log == nil {
+		if e != nil {
+			r.Ch <- e
+			code, msg = http.StatusOK, ""
+		}
+	} else {
+		seq, dup, err := r.Log.Add(d)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		r.Ch <- e
-	case "pull_request":
-		e := PullRequestEvent{}
-		err = json.Unmarshal(body, &e)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if dup {
+			fmt.Fprintf(w, "delivery %s has been received\n", d.ID)
 			return
 		}
-		r.Ch <- e
+		if d.Outcome == Pending {
+			r.accepted()
+			msg = fmt.Sprintf("delivery %d is accepted", seq)
+		}
+	}
+
+	if code >= 400 {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if msg != "" {
+		fmt.Fprintln(w, msg)
+	}
+}
+
+// check checks delivery d with content type contentType and sets its
+// outcome, returns the response and the decoded event, nil if the
+// event is not sent to the event channel.
+func (r *Receiver) check(d *Delivery, contentType string) (code int, msg string, e interface{}) {
+	if d.Event == "" {
+		d.Outcome = "missing X-GitHub-Event header"
+		return http.StatusBadRequest, "400 Bad Request - Missing X-GitHub-Event Header", nil
+	}
+
+	if t, _, _ := mime.ParseMediaType(contentType); t != "" && t != "application/json" {
+		d.Outcome = "content type " + t
+		return http.StatusBadRequest, fmt.Sprintf("400 Bad Request - the content type of the webhook is %s, set it to application/json", t), nil
+	}
+	if d.Event == "ping" {
+		code, msg, d.Outcome = r.ping(d.Body)
+		return code, msg, nil
+	}
+	if repo := repository(d.Body); !r.isRepo(repo) {
+		d.Outcome = "repository " + repo
+		return http.StatusBadRequest, fmt.Sprintf("400 Bad Request - the event is of repository %s, the ci builds %s", repo, r.Repo), nil
+	}
+
+	e, err := Decode(d.Event, d.Body)
+	if err != nil {
+		d.Outcome = "malformed: " + err.Error()
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+	if e == nil {
+		d.Outcome = Ignored
+		return http.StatusOK, fmt.Sprintf("%s events are ignored", d.Event), nil
+	}
+	d.Outcome = Pending
+	return http.StatusAccepted, "", e
+}
+
+// verify returns whether signature, the X-Hub-Signature-256 header,
+// is the HMAC of body with the secret.
+func (r *Receiver) verify(signature string, body []byte) bool {
+	if r.Secret == "" {
+		return true
+	}
+	const prefix = "sha256="
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+	sum, err := hex.DecodeString(signature[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sum, Sign(r.Secret, body))
+}
+
+// Sign returns the HMAC-SHA256 of body with secret, github sends it as
+// "sha256=" followed by its hex encoding in X-Hub-Signature-256.
+func Sign(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (r *Receiver) setOutcome(seq uint64, outcome string) error {
+	err := r.Log.SetOutcome(seq, outcome)
+	if err != nil {
+		log.Println("record outcome of delivery", seq, err)
 	}
+	return err
 }
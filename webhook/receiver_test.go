@@ -0,0 +1,178 @@
+package webhook_test
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangkuiyi/ci/webhook"
+)
+
+type memLog struct {
+	mu       sync.Mutex
+	ds       []webhook.Delivery
+	outcomes map[uint64]string
+}
+
+func (l *memLog) Add(d webhook.Delivery) (uint64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, r := range l.ds {
+		o := l.outcomes[r.Seq]
+		if d.ID != "" && r.ID == d.ID && (o == webhook.Pending || o == webhook.Queued || o == webhook.Ignored) {
+			return uint64(i + 1), true, nil
+		}
+	}
+	d.Seq = uint64(len(l.ds) + 1)
+	d.Received = time.Now()
+	l.ds = append(l.ds, d)
+	l.outcomes[d.Seq] = d.Outcome
+	return d.Seq, false, nil
+}
+
+func (l *memLog) SetOutcome(seq uint64, outcome string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.outcomes[seq] = outcome
+	return nil
+}
+
+func (l *memLog) Pending(n int) ([]webhook.Delivery, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ds []webhook.Delivery
+	total := 0
+	for _, d := range l.ds {
+		if l.outcomes[d.Seq] == webhook.Pending {
+			if len(ds) < n {
+				ds = append(ds, d)
+			}
+			total++
+		}
+	}
+	return ds, total, nil
+}
+
+func (l *memLog) outcome(seq uint64) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.outcomes[seq]
+}
+
+func deliver(r *webhook.Receiver, id, event, body string) int {
+	req := httptest.NewRequest("POST", "/ci/", strings.NewReader(body))
+	req.Header.Set("X-GitHub-Delivery", id)
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestReceiver(t *testing.T) {
+	ch := make(chan interface{})
+	l := &memLog{outcomes: make(map[uint64]string)}
+	r := &webhook.Receiver{Ch: ch, Log: l}
+
+	// deliveries are accepted while nothing consumes the event channel
+	for _, ref := range []string{"master", "develop"} {
+		if c := deliver(r, ref, "push", `{"ref":"refs/heads/`+ref+`","head_commit":{"id":"abc"}}`); c != http.StatusAccepted {
+			t.Fatal(c)
+		}
+	}
+	if c := deliver(r, "master", "push", `{"ref":"refs/heads/master","head_commit":{"id":"abc"}}`); c != http.StatusOK {
+		t.Fatal(c)
+	}
+	if c := deliver(r, "2", "watch", `{}`); c != http.StatusOK {
+		t.Fatal(c)
+	}
+	if c := deliver(r, "3", "push", `{"ref":`); c == http.StatusOK || c == http.StatusAccepted {
+		t.Fatal(c)
+	}
+	if c := deliver(r, "4", "", `{}`); c != http.StatusBadRequest {
+		t.Fatal(c)
+	}
+
+	if s := r.Stats(); s.Accepted != 2 || s.Pending != 2 || s.Processed != 0 {
+		t.Fatal(s)
+	}
+	if len(l.ds) != 5 {
+		t.Fatal(l.ds)
+	}
+	if l.ds[0].Event != "push" || l.ds[0].Header.Get("X-GitHub-Delivery") != "master" || l.ds[0].Header.Get("Authorization") != "" {
+		t.Fatal(l.ds[0])
+	}
+	if l.outcome(1) != webhook.Pending || l.outcome(3) != webhook.Ignored ||
+		!strings.HasPrefix(l.outcome(4), "malformed") || l.outcome(5) == "" {
+		t.Fatal(l.outcomes)
+	}
+
+	go r.Run()
+	for _, ref := range []string{"refs/heads/master", "refs/heads/develop"} {
+		e, ok := (<-ch).(webhook.PushEvent)
+		if !ok || e.Ref != ref || e.HeadCommit.ID != "abc" {
+			t.Fatal(e)
+		}
+	}
+	if c := deliver(r, "5", "push", `{"ref":"refs/heads/feature"}`); c != http.StatusAccepted {
+		t.Fatal(c)
+	}
+	if e, ok := (<-ch).(webhook.PushEvent); !ok || e.Ref != "refs/heads/feature" {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 100 && r.Stats().Processed != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l.outcome(1) != webhook.Queued || l.outcome(2) != webhook.Queued || l.outcome(6) != webhook.Queued {
+		t.Fatal(l.outcomes)
+	}
+	if s := r.Stats(); s.Accepted != 3 || s.Processed != 3 || s.Pending != 0 {
+		t.Fatal(s)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	e, err := webhook.Decode("release", []byte(`{"action":"published","release":{"tag_name":"v1.0"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := e.(webhook.ReleaseEvent); !ok || r.Release.TagName != "v1.0" {
+		t.Fatal(e)
+	}
+	e, err = webhook.Decode("watch", []byte(`{}`))
+	if e != nil || err != nil {
+		t.Fatal(e, err)
+	}
+}
+
+func TestReceiverSignature(t *testing.T) {
+	ch := make(chan interface{}, 1)
+	r := &webhook.Receiver{Ch: ch, Secret: "s3cret"}
+	body := `{"ref":"refs/heads/master","head_commit":{"id":"abc"}}`
+	for _, c := range []struct {
+		signature string
+		code      int
+	}{
+		{"", http.StatusUnauthorized},
+		{"sha256=" + hex.EncodeToString(webhook.Sign("guessed", []byte(body))), http.StatusUnauthorized},
+		{"sha1=" + hex.EncodeToString(webhook.Sign("s3cret", []byte(body))), http.StatusUnauthorized},
+		{"sha256=" + hex.EncodeToString(webhook.Sign("s3cret", []byte(body))), http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/ci/", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", c.signature)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Fatal(c.signature, w.Code, w.Body.String())
+		}
+	}
+	if len(ch) != 1 {
+		t.Fatal(len(ch))
+	}
+}